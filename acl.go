@@ -0,0 +1,182 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+
+	"pault.ag/go/debian/control"
+)
+
+// Grant {{{
+
+// Grant is what an uploader, by the fingerprint of their OpenPGP key, is
+// allowed to upload. An empty list allows anything; so a Grant with just
+// a Fingerprint allows that key to upload anything, anywhere.
+type Grant struct {
+	control.Paragraph
+
+	Fingerprint string
+
+	// Names of the Suites the uploader may upload to.
+	Suites []string `delim:" "`
+
+	// Names of the Components the uploader may upload to.
+	Components []string `delim:" "`
+
+	// Patterns (as understood by path.Match, such as "golang-*") the name
+	// of the source package must match.
+	Sources []string `delim:" "`
+}
+
+// Check if the Grant allows an upload of `source` to `suite`, in every one
+// of `components`, returning the reason it doesn't if not.
+func (g Grant) allows(suite string, components []string, source string) (string, bool) {
+	if len(g.Suites) != 0 && !slices.Contains(g.Suites, suite) {
+		return fmt.Sprintf("uploads to %s are not allowed", suite), false
+	}
+
+	for _, component := range components {
+		if len(g.Components) != 0 && !slices.Contains(g.Components, component) {
+			return fmt.Sprintf("uploads to %s are not allowed", component), false
+		}
+	}
+
+	if len(g.Sources) == 0 {
+		return "", true
+	}
+	for _, pattern := range g.Sources {
+		if matched, _ := path.Match(pattern, source); matched {
+			return "", true
+		}
+	}
+	return fmt.Sprintf("uploads of %s are not allowed", source), false
+}
+
+// }}}
+
+// ACL {{{
+
+// ACL is the set of Grants for every uploader allowed to upload to an
+// Archive. An uploader may have more than one Grant; an Upload is accepted
+// if any one of them allows all of it.
+type ACL struct {
+	grants map[string][]Grant
+}
+
+// Create a new, empty, ACL, which allows nothing.
+func NewACL() *ACL {
+	return &ACL{grants: map[string][]Grant{}}
+}
+
+// Load an ACL from a file of Grants, as control paragraphs, such as:
+//
+//	Fingerprint: 0123 4567 89AB CDEF 0123  4567 89AB CDEF 0123 4567
+//	Suites: unstable experimental
+//	Components: main contrib
+//	Sources: golang-* dh-golang
+func LoadACL(in io.Reader) (*ACL, error) {
+	decoder, err := control.NewDecoder(in, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := NewACL()
+	for {
+		grant := Grant{}
+		if err := decoder.Decode(&grant); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err := acl.Allow(grant); err != nil {
+			return nil, err
+		}
+	}
+	return acl, nil
+}
+
+// Load an ACL from the file at `path`. See LoadACL.
+func LoadACLFile(path string) (*ACL, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return LoadACL(fd)
+}
+
+// Add a Grant to the ACL, in addition to any the uploader already has.
+func (a *ACL) Allow(grant Grant) error {
+	fingerprint := normalizeFingerprint(grant.Fingerprint)
+	if fingerprint == "" {
+		return fmt.Errorf("Grant has no Fingerprint")
+	}
+	for _, pattern := range grant.Sources {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Malformed source pattern: '%s'", pattern)
+		}
+	}
+	grant.Fingerprint = fingerprint
+	a.grants[fingerprint] = append(a.grants[fingerprint], grant)
+	return nil
+}
+
+// Remove every Grant an uploader has.
+func (a *ACL) Revoke(fingerprint string) {
+	delete(a.grants, normalizeFingerprint(fingerprint))
+}
+
+// Get the Grants an uploader has, if any.
+func (a ACL) Grants(fingerprint string) []Grant {
+	return a.grants[normalizeFingerprint(fingerprint)]
+}
+
+// Check that the Upload's signer has a Grant covering its Suite, every
+// Component it uploads to, and its source package. If not, a *Rejection
+// is returned.
+func (a ACL) Check(upload Upload) error {
+	fingerprint := upload.Fingerprint()
+	grants := a.grants[fingerprint]
+	if len(grants) == 0 {
+		return Reject("%s is not allowed to upload", fingerprint)
+	}
+
+	seen := map[string]bool{}
+	components := []string{}
+	for _, file := range upload.Changes.Files {
+		component := componentFromSection(file.Component)
+		if !seen[component] {
+			seen[component] = true
+			components = append(components, component)
+		}
+	}
+	sort.Strings(components)
+
+	reason := ""
+	for _, grant := range grants {
+		why, ok := grant.allows(upload.Changes.Distribution, components, changesSource(*upload.Changes))
+		if ok {
+			return nil
+		}
+		if reason == "" {
+			reason = why
+		}
+	}
+	return Reject("%s: %s", fingerprint, reason)
+}
+
+// Create an UploadHook which rejects any Upload the ACL doesn't allow, for
+// passing to Incoming.AddHook.
+func (a *ACL) Hook() UploadHook {
+	return func(upload Upload) error {
+		return a.Check(upload)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"strings"
+	"testing"
+)
+
+// Grant {{{
+
+func TestGrantAllows(t *testing.T) {
+	grant := Grant{
+		Suites:     []string{"unstable", "experimental"},
+		Components: []string{"main", "contrib"},
+		Sources:    []string{"golang-*", "dh-golang"},
+	}
+	for _, test := range []struct {
+		suite      string
+		components []string
+		source     string
+		allowed    bool
+	}{
+		{"unstable", []string{"main"}, "golang-foo", true},
+		{"experimental", []string{"main", "contrib"}, "dh-golang", true},
+		{"stable", []string{"main"}, "golang-foo", false},
+		{"unstable", []string{"main", "non-free"}, "golang-foo", false},
+		{"unstable", []string{"main"}, "dh-golang-extra", false},
+		{"unstable", []string{"main"}, "python-foo", false},
+	} {
+		why, ok := grant.allows(test.suite, test.components, test.source)
+		if ok != test.allowed {
+			t.Errorf(
+				"Upload of %s to %s %v allowed: %t, expected %t (%s)",
+				test.source, test.suite, test.components, ok, test.allowed, why,
+			)
+		}
+	}
+
+	/* An empty Grant allows anything */
+	if why, ok := (Grant{}).allows("stable", []string{"non-free"}, "anything"); !ok {
+		t.Errorf("Empty Grant refused an upload: %s", why)
+	}
+}
+
+// }}}
+
+// ACL {{{
+
+func TestLoadACL(t *testing.T) {
+	acl, err := LoadACL(strings.NewReader(`Fingerprint: 0123 4567 89ab cdef 0123  4567 89AB CDEF 0123 4567
+Suites: unstable
+Sources: golang-*
+
+Fingerprint: 0123456789ABCDEF0123456789ABCDEF01234567
+Suites: experimental
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grants := acl.Grants("0123 4567 89AB CDEF 0123  4567 89AB CDEF 0123 4567")
+	if len(grants) != 2 {
+		t.Fatalf("Expected 2 Grants, got %d", len(grants))
+	}
+	if grants[0].Fingerprint != "0123456789ABCDEF0123456789ABCDEF01234567" {
+		t.Errorf("Fingerprint wasn't normalized: %s", grants[0].Fingerprint)
+	}
+	if len(acl.Grants("FEDCBA9876543210FEDCBA9876543210FEDCBA98")) != 0 {
+		t.Errorf("Unknown uploader has Grants")
+	}
+
+	acl.Revoke("0123456789abcdef0123456789abcdef01234567")
+	if len(acl.Grants("0123456789ABCDEF0123456789ABCDEF01234567")) != 0 {
+		t.Errorf("Revoked uploader still has Grants")
+	}
+
+	if _, err := LoadACL(strings.NewReader("Suites: unstable\n")); err == nil {
+		t.Errorf("Grant without a Fingerprint was loaded")
+	}
+	if _, err := LoadACL(strings.NewReader("Fingerprint: 01234567\nSources: golang-[\n")); err == nil {
+		t.Errorf("Grant with a malformed source pattern was loaded")
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
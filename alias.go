@@ -0,0 +1,72 @@
+package archive
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Aliases {{{
+
+// Also publish the Suite under `alias`, such as "stable" for a Suite named
+// "bookworm". Every file the Suite publishes under dists/<name>/ is linked
+// under dists/<alias>/ too, to the very same blob, by the same Link; so the
+// two can never point at different states.
+//
+// The Release file of a Suite with aliases has its name as the Codename,
+// and its first alias as the Suite, just like Debian's, so that apt will
+// accept it under either name.
+//
+// When an alias moves to another Suite (such as "stable" at a release),
+// the other Suite has to be published with it in the same Link, or it'll
+// keep the old Suite's files until then.
+func (s *Suite) AddAlias(alias string) error {
+	if alias == "" || strings.Contains(alias, "@") || path.Clean(alias) != alias ||
+		strings.HasPrefix(alias, "/") || strings.HasPrefix(alias, "..") {
+		return fmt.Errorf("Invalid alias: '%s'", alias)
+	}
+	if alias == s.Name {
+		return fmt.Errorf("Suite %s can't be an alias of itself", s.Name)
+	}
+	if slices.Contains(s.features.Aliases, alias) {
+		return fmt.Errorf("Suite %s already has alias '%s'", s.Name, alias)
+	}
+	s.features.Aliases = append(s.features.Aliases, alias)
+	return nil
+}
+
+// Get every alias of the Suite, in the order they were added.
+func (s Suite) Aliases() []string {
+	return s.features.Aliases
+}
+
+// Link every file published under dists/<name>/ under dists/<alias>/ for
+// each alias of the Suite, too.
+func (s Suite) addAliases(files ArchiveState) {
+	suiteRoot := path.Join("dists", s.Name) + "/"
+	for target, obj := range files {
+		if !strings.HasPrefix(target, suiteRoot) {
+			continue
+		}
+		relPath := strings.TrimPrefix(target, suiteRoot)
+		for _, alias := range s.features.Aliases {
+			files[path.Join("dists", alias, relPath)] = obj
+		}
+	}
+}
+
+// Check if the file at `target` in `state` is just another name for the
+// file at the same path under dists/<suite>/, linked for an alias.
+func isAliasOf(state ArchiveState, suite string, target string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(target, "dists/"), "/", 2)
+	if !strings.HasPrefix(target, "dists/") || len(parts) != 2 {
+		return false
+	}
+	obj, ok := state[path.Join("dists", suite, parts[1])]
+	return ok && obj == state[target]
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"pault.ag/go/debian/dependency"
+)
+
+// aptly {{{
+
+// AptlyPublished is a single published repository, as listed by
+// `aptly publish list -json`.
+type AptlyPublished struct {
+	Prefix        string
+	Distribution  string
+	Origin        string
+	Label         string
+	Architectures []string
+
+	// Either "snapshot" or "local"; what each of Sources names.
+	SourceKind string
+	Sources    []struct {
+		Component string
+		Name      string
+	}
+}
+
+// AptlySuite is a Suite imported from an aptly published repository,
+// along with what aptly published it from, if known.
+type AptlySuite struct {
+	Suite *Suite
+
+	// The aptly entry the Suite was published from, or nil if no
+	// `aptly publish list -json` output was given to ImportAptly.
+	Published *AptlyPublished
+
+	// Name of the aptly snapshot (or local repo, see the Published
+	// SourceKind) each Component was published from, by Component.
+	Sources map[string]string
+}
+
+// Import the repositories aptly has published under `prefix` (such as "."
+// for the default prefix, or "ppa"), from aptly's root directory at
+// `rootDir` (which has the "public" directory in it), for anyone moving
+// off aptly. Every Package and Source entry, and every pool file, is
+// imported just like Import.
+//
+// `publishList` is optional, and, if not nil, is the output of `aptly
+// publish list -json`. Only the distributions listed there (for `prefix`)
+// are imported, each with its Origin, Label, declared Architectures, and
+// the name of the aptly snapshot (or local repo) each Component came from.
+// Otherwise, every distribution under `prefix` is imported as-is.
+func (a Archive) ImportAptly(rootDir string, prefix string, publishList io.Reader) ([]AptlySuite, error) {
+	prefix = aptlyPrefix(prefix)
+	root := filepath.Join(rootDir, "public", filepath.FromSlash(prefix))
+
+	if publishList == nil {
+		suites, err := a.Import(root)
+		if err != nil {
+			return nil, err
+		}
+		ret := []AptlySuite{}
+		for _, suite := range suites {
+			ret = append(ret, AptlySuite{Suite: suite, Sources: map[string]string{}})
+		}
+		return ret, nil
+	}
+
+	published := []AptlyPublished{}
+	if err := json.NewDecoder(publishList).Decode(&published); err != nil {
+		return nil, fmt.Errorf("Can't parse aptly publish list: %s", err)
+	}
+
+	ret := []AptlySuite{}
+	for i := range published {
+		entry := &published[i]
+		if aptlyPrefix(entry.Prefix) != prefix {
+			continue
+		}
+
+		suites, err := a.Import(root, entry.Distribution)
+		if err != nil {
+			return nil, err
+		}
+		suite := suites[0]
+
+		if err := entry.apply(suite); err != nil {
+			return nil, fmt.Errorf("%s: %s", entry.Distribution, err)
+		}
+
+		sources := map[string]string{}
+		for _, source := range entry.Sources {
+			sources[source.Component] = source.Name
+		}
+		ret = append(ret, AptlySuite{Suite: suite, Published: entry, Sources: sources})
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("Nothing is published under prefix '%s'", prefix)
+	}
+	return ret, nil
+}
+
+// Carry the Origin, Label and Architectures aptly was configured with over
+// to the imported Suite.
+func (p AptlyPublished) apply(suite *Suite) error {
+	if p.Origin != "" {
+		suite.Origin = p.Origin
+	}
+	if p.Label != "" {
+		suite.Label = p.Label
+	}
+
+	arches := []dependency.Arch{}
+	for _, name := range p.Architectures {
+		/* aptly lists "source" (and sometimes "all") alongside the rest */
+		if name == "source" || name == "all" {
+			continue
+		}
+		arch, err := dependency.ParseArch(name)
+		if err != nil {
+			return err
+		}
+		arches = append(arches, *arch)
+	}
+	if len(arches) == 0 {
+		return nil
+	}
+	return suite.SetArchitectures(arches...)
+}
+
+// aptly calls the default prefix ".", and allows a leading or trailing
+// "/" on any other.
+func aptlyPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "."
+	}
+	return prefix
+}
+
+// }}}
+
+// vim: foldmethod=marker
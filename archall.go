@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"pault.ag/go/debian/dependency"
+)
+
+// Architecture: all {{{
+
+// ArchAllPolicy decides how Packages built for "all" are published.
+type ArchAllPolicy int
+
+const (
+	// Publish Packages built for "all" in their own "binary-all" index,
+	// and list "all" in the Release's Architectures. This is the default.
+	ArchAllIndex ArchAllPolicy = iota
+
+	// Copy Packages built for "all" into the Packages index of every other
+	// Architecture in their Component, without a "binary-all" index. This
+	// is what apt releases older than 1.1 expect. If a Component has no
+	// other Architecture, the "binary-all" index is published anyway, and
+	// the Release sets "No-Support-for-Architecture-all: Packages", telling
+	// newer apt releases they're also listed in the other indices.
+	ArchAllDuplicate
+)
+
+// Set how the Suite publishes Packages built for "all".
+func (s *Suite) SetArchAllPolicy(policy ArchAllPolicy) {
+	s.features.ArchAll = policy
+}
+
+// Get the Packages indices to publish for a Component, by Architecture,
+// after adding any missing declared Architectures and applying the Suite's
+// ArchAllPolicy. The Component itself is not
+// changed, so that it can be Engrossed again.
+func (s Suite) packageIndices(component *Component) (map[dependency.Arch]*IndexWriter, error) {
+	ret := map[dependency.Arch]*IndexWriter{}
+	var allWriter *IndexWriter
+	for arch, writer := range component.packageWriters {
+		/* Anything added before the Architectures were declared */
+		if err := s.checkArchitecture(arch); err != nil {
+			return nil, err
+		}
+		if arch.String() == "all" {
+			allWriter = writer
+		}
+		ret[arch] = writer
+	}
+
+	/* Every declared Architecture gets an index, even if it's empty */
+	for _, arch := range s.features.Architectures {
+		if _, ok := component.packageWriters[arch]; ok {
+			continue
+		}
+		writer, err := newIndexWriter(component.suite)
+		if err != nil {
+			return nil, err
+		}
+		ret[arch] = writer
+	}
+
+	if s.features.ArchAll != ArchAllDuplicate || allWriter == nil || len(ret) == 1 {
+		return ret, nil
+	}
+	for arch := range ret {
+		if arch.String() == "all" {
+			delete(ret, arch)
+		}
+	}
+
+	for arch, writer := range ret {
+		merged, err := newIndexWriter(component.suite)
+		if err != nil {
+			return nil, err
+		}
+		merged.entries = append(
+			append([]interface{}{}, writer.entries...),
+			allWriter.entries...,
+		)
+		ret[arch] = merged
+	}
+	return ret, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
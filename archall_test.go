@@ -0,0 +1,100 @@
+package archive
+
+import (
+	"strings"
+	"testing"
+)
+
+// Architecture: all {{{
+
+func TestArchAllPolicy(t *testing.T) {
+	a, err := New(t.TempDir(), newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range []Package{
+		newTestPackage(t, "foo", "1.0", "amd64"),
+		newTestPackage(t, "bar", "1.0", "all"),
+	} {
+		if err := component.AddPackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	/* Name of each index, to the number of entries in it */
+	indices := func() map[string]int {
+		writers, err := suite.packageIndices(component)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := map[string]int{}
+		for arch, writer := range writers {
+			ret[arch.String()] = len(writer.entries)
+		}
+		return ret
+	}
+
+	if got := indices(); len(got) != 2 || got["all"] != 1 || got["amd64"] != 1 {
+		t.Errorf("Unexpected indices with ArchAllIndex: %v", got)
+	}
+
+	suite.SetArchAllPolicy(ArchAllDuplicate)
+	if got := indices(); len(got) != 1 || got["amd64"] != 2 {
+		t.Errorf("Unexpected indices with ArchAllDuplicate: %v", got)
+	}
+	if len(component.packageWriters) != 2 {
+		t.Errorf("packageIndices changed the Component's indices")
+	}
+}
+
+func TestArchAllPolicyRelease(t *testing.T) {
+	for policy, expected := range map[ArchAllPolicy]bool{
+		ArchAllIndex:     false,
+		ArchAllDuplicate: true,
+	} {
+		a, err := New(t.TempDir(), newTestKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		suite, err := a.Suite("unstable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		suite.SetArchAllPolicy(policy)
+		component, err := suite.Component("main")
+		if err != nil {
+			t.Fatal(err)
+		}
+		/* With nothing else to copy them into, binary-all is published */
+		if err := component.AddPackage(newTestPackage(t, "bar", "1.0", "all")); err != nil {
+			t.Fatal(err)
+		}
+		files, err := a.Engross(*suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := files["dists/unstable/main/binary-all/Packages"]; !ok {
+			t.Errorf("binary-all wasn't published with policy %d", policy)
+		}
+		release, err := readBlob(a.Store, files["dists/unstable/Release"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Contains(string(release), "No-Support-for-Architecture-all: Packages")
+		if got != expected {
+			t.Errorf("No-Support-for-Architecture-all set: %t, expected %t, with policy %d", got, expected, policy)
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
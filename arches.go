@@ -0,0 +1,68 @@
+package archive
+
+import (
+	"fmt"
+
+	"pault.ag/go/debian/dependency"
+)
+
+// Architectures {{{
+
+// Declare every Architecture the Suite supports, up front. Once declared,
+// AddPackage rejects any Package that isn't built for one of them (or for
+// "all"), every Component gets a Packages index for each of them (even if
+// it's empty), and the Release lists exactly these Architectures (along
+// with "all", if there's a "binary-all" index), rather than whatever
+// happened to be added.
+//
+// By default, no Architectures are declared, and anything is accepted.
+func (s *Suite) SetArchitectures(arches ...dependency.Arch) error {
+	seen := map[string]bool{}
+	declared := []dependency.Arch{}
+	for _, arch := range arches {
+		name := arch.String()
+		switch name {
+		case "":
+			return fmt.Errorf("Empty architecture")
+		case "all", "any", "source":
+			return fmt.Errorf("Can't declare architecture: '%s'", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("Architecture given more than once: '%s'", name)
+		}
+		seen[name] = true
+		declared = append(declared, arch)
+	}
+	sortArches(declared)
+	s.features.Architectures = declared
+	return nil
+}
+
+// Get the Architectures declared with SetArchitectures, if any.
+func (s Suite) Architectures() []dependency.Arch {
+	return s.features.Architectures
+}
+
+// Check that a Package built for `arch` may be added to the Suite.
+func (s Suite) checkArchitecture(arch dependency.Arch) error {
+	if len(s.features.Architectures) == 0 || arch.String() == "all" {
+		return nil
+	}
+	if s.declaresArchitecture(arch) {
+		return nil
+	}
+	return fmt.Errorf("Architecture '%s' isn't supported by suite %s", arch.String(), s.Name)
+}
+
+func (s Suite) declaresArchitecture(arch dependency.Arch) bool {
+	for _, declared := range s.features.Architectures {
+		if declared.String() == arch.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// }}}
+
+// vim: foldmethod=marker
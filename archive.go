@@ -1,23 +1,30 @@
 package archive
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
+	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"crypto"
-	"crypto/sha512"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
 
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/clearsign"
-	"golang.org/x/crypto/openpgp/packet"
-
-	"pault.ag/go/blobstore"
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/dependency"
 	"pault.ag/go/debian/transput"
+	"pault.ag/go/debian/version"
 )
 
 // Archive {{{
@@ -25,10 +32,26 @@ import (
 // Core Archive abstrcation. This contains helpers to write out package files,
 // as well as handles creating underlying abstractions (such as Suites).
 type Archive struct {
-	Store      blobstore.Store
+	Store      Store
 	signingKey *openpgp.Entity
 	path       string
 	Pool       Pool
+
+	/* Signing keys used alongside signingKey, during a key rotation */
+	rotationKeys []*openpgp.Entity
+
+	armoredSignatures bool
+
+	publishTime time.Time
+	logger      *slog.Logger
+	audit       *auditLog
+
+	publishHooks []namedPublishHook
+
+	/* How long blobs and paths have to go unused before GC removes them */
+	gcGrace time.Duration
+
+	verifyLink bool
 }
 
 // Create a new Archive at the given `root` on the filesystem, with the
@@ -45,16 +68,30 @@ func New(path string, signer *openpgp.Entity) (*Archive, error) {
 		return nil, err
 	}
 
-	store, err := blobstore.Load(path)
+	store, err := NewFilesystemStore(path)
 	if err != nil {
 		return nil, err
 	}
 
+	archive, err := NewWithStore(store, signer)
+	if err != nil {
+		return nil, err
+	}
+	archive.path = path
+	return archive, nil
+}
+
+// Create a new Archive backed by the given Store, with the openpgp.Entity
+// `signer`, just like New. This allows the Archive to be written somewhere
+// other than the local filesystem.
+//
+// An Archive created this way has no local Path, so anything that needs
+// one (such as Lock) will return an error.
+func NewWithStore(store Store, signer *openpgp.Entity) (*Archive, error) {
 	return &Archive{
-		Store:      *store,
+		Store:      store,
 		signingKey: signer,
-		path:       path,
-		Pool:       Pool{Store: *store},
+		Pool:       Pool{Store: store},
 	}, nil
 }
 
@@ -62,19 +99,164 @@ func (a Archive) Path() string {
 	return a.path
 }
 
-// Use the default backend to remove any unlinked files from the Blob store.
+// Set how the Archive's Store publishes files; by hardlinking, symlinking
+// or copying them out of the blob store. This is only supported by the
+// FilesystemStore (the Store New creates), and takes effect straight away
+// for every copy of the Archive, and every Suite made from it.
+func (a *Archive) SetLinkStrategy(strategy LinkStrategy) error {
+	store, ok := a.Store.(*FilesystemStore)
+	if !ok {
+		return fmt.Errorf("Store doesn't support link strategies")
+	}
+	return store.SetLinkStrategy(strategy)
+}
+
+// Pin the time every Release file and signature is published with, so
+// that publishing the same content twice gives the same bytes. Passing the
+// zero Time goes back to using SOURCE_DATE_EPOCH, or the current time.
+func (a *Archive) SetPublishTime(when time.Time) {
+	a.publishTime = when
+}
+
+// Get the time to publish with; either the time set by SetPublishTime, the
+// time in the SOURCE_DATE_EPOCH environment variable, or the current time,
+// in that order.
+func (a Archive) PublishTime() (time.Time, error) {
+	if !a.publishTime.IsZero() {
+		return a.publishTime, nil
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid SOURCE_DATE_EPOCH: '%s'", epoch)
+		}
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Now(), nil
+}
+
+// Use the Store to remove any unlinked files from the Blob store.
 //
 // If files you care about are not linked onto the stage, they will be removed
 // by the garbage collector. GC only when you're sure the stage has been
-// set.
+// set. See GCUnreferenced to also remove files no Suite refers to.
 func (a Archive) GC() error {
-	return a.Store.GC(blobstore.DumbGarbageCollector{})
+	return a.GCContext(context.Background())
+}
+
+// GC, with every Store operation made with `ctx`, if the Store supports
+// it.
+func (a Archive) GCContext(ctx context.Context) error {
+	return a.gc(ctx, nil)
+}
+
+// Run the Store's GC, recording it (along with any paths `unlinked` to
+// get there) in the audit log.
+func (a Archive) gc(ctx context.Context, unlinked []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a = a.withContext(ctx)
+
+	if a.gcGrace > 0 {
+		removed, err := a.gcBlobs()
+		if err != nil {
+			return err
+		}
+		a.info("gc", "removed", removed)
+	} else if a.logger != nil {
+		/* Only worth finding out what's going to go if anyone's listening */
+		garbage, err := a.Store.Garbage()
+		if err != nil {
+			return err
+		}
+		if err := a.Store.GC(); err != nil {
+			return err
+		}
+		a.info("gc", "removed", len(garbage))
+	} else if err := a.Store.GC(); err != nil {
+		return err
+	}
+	return a.record(AuditEvent{Action: AuditGC, Paths: unlinked})
+}
+
+// Get a copy of the Archive, with the Store (and Pool) making every
+// operation with `ctx`, if the Store supports it.
+func (a Archive) withContext(ctx context.Context) Archive {
+	a.Store = storeWithContext(a.Store, ctx)
+	a.Pool = a.Pool.WithContext(ctx)
+	return a
+}
+
+// Re-read every blob passed to Link, checking that it still hashes to its
+// Object ID, before anything is linked; so that a blob that's rotted (or
+// been tampered with) since it was committed is never published. This
+// means reading every blob back in full, so it's off by default.
+func (a *Archive) SetVerifyOnLink(verify bool) {
+	a.verifyLink = verify
 }
 
 // Given a list of objects, link them to the keyed paths.
+//
+// This is done as a single transaction; every object is checked before
+// anything is linked into place (with the Release files last), and if
+// anything goes wrong, the Archive is rolled back to how it was before
+// Link was called. Once everything is linked, each PublishHook is run.
 func (a Archive) Link(blobs ArchiveState) error {
-	for path, obj := range blobs {
-		if err := a.Store.Link(obj, path); err != nil {
+	return a.LinkContext(context.Background(), blobs)
+}
+
+// Link, stopping (and rolling back) once `ctx` is done. The rollback itself
+// is not done with `ctx`, so that it can still finish once `ctx` is done.
+func (a Archive) LinkContext(ctx context.Context, blobs ArchiveState) error {
+	txn := a.withContext(ctx).newTransaction()
+	txn.undo = a.Store
+	if err := txn.stage(blobs); err != nil {
+		return err
+	}
+
+	for _, target := range linkOrder(blobs) {
+		err := ctx.Err()
+		if err == nil {
+			err = txn.swap(target, blobs[target])
+		}
+		if err != nil {
+			a.warn("link failed, rolling back", "path", target, "error", err)
+			if rollbackErr := txn.rollback(); rollbackErr != nil {
+				return fmt.Errorf("%s (and rollback failed: %s)", err, rollbackErr)
+			}
+			return err
+		}
+	}
+	a.info("linked", "paths", len(blobs))
+	if err := a.recordPublish(blobs); err != nil {
+		return err
+	}
+	a.notifyPublish(blobs, txn.previous)
+	return nil
+}
+
+// Record a publish in the audit log for each Suite (or Snapshot) whose
+// Release was linked, along with every path linked under it.
+func (a Archive) recordPublish(blobs ArchiveState) error {
+	targets := linkOrder(blobs)
+	for _, target := range targets {
+		if !isSuiteRelease(target) {
+			continue
+		}
+		dir := path.Dir(target)
+		paths := []string{}
+		for _, el := range targets {
+			if strings.HasPrefix(el, dir+"/") {
+				paths = append(paths, el)
+			}
+		}
+		event := AuditEvent{
+			Action: AuditPublish,
+			Suite:  strings.TrimPrefix(dir, "dists/"),
+			Paths:  paths,
+		}
+		if err := a.record(event); err != nil {
 			return err
 		}
 	}
@@ -86,15 +268,16 @@ func (a Archive) Link(blobs ArchiveState) error {
 //
 // This will be an entirely empty object, without anything read off disk.
 func newRelease(suite Suite) (*Release, error) {
-	when := time.Now()
+	when, err := suite.archive.PublishTime()
+	if err != nil {
+		return nil, err
+	}
 
 	var validUntil string = ""
-	if suite.features.Duration != "" {
-		duration, err := time.ParseDuration(suite.features.Duration)
-		if err != nil {
-			return nil, err
-		}
-		validUntil = when.Add(duration).In(time.UTC).Format(time.RFC1123Z)
+	if !suite.features.ValidUntil.IsZero() {
+		validUntil = suite.features.ValidUntil.In(time.UTC).Format(time.RFC1123Z)
+	} else if suite.features.Duration != 0 {
+		validUntil = when.Add(suite.features.Duration).In(time.UTC).Format(time.RFC1123Z)
 	}
 
 	release := Release{
@@ -105,6 +288,10 @@ func newRelease(suite Suite) (*Release, error) {
 		Label:       suite.Label,
 		Version:     suite.Version,
 	}
+	if len(suite.features.Aliases) > 0 {
+		release.Codename = suite.Name
+		release.Suite = suite.features.Aliases[0]
+	}
 	release.Date = when.In(time.UTC).Format(time.RFC1123Z)
 	release.Architectures = []dependency.Arch{}
 	release.Components = []string{}
@@ -115,18 +302,131 @@ func newRelease(suite Suite) (*Release, error) {
 	return &release, nil
 }
 
+// Names of the Release fields each hash algorithm is written to.
+var releaseHashFields = map[string]string{
+	"md5":    "MD5Sum",
+	"sha1":   "SHA1",
+	"sha256": "SHA256",
+	"sha512": "SHA512",
+}
+
+// Render the Release into a Paragraph, along with any extra fields set
+// on the Suite's Paragraph (such as "Changelogs", or any "X-" fields).
+// Fields the Release already sets take precedence.
+//
+// Only the hash fields for the Suite's hash algorithms are written, in the
+// order they were given to SetHashes.
+func newReleaseParagraph(suite Suite, release *Release) (*control.Paragraph, error) {
+	para, err := control.ConvertToParagraph(release)
+	if err != nil {
+		return nil, err
+	}
+
+	hashFields := map[string]bool{}
+	for _, field := range releaseHashFields {
+		hashFields[field] = true
+	}
+	order := []string{}
+	for _, key := range para.Order {
+		if hashFields[key] {
+			continue
+		}
+		order = append(order, key)
+	}
+	if suite.features.ByHash {
+		para.Values["Acquire-By-Hash"] = "yes"
+		order = append(order, "Acquire-By-Hash")
+	}
+	for _, algorithm := range suite.features.Hashes {
+		field := releaseHashFields[algorithm]
+		if _, ok := para.Values[field]; ok {
+			order = append(order, field)
+		}
+	}
+	for field := range hashFields {
+		if !slices.Contains(order, field) {
+			delete(para.Values, field)
+		}
+	}
+	para.Order = order
+
+	for _, key := range suite.Order {
+		if _, ok := para.Values[key]; ok {
+			continue
+		}
+		para.Order = append(para.Order, key)
+		para.Values[key] = suite.Values[key]
+	}
+	return para, nil
+}
+
 // This is a set of file changes ready to be passed to `Link` to link in.
 // Basically, this maps file paths to blobstore objects, which will be
 // swapped in all at once. This allows errors to avoid mutating state in
 // the archive.
-type ArchiveState map[string]blobstore.Object
+type ArchiveState map[string]Object
 
 // Engross a Suite for signing and final commit into the blobstore. This
 // will return handle(s) to the signed and ready Objects, fit for passage
 // to Link.
 //
-// This will contain all the related Packages and Release files.
+// This will contain all the related Packages and Release files. If the
+// Suite has linting turned on (with SetLint), it's linted first, and a
+// LintReport is returned if anything's broken.
+//
+// If the Suite has been published before, any Packages or Sources index
+// that hasn't changed since (going by the hashes in the published Release)
+// isn't written out again; the blobs already published for it are reused,
+// which saves compressing every index of a large Suite each time.
 func (a Archive) Engross(suite Suite) (ArchiveState, error) {
+	return a.EngrossContext(context.Background(), suite)
+}
+
+// Engross, stopping once `ctx` is done. Anything committed to the Store
+// before then is left for GC to clean up.
+func (a Archive) EngrossContext(ctx context.Context, suite Suite) (ArchiveState, error) {
+	return a.EngrossWith(ctx, suite, EngrossOptions{})
+}
+
+// EngrossOptions overrides, for a single Engross, what the Release would
+// otherwise get from the Archive and Suite.
+type EngrossOptions struct {
+	// The Date of the Release, and the time it's signed at, rather than
+	// the Archive's PublishTime; such as the Date of a historical Release
+	// being published again, byte for byte.
+	Date time.Time
+
+	// The Valid-Until of the Release, rather than the Date plus the
+	// Suite's SetValidUntil duration.
+	ValidUntil time.Time
+
+	// Leave Valid-Until out of the Release, such as for a frozen Suite
+	// that's never going to be published again. This takes precedence
+	// over ValidUntil.
+	NoValidUntil bool
+}
+
+// Engross, stopping once `ctx` is done, with the given overrides for just
+// this Engross.
+func (a Archive) EngrossWith(ctx context.Context, suite Suite, options EngrossOptions) (ArchiveState, error) {
+	a = a.withContext(ctx)
+	suiteArchive := suite.archive.withContext(ctx)
+	suite.archive = &suiteArchive
+
+	if !options.Date.IsZero() {
+		a.publishTime = options.Date
+		suiteArchive.publishTime = options.Date
+	}
+	suite.features.ValidUntil = options.ValidUntil
+	if options.NoValidUntil {
+		suite.features.ValidUntil = time.Time{}
+		suite.features.Duration = 0
+	}
+
+	if err := a.lintSuite(suite); err != nil {
+		return nil, err
+	}
+
 	release, err := newRelease(suite)
 	if err != nil {
 		return nil, err
@@ -135,149 +435,443 @@ func (a Archive) Engross(suite Suite) (ArchiveState, error) {
 	files := ArchiveState{}
 	arches := map[dependency.Arch]bool{}
 
-	for name, component := range suite.components {
+	/* Every index is its own blob, so they can all be written out at
+	 * once, before registering them in order below */
+	writers := []*IndexWriter{}
+	indexPaths := []string{}
+	packageIndices := map[string]map[dependency.Arch]*IndexWriter{}
+	for _, name := range suite.componentNames() {
+		component := suite.components[name]
+		indices, err := suite.packageIndices(component)
+		if err != nil {
+			return nil, err
+		}
+		packageIndices[name] = indices
+		for _, arch := range sortedArches(indices) {
+			writers = append(writers, indices[arch])
+			indexPaths = append(indexPaths, path.Join(name, fmt.Sprintf("binary-%s", arch), "Packages"))
+		}
+		if component.sourceWriter != nil {
+			writers = append(writers, component.sourceWriter)
+			indexPaths = append(indexPaths, path.Join(name, "source", "Sources"))
+		}
+	}
+	if err := a.commitIndices(ctx, suite, writers, indexPaths); err != nil {
+		return nil, err
+	}
+
+	/* Walk everything in a stable order, so that publishing the same
+	 * Suite twice gives the same Release file */
+	for _, name := range suite.componentNames() {
+		component := suite.components[name]
 		release.Components = append(release.Components, name)
-		for arch, writer := range component.packageWriters {
+		indices := packageIndices[name]
+		for _, arch := range sortedArches(indices) {
+			writer := indices[arch]
 			arches[arch] = true
 
-			// For each Binary entry, do the same as above (todo: someone
-			// DRY this out a bit. I'm too lazy.
-
-			suitePath := path.Join(name, fmt.Sprintf("binary-%s", arch),
-				"Packages")
-
-			obj, err := a.Store.Commit(*writer.handle)
-			if err != nil {
+			indexPath := path.Join(name, fmt.Sprintf("binary-%s", arch))
+			a.registerIndex(suite, release, files, path.Join(indexPath, "Packages"), writer)
+			if err := a.commitIndexRelease(
+				suite, release, files, name, arch.String(),
+				path.Join(indexPath, "Release"),
+			); err != nil {
 				return nil, err
 			}
+		}
 
-			for _, hasher := range writer.hashers {
-				fileHash := control.FileHashFromHasher(suitePath, *hasher)
-				release.AddHash(fileHash)
+		if component.sourceWriter != nil {
+			indexPath := path.Join(name, "source")
+			a.registerIndex(suite, release, files, path.Join(indexPath, "Sources"), component.sourceWriter)
+			if err := a.commitIndexRelease(
+				suite, release, files, name, "source",
+				path.Join(indexPath, "Release"),
+			); err != nil {
+				return nil, err
 			}
+		}
+
+		if err := a.commitDEP11(suite, release, files, component); err != nil {
+			return nil, err
+		}
 
-			filePath := path.Join("dists", suite.Name, suitePath)
-			files[filePath] = *obj
+		if err := a.commitTranslations(suite, release, files, component); err != nil {
+			return nil, err
+		}
+
+		if err := a.commitBuildinfo(suite, release, files, component); err != nil {
+			return nil, err
 		}
 	}
 
-	for arch, _ := range arches {
+	for arch := range arches {
 		release.Architectures = append(release.Architectures, arch)
+		/* The binary-all Packages are also in every other index */
+		if arch.String() == "all" && suite.features.ArchAll == ArchAllDuplicate {
+			release.NoSupportForArchitectureAll = "Packages"
+		}
 	}
+	sortArches(release.Architectures)
 
-	/* Now, let's do some magic */
+	if err := a.commitContents(suite, release, files, packageIndices); err != nil {
+		return nil, err
+	}
 
-	// Now, let's write out the Release file (and sign it normally)
-	obj, sig, err := suite.archive.encodeSigned(release)
-	if err != nil {
+	if err := a.commitDeltas(suite, files, packageIndices); err != nil {
 		return nil, err
 	}
 
-	filePath := path.Join("dists", suite.Name, "Release")
-	files[filePath] = *obj
-	files[fmt.Sprintf("%s.gpg", filePath)] = *sig
+	/* Now, let's do some magic */
 
-	// Ditto with the clearsigned version (Should we merge the two above?)
-	obj, err = suite.archive.encodeClearsigned(release)
+	releaseParagraph, err := newReleaseParagraph(suite, release)
 	if err != nil {
 		return nil, err
 	}
 
-	files[path.Join("dists", suite.Name, "InRelease")] = *obj
+	if err := suite.archive.signRelease(suite, releaseParagraph, files); err != nil {
+		return nil, err
+	}
+	suite.addAliases(files)
 
 	return files, nil
 }
 
-// Given a control.Marshal'able object, encode it to the blobstore, while
-// also clearsigning the data.
-func (a Archive) encodeClearsigned(data interface{}) (*blobstore.Object, error) {
+// Apply the Suite's retention policy to each IndexWriter, and then Flush
+// every IndexWriter to the store, a few at a time, unless what's already
+// published at its path in `indexPaths` (relative to the Suite's dists
+// directory) can be reused.
+func (a Archive) commitIndices(
+	ctx context.Context,
+	suite Suite,
+	writers []*IndexWriter,
+	indexPaths []string,
+) error {
+	for _, writer := range writers {
+		for _, entry := range writer.retain(suite.features.Retain) {
+			writer.suite.recordRemoved(entry)
+		}
+	}
 
-	if a.signingKey == nil {
-		return nil, fmt.Errorf("No signing key loaded")
+	published, err := a.publishedIndices(suite)
+	if err != nil {
+		return err
 	}
 
-	fd, err := a.Store.Create()
+	errs := make([]error, len(writers))
+	reused := make([]bool, len(writers))
+
+	limit := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, writer := range writers {
+		wg.Add(1)
+		go func(i int, writer *IndexWriter) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			if errs[i] = ctx.Err(); errs[i] != nil {
+				return
+			}
+			reused[i], errs[i] = a.reuseIndex(suite, published, indexPaths[i], writer)
+			if errs[i] != nil || reused[i] {
+				return
+			}
+			errs[i] = writer.flush(a.Store)
+		}(i, writer)
+	}
+	wg.Wait()
+
+	/* Nothing should be left open by now, but if anything is, don't leak
+	 * it, whichever writer failed */
+	for _, writer := range writers {
+		writer.Close()
+	}
+
+	for i, writer := range writers {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if reused[i] {
+			a.debug("index unchanged", "suite", suite.Name, "path", indexPaths[i])
+			continue
+		}
+		for _, file := range writer.files {
+			a.debug("blob committed", "object", file.obj.ID)
+		}
+	}
+	return nil
+}
+
+// Register an IndexWriter's committed Objects at `suitePath` (relative to
+// the Suite's dists directory), plus the compression's extension, in both
+// the ArchiveState and the Release's hash lists. The uncompressed index is
+// listed in the Release even if it's not published, unless the Suite's
+// UncompressedPolicy is OmitUncompressed.
+func (a Archive) registerIndex(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	suitePath string,
+	writer *IndexWriter,
+) {
+	if suite.listUncompressed() {
+		for _, hasher := range writer.hashers {
+			fileHash := control.FileHashFromHasher(suitePath, *hasher)
+			release.AddHash(fileHash)
+		}
+	}
+
+	for _, file := range writer.files {
+		filePath := suitePath + file.suffix
+		fileHashes := file.fileHashes(filePath)
+		if file.suffix != "" {
+			for _, fileHash := range fileHashes {
+				release.AddHash(fileHash)
+			}
+		}
+
+		files[path.Join("dists", suite.Name, filePath)] = *file.obj
+		a.registerByHash(suite, files, filePath, fileHashes, *file.obj)
+		a.info("index written",
+			"suite", suite.Name, "path", filePath,
+			"entries", len(writer.entries), "object", file.obj.ID)
+	}
+}
+
+// Write out the small per-index Release file apt (and plenty of mirroring
+// tools) still expect alongside each index, such as
+// "main/binary-amd64/Release", and register it like any other file.
+func (a Archive) commitIndexRelease(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	component string,
+	arch string,
+	suitePath string,
+) error {
+	paragraph := control.Paragraph{Values: map[string]string{}, Order: []string{}}
+	for _, field := range []struct{ key, value string }{
+		{"Archive", suite.Name},
+		{"Version", suite.Version},
+		{"Component", component},
+		{"Origin", suite.Origin},
+		{"Label", suite.Label},
+		{"Architecture", arch},
+	} {
+		if field.value != "" {
+			paragraph.Set(field.key, field.value)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	encoder, err := control.NewEncoder(&buf)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if err := encoder.Encode(paragraph); err != nil {
+		return err
 	}
+	return a.commitFile(suite, release, files, suitePath, &buf)
+}
 
-	defer fd.Close()
-	wc, err := clearsign.Encode(fd, a.signingKey.PrivateKey, &packet.Config{
-		DefaultHash: crypto.SHA512,
-	})
+// Check if a path under dists is a Suite's (or Snapshot's) top level
+// Release file, rather than one of the per-index Release files next to a
+// Packages or Sources index.
+func isSuiteRelease(target string) bool {
+	if path.Base(target) != "Release" {
+		return false
+	}
+	dir := path.Base(path.Dir(target))
+	return dir != "source" && !strings.HasPrefix(dir, "binary-")
+}
+
+// Write the data out to a new blob in the store, and register the
+// resulting Object at `suitePath` (relative to the Suite's dists
+// directory) in both the ArchiveState and the Release's hash lists.
+func (a Archive) commitFile(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	suitePath string,
+	data io.Reader,
+) error {
+	handle, err := a.Store.Create()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer handle.Close()
 
-	encoder, err := control.NewEncoder(wc)
+	writer, hashers, err := getHashers(&suite)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err := encoder.Encode(data); err != nil {
-		return nil, err
+	if _, err := io.Copy(io.MultiWriter(writer, handle), data); err != nil {
+		return err
 	}
 
-	if err := wc.Close(); err != nil {
-		return nil, err
+	obj, err := a.Store.Commit(handle)
+	if err != nil {
+		return err
+	}
+
+	fileHashes := []control.FileHash{}
+	for _, hasher := range hashers {
+		fileHash := control.FileHashFromHasher(suitePath, *hasher)
+		release.AddHash(fileHash)
+		fileHashes = append(fileHashes, fileHash)
 	}
 
-	return a.Store.Commit(*fd)
+	files[path.Join("dists", suite.Name, suitePath)] = *obj
+	a.registerByHash(suite, files, suitePath, fileHashes, *obj)
+	a.info("file written", "suite", suite.Name, "path", suitePath, "object", obj.ID)
+	return nil
 }
 
-// Given a control.Marshal'able object, encode it to the blobstore, while
-// also doing a detached OpenPGP signature. The objects returned (in order)
-// are data, commited to the blobstore, the signature for that object, commited
-// to the blobstore, and any error(s), finally.
-func (a Archive) encodeSigned(data interface{}) (*blobstore.Object, *blobstore.Object, error) {
-	/* Right, so, the trick here is that we secretly call out to encode,
-	 * but tap it with a pipe into the signing code */
+// Write the data out to a new blob in each of the Suite's Compressions,
+// and register each at `suitePath` (relative to the Suite's dists
+// directory) plus the compression's extension, like commitFile. This
+// returns the hashes of every file written, as listed in the Release.
+func (a Archive) commitCompressed(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	suitePath string,
+	data []byte,
+) ([]control.FileHash, error) {
+	ret := []control.FileHash{}
+	for _, suffix := range suite.features.Compressions {
+		file, err := newIndexFile(a.Store, &suite, suffix)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.writer.Write(data); err != nil {
+			file.close()
+			return nil, err
+		}
+		if err := file.flush(); err != nil {
+			file.close()
+			return nil, err
+		}
+		if err := file.commit(a.Store); err != nil {
+			return nil, err
+		}
 
+		filePath := suitePath + suffix
+		fileHashes := file.fileHashes(filePath)
+		for _, fileHash := range fileHashes {
+			release.AddHash(fileHash)
+			ret = append(ret, fileHash)
+		}
+		files[path.Join("dists", suite.Name, filePath)] = *file.obj
+		a.registerByHash(suite, files, filePath, fileHashes, *file.obj)
+		a.info("file written", "suite", suite.Name, "path", filePath, "object", file.obj.ID)
+	}
+	return ret, nil
+}
+
+// Encode the Release for the Suite into the blobstore, and sign it, adding
+// the Release, Release.gpg and InRelease files to the ArchiveState.
+//
+// The Release is only encoded once; the detached signature and the
+// clearsigned InRelease are both made from the very same bytes as the
+// Release file, so the three always agree.
+func (a Archive) signRelease(suite Suite, data interface{}, files ArchiveState) error {
 	if a.signingKey == nil {
-		return nil, nil, fmt.Errorf("No signing key loaded")
+		return fmt.Errorf("No signing key loaded")
 	}
 
-	signature, err := a.Store.Create()
+	when, err := a.PublishTime()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	defer signature.Close()
 
-	hash := sha512.New()
+	/* Release files are small, so keep a copy to sign */
+	body := bytes.Buffer{}
+	obj, err := a.encode(data, &body)
+	if err != nil {
+		return err
+	}
 
-	obj, err := a.encode(data, hash)
+	sig, err := a.detachSign(body.Bytes(), when, suite.armoredSignature())
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	sig := new(packet.Signature)
-	sig.SigType = packet.SigTypeBinary
-	sig.PubKeyAlgo = a.signingKey.PrivateKey.PubKeyAlgo
+	inRelease, err := a.clearsign(body.Bytes(), when)
+	if err != nil {
+		return err
+	}
 
-	sig.Hash = crypto.SHA512
+	filePath := path.Join("dists", suite.Name, "Release")
+	files[filePath] = *obj
+	files[fmt.Sprintf("%s.gpg", filePath)] = *sig
+	files[path.Join("dists", suite.Name, "InRelease")] = *inRelease
+	a.info("release signed", "suite", suite.Name, "files", len(files))
 
-	sig.CreationTime = new(packet.Config).Now()
-	sig.IssuerKeyId = &(a.signingKey.PrivateKey.KeyId)
+	keys := []string{}
+	for _, key := range a.signers(when) {
+		keys = append(keys, fmt.Sprintf("%X", key.Fingerprint))
+	}
+	return a.record(AuditEvent{Action: AuditSign, Suite: suite.Name, Keys: keys})
+}
 
-	err = sig.Sign(hash, a.signingKey.PrivateKey, &packet.Config{
-		DefaultHash: crypto.SHA512,
-	})
+// Clearsign `body` with every signing key, and commit it to the blobstore.
+func (a Archive) clearsign(body []byte, when time.Time) (*Object, error) {
+	fd, err := a.Store.Create()
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
 
+	wc, err := clearsign.EncodeMulti(fd, a.signers(when), signatureConfig(when))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if err := sig.Serialize(signature); err != nil {
-		return nil, nil, err
+	if _, err := wc.Write(body); err != nil {
+		return nil, err
 	}
 
-	sigObj, err := a.Store.Commit(*signature)
+	if err := wc.Close(); err != nil {
+		return nil, err
+	}
+
+	return a.Store.Commit(fd)
+}
+
+// Make a detached OpenPGP signature of `body` with every signing key, and
+// commit it to the blobstore. If `armored` is set, the signature is ASCII
+// armored.
+func (a Archive) detachSign(body []byte, when time.Time, armored bool) (*Object, error) {
+	signature, err := a.Store.Create()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	defer signature.Close()
+
+	var out io.WriteCloser = signature
+	if armored {
+		out, err = armor.Encode(signature, openpgp.SignatureType, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, signer := range a.SigningKeys() {
+		err := openpgp.DetachSign(out, signer, bytes.NewReader(body), signatureConfig(when))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return obj, sigObj, nil
+	if armored {
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+	}
 
+	return a.Store.Commit(signature)
 }
 
 // Encode a given control.Marshal'able object into the Blobstore, and return
@@ -286,27 +880,36 @@ func (a Archive) encodeSigned(data interface{}) (*blobstore.Object, *blobstore.O
 // The optinal argument `tap` will be written to as the object gets sent into
 // the blobstore. This may be useful if you wish to have a copy of the data
 // going into the store.
-func (a Archive) encode(data interface{}, tap io.Writer) (*blobstore.Object, error) {
+func (a Archive) encode(data interface{}, tap io.Writer) (*Object, error) {
 	fd, err := a.Store.Create()
 	if err != nil {
 		return nil, err
 	}
+	defer fd.Close()
 
 	var writer io.Writer = fd
 	if tap != nil {
 		writer = io.MultiWriter(fd, tap)
 	}
 
-	encoder, err := control.NewEncoder(writer)
-	if err != nil {
+	if err := encodeControl(writer, data); err != nil {
 		return nil, err
 	}
 
-	if err := encoder.Encode(data); err != nil {
-		return nil, err
+	return a.Store.Commit(fd)
+}
+
+// Write out a control.Marshal'able object, or a control.Paragraph as-is.
+func encodeControl(writer io.Writer, data interface{}) error {
+	if para, ok := data.(*control.Paragraph); ok {
+		return para.WriteTo(writer)
 	}
 
-	return a.Store.Commit(*fd)
+	encoder, err := control.NewEncoder(writer)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(data)
 }
 
 // }}}
@@ -316,6 +919,10 @@ func (a Archive) encode(data interface{}, tap io.Writer) (*blobstore.Object, err
 // Abstraction to handle writing data into a Suite. This is a write-only
 // target, and is not intended to read a Release file.
 //
+// Any fields Set on the Suite's Paragraph are passed through to the
+// Release file as-is, which allows setting fields this package doesn't
+// know about, such as "Changelogs" or site-specific "X-" fields.
+//
 // This contains no state read off disk, and is purely for writing to.
 type Suite struct {
 	control.Paragraph
@@ -329,25 +936,144 @@ type Suite struct {
 	Version     string
 
 	components map[string]*Component `control:"-"`
+	removed    []string              `control:"-"`
+	lintChecks []namedLintCheck      `control:"-"`
 
 	features struct {
-		Hashes   []string
-		Duration string
+		Hashes     []string
+		Duration   time.Duration
+		ValidUntil time.Time
+		Duplicates DuplicatePolicy
+		Retain     int
+		Lint       bool
+		Armor      *bool
+		ArchAll    ArchAllPolicy
+
+		Architectures []dependency.Arch
+
+		Compressions    []string
+		Compression     CompressionOptions
+		Uncompressed    UncompressedPolicy
+		StripWeakHashes bool
+
+		Aliases []string
+		ByHash  bool
+
+		Sections  SectionPolicy
+		Overrides map[string]Override
+
+		ComponentPrefix string
+
+		Contents       ContentsLayout
+		Deltas         DeltaFunc
+		BuildinfoIndex bool
+
+		DebugSuite     *Suite
+		DebugComponent string
 	} `control:"-"`
 }
 
+// Keep only the newest `n` versions of each package (on each
+// architecture) in the Suite's indices. Older versions are dropped from
+// the indices when the Suite is Engrossed, and their pool files recorded
+// just like RemovePackage, to be found with Removed. Setting this to 0 (the
+// default) keeps every version.
+func (s *Suite) SetRetention(n int) error {
+	if n < 0 {
+		return fmt.Errorf("Invalid retention: %d", n)
+	}
+	s.features.Retain = n
+	return nil
+}
+
+// Set the hash algorithms used for the Suite's indices in the Release
+// file, which are written in the order given. Valid algorithms are "md5",
+// "sha1", "sha256" and "sha512". By default, "sha1", "sha256" and "sha512"
+// are used; dropping "sha1" leaves no weak digests in the Release file.
+func (s *Suite) SetHashes(algorithms ...string) error {
+	if len(algorithms) == 0 {
+		return fmt.Errorf("At least one hash algorithm is required")
+	}
+	seen := map[string]bool{}
+	for _, algorithm := range algorithms {
+		if _, ok := releaseHashFields[algorithm]; !ok {
+			return fmt.Errorf("No known hash: '%s'", algorithm)
+		}
+		if seen[algorithm] {
+			return fmt.Errorf("Hash given more than once: '%s'", algorithm)
+		}
+		seen[algorithm] = true
+	}
+	s.features.Hashes = algorithms
+	return nil
+}
+
+// Set how long the Release file is valid for after it's published, which
+// is used to set Valid-Until. A duration of 0 leaves out Valid-Until
+// entirely. By default, Release files are valid for a week.
+func (s *Suite) SetValidUntil(duration time.Duration) error {
+	if duration < 0 {
+		return fmt.Errorf("Invalid Valid-Until duration: %s", duration)
+	}
+	s.features.Duration = duration
+	return nil
+}
+
+// Write the Suite's Release.gpg ASCII armored (or not), no matter what the
+// Archive was set to with SetArmoredSignatures.
+func (s *Suite) SetArmoredSignature(armored bool) {
+	s.features.Armor = &armored
+}
+
+// Check if the Suite's Release.gpg is to be ASCII armored; either as set
+// with SetArmoredSignature, or as set on the Archive.
+func (s Suite) armoredSignature() bool {
+	if s.features.Armor != nil {
+		return *s.features.Armor
+	}
+	return s.archive.armoredSignatures
+}
+
+// DuplicatePolicy decides what happens when an entry with the same name,
+// version and architecture as one already in an index is added to it.
+type DuplicatePolicy int
+
+const (
+	// Return an error, leaving the existing entry alone.
+	RejectDuplicates DuplicatePolicy = iota
+
+	// Replace the existing entry with the one being added.
+	ReplaceDuplicates
+)
+
+// Set what to do when an entry is added to one of the Suite's indices
+// that already has an entry for the same name, version and architecture.
+// By default, duplicates are rejected, since apt handles duplicate stanzas
+// poorly.
+func (s *Suite) SetDuplicatePolicy(policy DuplicatePolicy) {
+	s.features.Duplicates = policy
+}
+
+// Prefix the name of every Component of the Suite with `prefix`, such as
+// "updates/", so that Component("main") is published as "updates/main",
+// like Debian's security Suites.
+func (s *Suite) SetComponentPrefix(prefix string) {
+	s.features.ComponentPrefix = prefix
+}
+
 // Get a handle to write a given Suite from an Archive.
 // The suite will be entirely blank, and attributes will not be
 // read from the existing files, if any.
-func (a Archive) Suite(name string) (*Suite, error) {
+func (a *Archive) Suite(name string) (*Suite, error) {
 	suite := Suite{
+		Paragraph:  control.Paragraph{Values: map[string]string{}, Order: []string{}},
 		Name:       name,
-		archive:    &a,
+		archive:    a,
 		components: map[string]*Component{},
 	}
 
-	suite.features.Hashes = []string{"sha256", "sha1", "sha512"}
-	suite.features.Duration = "168h"
+	suite.setProfile(DefaultProfile)
+	suite.features.Duration = 168 * time.Hour
 
 	return &suite, nil
 }
@@ -356,10 +1082,17 @@ func (a Archive) Suite(name string) (*Suite, error) {
 // has been created so far, this will create a new object, otherwise
 // it will return the existing entry.
 //
+// If the Suite has a component prefix (see SetComponentPrefix), it's
+// added to `name`, unless `name` already has it.
+//
 // This contains no state read off disk, and is purely for writing to.
-func (s Suite) Component(name string) (*Component, error) {
+func (s *Suite) Component(name string) (*Component, error) {
+	prefix := s.features.ComponentPrefix
+	if prefix != "" && !strings.HasPrefix(name, prefix) {
+		name = prefix + name
+	}
 	if _, ok := s.components[name]; !ok {
-		comp, err := newComponent(&s)
+		comp, err := newComponent(s, name)
 		if err != nil {
 			return nil, err
 		}
@@ -370,6 +1103,147 @@ func (s Suite) Component(name string) (*Component, error) {
 	return el, nil
 }
 
+// Copy the .deb at `debPath` into the Archive's Pool, under the
+// Component `component`, and add its Package entry (with the Filename,
+// Size and hashes set) to that Component of the Suite, all in one go. This
+// returns the Package entry that was added.
+func (s *Suite) AddDebFile(component string, debPath string) (*Package, error) {
+	comp, err := s.Component(component)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := s.archive.Pool.includeDebFile(comp.name, debPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", debPath, err)
+	}
+	if err := comp.AddPackage(*pkg); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// Get the names of every Component of the Suite, sorted.
+func (s Suite) componentNames() []string {
+	ret := []string{}
+	for name := range s.components {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Remove a binary Package from the Suite, by name, version and
+// architecture, in any Component. The entry will be dropped from the
+// Packages index on the next Engross. This returns the Package entries
+// that were removed.
+//
+// The pool files of anything removed are recorded, and can be fetched
+// with Removed, to be passed to Archive.UnlinkUnreferenced once the Suite
+// has been published.
+func (s *Suite) RemovePackage(
+	name string,
+	ver version.Version,
+	arch dependency.Arch,
+) ([]Package, error) {
+	ret := []Package{}
+	for _, component := range s.components {
+		writer, ok := component.packageWriters[arch]
+		if !ok {
+			continue
+		}
+
+		removed := writer.Remove(func(entry interface{}) bool {
+			pkg, ok := entry.(Package)
+			return ok && pkg.Package == name && version.Compare(pkg.Version, ver) == 0
+		})
+
+		for _, entry := range removed {
+			pkg := entry.(Package)
+			ret = append(ret, pkg)
+			s.recordRemoved(entry)
+			if err := s.archive.record(AuditEvent{
+				Action:       AuditRemove,
+				Suite:        s.Name,
+				Component:    component.name,
+				Package:      pkg.Package,
+				Version:      pkg.Version.String(),
+				Architecture: pkg.Architecture.String(),
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("No such package: %s %s on %s", name, ver, arch.String())
+	}
+	return ret, nil
+}
+
+// Remove a Source from the Suite, by name and version, in any Component.
+// The entry will be dropped from the Sources index on the next Engross.
+// This returns the Source entries that were removed, and records their
+// pool files just like RemovePackage.
+func (s *Suite) RemoveSource(name string, ver version.Version) ([]Source, error) {
+	ret := []Source{}
+	for _, component := range s.components {
+		if component.sourceWriter == nil {
+			continue
+		}
+
+		removed := component.sourceWriter.Remove(func(entry interface{}) bool {
+			src, ok := entry.(Source)
+			return ok && src.Package == name && version.Compare(src.Version, ver) == 0
+		})
+
+		for _, entry := range removed {
+			src := entry.(Source)
+			ret = append(ret, src)
+			s.recordRemoved(entry)
+			if err := s.archive.record(AuditEvent{
+				Action:       AuditRemove,
+				Suite:        s.Name,
+				Component:    component.name,
+				Package:      src.Package,
+				Version:      src.Version.String(),
+				Architecture: "source",
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("No such source: %s %s", name, ver)
+	}
+	return ret, nil
+}
+
+// Record the pool files of an entry removed from one of the Suite's
+// indices.
+func (s *Suite) recordRemoved(entry interface{}) {
+	record := func(filename string) {
+		/* "all" Packages may be dropped from more than one index */
+		if !slices.Contains(s.removed, filename) {
+			s.removed = append(s.removed, filename)
+		}
+	}
+	switch el := entry.(type) {
+	case Package:
+		record(el.Filename)
+	case Source:
+		for _, file := range el.Files {
+			record(path.Join(el.Directory, file.Filename))
+		}
+	}
+}
+
+// Get the pool paths of every file belonging to a Package or Source
+// that's been removed from this Suite.
+func (s Suite) Removed() []string {
+	return s.removed
+}
+
 // }}}
 
 // Component {{{
@@ -380,17 +1254,51 @@ func (s Suite) Component(name string) (*Component, error) {
 // This contains no state read off disk, and is purely for writing to.
 type Component struct {
 	suite          *Suite
+	name           string
 	packageWriters map[dependency.Arch]*IndexWriter
+	sourceWriter   *IndexWriter
+	dep11          map[string][]byte
+	translations   map[string][]byte
+	translated     map[string]map[string]Translation
 }
 
 // Create a new Component, configured for use.
-func newComponent(suite *Suite) (*Component, error) {
+func newComponent(suite *Suite, name string) (*Component, error) {
 	return &Component{
 		suite:          suite,
+		name:           name,
 		packageWriters: map[dependency.Arch]*IndexWriter{},
+		dep11:          map[string][]byte{},
+		translations:   map[string][]byte{},
+		translated:     map[string]map[string]Translation{},
 	}, nil
 }
 
+func (c Component) Name() string {
+	return c.name
+}
+
+// Get every Architecture the Component has a Packages index for, sorted.
+func (c Component) arches() []dependency.Arch {
+	return sortedArches(c.packageWriters)
+}
+
+// Get the Architectures of a set of Packages indices, sorted.
+func sortedArches(writers map[dependency.Arch]*IndexWriter) []dependency.Arch {
+	ret := []dependency.Arch{}
+	for arch := range writers {
+		ret = append(ret, arch)
+	}
+	sortArches(ret)
+	return ret
+}
+
+func sortArches(arches []dependency.Arch) {
+	sort.Slice(arches, func(i, j int) bool {
+		return arches[i].String() < arches[j].String()
+	})
+}
+
 // Get a given IndexWriter for an arch, or create one if none exists.
 func (c *Component) getWriter(arch dependency.Arch) (*IndexWriter, error) {
 	if _, ok := c.packageWriters[arch]; !ok {
@@ -406,12 +1314,77 @@ func (c *Component) getWriter(arch dependency.Arch) (*IndexWriter, error) {
 // Add a given Package to a Package List. Under the hood, this will
 // get or create a IndexWriter, and invoke the .Add method on the
 // Package Writer.
+//
+// Debug symbols are added to another Component instead, if the Suite
+// routes them somewhere else with SetDebugRouting.
+//
+// Its Section and Priority are checked (and maybe overridden) according to
+// the Suite's SetSectionPolicy.
 func (c *Component) AddPackage(pkg Package) error {
-	writer, err := c.getWriter(pkg.Architecture)
+	return c.addPackageTo(pkg, pkg.Architecture)
+}
+
+// Add a Package to the Packages index of `arch`, which needn't be the
+// Package's own Architecture (such as an "all" Package being copied into
+// every Architecture's index), with all the checks of AddPackage.
+func (c *Component) addPackageTo(pkg Package, arch dependency.Arch) error {
+	target, err := c.debugComponent(pkg)
+	if err != nil {
+		return err
+	}
+	if target != nil {
+		return target.addPackage(pkg, arch)
+	}
+	return c.addPackage(pkg, arch)
+}
+
+func (c *Component) addPackage(pkg Package, arch dependency.Arch) error {
+	if err := c.suite.checkArchitecture(arch); err != nil {
+		return err
+	}
+	pkg, err := c.suite.checkSection(pkg)
+	if err != nil {
+		return err
+	}
+	writer, err := c.getWriter(arch)
 	if err != nil {
 		return err
 	}
-	return writer.Add(pkg)
+	if err := writer.Add(pkg); err != nil {
+		return err
+	}
+	return c.suite.archive.record(AuditEvent{
+		Action:       AuditAdd,
+		Suite:        c.suite.Name,
+		Component:    c.name,
+		Package:      pkg.Package,
+		Version:      pkg.Version.String(),
+		Architecture: pkg.Architecture.String(),
+	})
+}
+
+// Add a given Source to the Sources List. Under the hood, this will
+// get or create the IndexWriter for the Component's Sources, and invoke
+// the .Add method on it.
+func (c *Component) AddSource(src Source) error {
+	if c.sourceWriter == nil {
+		writer, err := newIndexWriter(c.suite)
+		if err != nil {
+			return err
+		}
+		c.sourceWriter = writer
+	}
+	if err := c.sourceWriter.Add(src); err != nil {
+		return err
+	}
+	return c.suite.archive.record(AuditEvent{
+		Action:       AuditAdd,
+		Suite:        c.suite.Name,
+		Component:    c.name,
+		Package:      src.Package,
+		Version:      src.Version.String(),
+		Architecture: "source",
+	})
 }
 
 // }}}
@@ -422,23 +1395,36 @@ func (c *Component) AddPackage(pkg Package) error {
 // binary .deb files, for a particular Architecture, in a particular Component
 // in a particular Suite, in a particular Archive.
 //
-// This is not an encapsulation to store the entire Index in memory, rather,
-// it's a wrapper to help write Package entries into the Index.
+// Entries are held in memory until the Suite is Engrossed, at which point
+// they're encoded into a new blob in the underlying blobstore. This allows
+// entries to be removed again before publishing.
+//
+// Engross Flushes and Closes every IndexWriter of the Suite itself; Flush
+// and Close only need calling to write out an IndexWriter on its own.
 type IndexWriter struct {
 	archive *Archive
+	suite   *Suite
 
-	handle  *blobstore.Writer
-	closer  func() error
-	encoder *control.Encoder
+	entries []interface{}
+	seen    map[string]int
 
+	/* Set once written out; the hashes of the uncompressed index, and
+	 * each file (compressed or not) published for it */
 	hashers []*transput.Hasher
+	files   []*indexFile
 }
 
 func getHashers(suite *Suite) (io.Writer, []*transput.Hasher, error) {
+	return newHashers(suite.features.Hashes)
+}
+
+// Create a Hasher for each of the named algorithms, returning an io.Writer
+// that will write to all of them.
+func newHashers(algorithms []string) (io.Writer, []*transput.Hasher, error) {
 	ret := []*transput.Hasher{}
 	writers := []io.Writer{}
 
-	for _, algo := range suite.features.Hashes {
+	for _, algo := range algorithms {
 		hasher, err := transput.NewHasher(algo)
 		if err != nil {
 			return nil, nil, err
@@ -450,38 +1436,253 @@ func getHashers(suite *Suite) (io.Writer, []*transput.Hasher, error) {
 	return io.MultiWriter(writers...), ret, nil
 }
 
-// given a Suite, create a new Package Writer, configured with
-// the appropriate Hashing, and targeting a new file blob in the
-// underlying blobstore.
+// given a Suite, create a new Package Writer, which will be configured
+// with the appropriate Hashing when written out.
 func newIndexWriter(suite *Suite) (*IndexWriter, error) {
-	handle, err := suite.archive.Store.Create()
-	if err != nil {
-		return nil, err
+	return &IndexWriter{
+		archive: suite.archive,
+		suite:   suite,
+		entries: []interface{}{},
+		seen:    map[string]int{},
+	}, nil
+}
+
+// Get the key used to find duplicate entries, or an empty string for
+// entries that can't be checked.
+func seenKey(entry interface{}) string {
+	name, ver, arch := entryKey(entry)
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %s %s", name, ver.String(), arch)
+}
+
+// Add a Package entry to the Packages index. If an entry with the same
+// name, version and architecture is already in the index, the Suite's
+// DuplicatePolicy decides what happens.
+func (p *IndexWriter) Add(data interface{}) error {
+	key := seenKey(data)
+	if i, ok := p.seen[key]; ok && key != "" {
+		switch p.suite.features.Duplicates {
+		case ReplaceDuplicates:
+			p.entries[i] = data
+			return nil
+		default:
+			name, ver, arch := entryKey(data)
+			return fmt.Errorf(
+				"%s %s on %s is already in %s",
+				name, ver.String(), arch, p.suite.Name,
+			)
+		}
+	}
+
+	p.seen[key] = len(p.entries)
+	p.entries = append(p.entries, data)
+	return nil
+}
+
+// Remove every entry for which `match` returns true, returning the entries
+// that were removed.
+func (p *IndexWriter) Remove(match func(interface{}) bool) []interface{} {
+	kept := []interface{}{}
+	removed := []interface{}{}
+	for _, entry := range p.entries {
+		if match(entry) {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	p.entries = kept
+
+	p.seen = map[string]int{}
+	for i, entry := range p.entries {
+		p.seen[seenKey(entry)] = i
+	}
+	return removed
+}
+
+// Remove all but the newest `n` versions of each package on each
+// architecture, returning the entries that were removed. If `n` is 0,
+// nothing is removed.
+func (p *IndexWriter) retain(n int) []interface{} {
+	if n <= 0 {
+		return []interface{}{}
+	}
+
+	versions := map[string][]version.Version{}
+	for _, entry := range p.entries {
+		name, ver, arch := entryKey(entry)
+		if name == "" {
+			continue
+		}
+		key := name + " " + arch
+		versions[key] = append(versions[key], ver)
+	}
+
+	/* Find the oldest version we're keeping of each package */
+	oldest := map[string]version.Version{}
+	for key, vers := range versions {
+		if len(vers) <= n {
+			continue
+		}
+		sort.Slice(vers, func(i, j int) bool {
+			return version.Compare(vers[i], vers[j]) > 0
+		})
+		oldest[key] = vers[n-1]
 	}
 
-	writer, hashers, err := getHashers(suite)
+	return p.Remove(func(entry interface{}) bool {
+		name, ver, arch := entryKey(entry)
+		cutoff, ok := oldest[name+" "+arch]
+		return ok && version.Compare(ver, cutoff) < 0
+	})
+}
+
+// Get every entry for which `match` returns true, without removing them.
+func (p *IndexWriter) Find(match func(interface{}) bool) []interface{} {
+	ret := []interface{}{}
+	for _, entry := range p.entries {
+		if match(entry) {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// Get the name, version and architecture of an index entry, which is what
+// entries are sorted by when written out.
+func entryKey(entry interface{}) (string, version.Version, string) {
+	switch el := entry.(type) {
+	case Package:
+		return el.Package, el.Version, el.Architecture.String()
+	case *Package:
+		return el.Package, el.Version, el.Architecture.String()
+	case Source:
+		return el.Package, el.Version, "source"
+	case *Source:
+		return el.Package, el.Version, "source"
+	}
+	return "", version.Version{}, ""
+}
+
+// Get a copy of the entries, sorted by name, then version, then
+// architecture, so that the index is the same no matter what order the
+// entries were added in.
+func sortedEntries(entries []interface{}) []interface{} {
+	ret := make([]interface{}, len(entries))
+	copy(ret, entries)
+	sort.SliceStable(ret, func(i, j int) bool {
+		iName, iVersion, iArch := entryKey(ret[i])
+		jName, jVersion, jArch := entryKey(ret[j])
+		if iName != jName {
+			return iName < jName
+		}
+		if cmp := version.Compare(iVersion, jVersion); cmp != 0 {
+			return cmp < 0
+		}
+		return iArch < jArch
+	})
+	return ret
+}
+
+// Encode all the entries, sorted, as the uncompressed index.
+func (p *IndexWriter) encode(out io.Writer) error {
+	encoder, err := control.NewEncoder(out)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for _, entry := range sortedEntries(p.entries) {
+		if err := encoder.Encode(p.suite.indexEntry(entry)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	encoder, err := control.NewEncoder(io.MultiWriter(writer, handle))
+// Encode all the entries into a new blob in the underlying blobstore,
+// hashing the data as it's written. The blob is ready to be Committed
+// once this returns.
+func (p *IndexWriter) write(store Store) error {
+	writer, hashers, err := getHashers(p.suite)
 	if err != nil {
-		handle.Close()
-		return nil, err
+		return err
 	}
 
-	return &IndexWriter{
-		archive: suite.archive,
-		closer:  handle.Close,
-		encoder: encoder,
-		handle:  handle,
-		hashers: hashers,
-	}, nil
+	files := []*indexFile{}
+	closeAll := func() {
+		for _, file := range files {
+			file.close()
+		}
+	}
+
+	outputs := []io.Writer{writer}
+	for _, suffix := range p.suite.features.Compressions {
+		file, err := newIndexFile(store, p.suite, suffix)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		files = append(files, file)
+		outputs = append(outputs, file.writer)
+	}
+
+	if err := p.encode(io.MultiWriter(outputs...)); err != nil {
+		closeAll()
+		return err
+	}
+
+	for _, file := range files {
+		if err := file.flush(); err != nil {
+			closeAll()
+			return err
+		}
+	}
+
+	p.files = files
+	p.hashers = hashers
+	return nil
+}
+
+// Write out every entry, and commit the blobs to the Archive's Store, one
+// for each of the Suite's Compressions, closing each once it's committed.
+// Anything written out by an earlier Flush is let go of (and left for GC,
+// unless it's still published).
+func (p *IndexWriter) Flush() error {
+	return p.flush(p.archive.Store)
 }
 
-// Write a Package entry into the Packages index.
-func (p IndexWriter) Add(data interface{}) error {
-	return p.encoder.Encode(data)
+func (p *IndexWriter) flush(store Store) error {
+	if err := p.Close(); err != nil {
+		return err
+	}
+	p.files = nil
+	p.hashers = nil
+
+	if err := p.write(store); err != nil {
+		return err
+	}
+	for _, file := range p.files {
+		if err := file.commit(store); err != nil {
+			p.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Close every blob the IndexWriter still has open, throwing away any that
+// weren't committed (say, because Flush failed part way through). This is
+// safe to call more than once, or on an IndexWriter that was never written
+// out, and the IndexWriter can still be added to, and Flushed, after.
+func (p *IndexWriter) Close() error {
+	var err error
+	for _, file := range p.files {
+		if closeErr := file.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 // }}}
@@ -0,0 +1,186 @@
+package archive
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"pault.ag/go/debian/dependency"
+	"pault.ag/go/debian/version"
+)
+
+// Archive {{{
+
+// Make a Package entry for `name` at `ver`, built for `arch`.
+func newTestPackage(t *testing.T, name, ver, arch string) Package {
+	v, err := version.Parse(ver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := dependency.ParseArch(arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Package{
+		Package:      name,
+		Version:      v,
+		Architecture: *a,
+		Filename:     "pool/main/" + poolPrefix(name) + "/" + name + "_" + ver + "_" + arch + ".deb",
+	}
+}
+
+func TestEngrossDeterministic(t *testing.T) {
+	key := newTestKey(t)
+	packages := []Package{
+		newTestPackage(t, "foo", "1.0", "amd64"),
+		newTestPackage(t, "bar", "2.0", "amd64"),
+		newTestPackage(t, "foo", "1.0", "arm64"),
+		newTestPackage(t, "bar", "1.0", "amd64"),
+		newTestPackage(t, "baz", "1.0", "all"),
+		newTestPackage(t, "qux", "1.0", "arm64"),
+	}
+	when := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	engross := func(order []Package) ArchiveState {
+		a, err := New(t.TempDir(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		suite, err := a.Suite("unstable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pkg := range order {
+			component := "main"
+			if pkg.Package == "qux" {
+				component = "contrib"
+			}
+			c, err := suite.Component(component)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.AddPackage(pkg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files, err := a.EngrossWith(context.Background(), *suite, EngrossOptions{Date: when})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	reversed := []Package{}
+	for i := len(packages) - 1; i >= 0; i-- {
+		reversed = append(reversed, packages[i])
+	}
+
+	first, second := engross(packages), engross(reversed)
+	if len(first) == 0 || len(first) != len(second) {
+		t.Fatalf("Published %d files, then %d", len(first), len(second))
+	}
+	for target, obj := range first {
+		/* Signatures are salted, so only what's signed has to match */
+		if target == "dists/unstable/InRelease" || target == "dists/unstable/Release.gpg" {
+			continue
+		}
+		if second[target] != obj {
+			t.Errorf("%s differs when Packages are added in another order", target)
+		}
+	}
+}
+
+func TestDuplicateEntries(t *testing.T) {
+	a, err := New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := newTestPackage(t, "foo", "1.0", "amd64")
+	if err := component.AddPackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	err = component.AddPackage(pkg)
+	if err == nil || !strings.Contains(err.Error(), "already in unstable") {
+		t.Fatalf("Duplicate Package wasn't rejected: %v", err)
+	}
+	if err := component.AddPackage(newTestPackage(t, "foo", "1.0", "arm64")); err != nil {
+		t.Errorf("Package on another Architecture was rejected: %v", err)
+	}
+
+	suite.SetDuplicatePolicy(ReplaceDuplicates)
+	pkg.Filename = "pool/main/f/foo/foo_1.0_amd64.rebuilt.deb"
+	if err := component.AddPackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	found := component.packageWriters[pkg.Architecture].Find(func(entry interface{}) bool {
+		return entry.(Package).Package == "foo"
+	})
+	if len(found) != 1 || found[0].(Package).Filename != pkg.Filename {
+		t.Errorf("Duplicate Package didn't replace the existing entry: %v", found)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	a, err := New(t.TempDir(), newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := suite.SetRetention(2); err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range []Package{
+		newTestPackage(t, "foo", "1.10", "amd64"),
+		newTestPackage(t, "foo", "1.0", "amd64"),
+		newTestPackage(t, "foo", "1.2", "amd64"),
+		newTestPackage(t, "bar", "1.0", "amd64"),
+	} {
+		if err := component.AddPackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Engross(*suite); err != nil {
+		t.Fatal(err)
+	}
+
+	amd64, err := dependency.ParseArch("amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := []string{}
+	for _, entry := range component.packageWriters[*amd64].Find(func(interface{}) bool { return true }) {
+		pkg := entry.(Package)
+		kept = append(kept, pkg.Package+" "+pkg.Version.String())
+	}
+	sort.Strings(kept)
+	if strings.Join(kept, ", ") != "bar 1.0, foo 1.10, foo 1.2" {
+		t.Errorf("Unexpected Packages kept: %v", kept)
+	}
+
+	removed := suite.Removed()
+	if len(removed) != 1 || removed[0] != "pool/main/f/foo/foo_1.0_amd64.deb" {
+		t.Errorf("Unexpected pool files removed: %v", removed)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,176 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AuditEvent {{{
+
+// Kinds of change recorded in the audit log.
+const (
+	AuditAdd     = "add"
+	AuditRemove  = "remove"
+	AuditSign    = "sign"
+	AuditPublish = "publish"
+	AuditGC      = "gc"
+)
+
+// AuditEvent is a single change made to the Archive, as recorded in its
+// audit log. Only the fields that make sense for the Action are set.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor,omitempty"`
+	Action string    `json:"action"`
+
+	Suite        string `json:"suite,omitempty"`
+	Component    string `json:"component,omitempty"`
+	Package      string `json:"package,omitempty"`
+	Version      string `json:"version,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+
+	// Fingerprints of the keys a Release was signed with.
+	Keys []string `json:"keys,omitempty"`
+
+	// Paths linked into place by a publish, or unlinked by a GC.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// }}}
+
+// auditLog {{{
+
+type auditLog struct {
+	lock  sync.Mutex
+	path  string
+	actor string
+}
+
+func (a Archive) auditPath() string {
+	return filepath.Join(a.path, ".audit.log")
+}
+
+// Record every change made through this Archive (Packages and Sources
+// added to or removed from a Suite, Release files signed, Suites
+// published with Link, and GC runs) to an append-only log in the
+// Archive's root, as `actor` (such as the operator's name, or the
+// fingerprint of an upload's signer). The log can be read back with
+// AuditLog.
+//
+// Once enabled, failing to write to the log fails the change being
+// recorded. This needs the Archive to have a local Path.
+func (a *Archive) EnableAudit(actor string) error {
+	if a.path == "" {
+		return fmt.Errorf("Archive has no local path to audit to")
+	}
+	a.audit = &auditLog{path: a.auditPath(), actor: actor}
+	return nil
+}
+
+// Append an AuditEvent to the audit log, if auditing is enabled, filling
+// in the Time and Actor.
+func (a Archive) record(event AuditEvent) error {
+	if a.audit == nil {
+		return nil
+	}
+	event.Time = time.Now().UTC()
+	event.Actor = a.audit.actor
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.audit.lock.Lock()
+	defer a.audit.lock.Unlock()
+
+	/* A single write to a file opened for appending, so that concurrent
+	 * writers (even in other processes) don't interleave lines */
+	fd, err := os.OpenFile(a.audit.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(line); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// }}}
+
+// AuditLog {{{
+
+// AuditQuery picks which AuditEvents AuditLog returns. Every field that's
+// set must match; the zero AuditQuery matches everything.
+type AuditQuery struct {
+	// Only events at or after Since, and before Until.
+	Since time.Time
+	Until time.Time
+
+	Actor   string
+	Action  string
+	Suite   string
+	Package string
+}
+
+func (q AuditQuery) matches(event AuditEvent) bool {
+	switch {
+	case !q.Since.IsZero() && event.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !event.Time.Before(q.Until):
+		return false
+	case q.Actor != "" && event.Actor != q.Actor:
+		return false
+	case q.Action != "" && event.Action != q.Action:
+		return false
+	case q.Suite != "" && event.Suite != q.Suite:
+		return false
+	case q.Package != "" && event.Package != q.Package:
+		return false
+	}
+	return true
+}
+
+// Read back every AuditEvent in the Archive's audit log that matches the
+// AuditQuery, oldest first, to answer questions like "who published what,
+// and when". An Archive that has never been audited has no events.
+func (a Archive) AuditLog(query AuditQuery) ([]AuditEvent, error) {
+	if a.path == "" {
+		return nil, fmt.Errorf("Archive has no local path to audit to")
+	}
+
+	fd, err := os.Open(a.auditPath())
+	if os.IsNotExist(err) {
+		return []AuditEvent{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret := []AuditEvent{}
+	decoder := json.NewDecoder(fd)
+	for {
+		event := AuditEvent{}
+		if err := decoder.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if query.matches(event) {
+			ret = append(ret, event)
+		}
+	}
+	return ret, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,233 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// Buildinfo {{{
+
+// Copy a .buildinfo file into the Pool, next to the files of the source
+// package `source` it records a build of (such as
+// "pool/main/f/foo/foo_1.0-1_amd64.buildinfo"), and return its pool path,
+// for anyone checking the build can be reproduced. If the same .buildinfo
+// is already there, it's left alone; if a different one is, this will
+// return an error.
+func (p Pool) IncludeBuildinfo(component, source, buildinfoPath string) (string, error) {
+	if source == "" || strings.Contains(source, "/") {
+		return "", fmt.Errorf("Invalid source for %s: '%s'", filepath.Base(buildinfoPath), source)
+	}
+	target := path.Join("pool", component, poolPrefix(source), filepath.Base(buildinfoPath))
+
+	obj, hashers, err := p.copyHashed(buildinfoPath, []string{"sha256"})
+	if err != nil {
+		return "", err
+	}
+	exists, err := p.hasFile(target, control.FileHashFromHasher(target, *hashers[0]))
+	if err != nil || exists {
+		return target, err
+	}
+
+	if err := p.Store.Link(*obj, target); err != nil {
+		return "", err
+	}
+	logEvent(p.logger, slog.LevelInfo, "included", "path", target, "object", obj.ID)
+	return target, nil
+}
+
+// Publish an index of the .buildinfo files in the Pool for each Component
+// of the Suite, at "<component>/Buildinfo", in each of the Suite's
+// Compressions. Each entry has the Source, Version and Architecture of the
+// build, and the Filename, Size and SHA256 of its .buildinfo, for
+// reproducible builds tooling to find them by. This is off by default.
+//
+// Only .buildinfo files for a source version the Component has a Source or
+// Package entry for are listed, as found next to them in the Pool (such as
+// by an Incoming queue, or IncludeBuildinfo).
+func (s *Suite) SetBuildinfoIndex(enabled bool) {
+	s.features.BuildinfoIndex = enabled
+}
+
+// Write out the Component's Buildinfo index, if the Suite publishes one,
+// and register it in the ArchiveState and Release.
+func (a Archive) commitBuildinfo(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	component *Component,
+) error {
+	if !suite.features.BuildinfoIndex {
+		return nil
+	}
+
+	/* By pool directory, the "<source>_<version>_" prefix of the filename
+	 * of every .buildinfo that belongs in the index */
+	prefixes := map[string]map[string]bool{}
+	addPrefix := func(dir, name, ver string) {
+		if _, ok := prefixes[dir]; !ok {
+			prefixes[dir] = map[string]bool{}
+		}
+		prefixes[dir][fmt.Sprintf("%s_%s_", name, ver)] = true
+	}
+
+	for _, arch := range component.arches() {
+		for _, entry := range component.packageWriters[arch].entries {
+			pkg, ok := entry.(Package)
+			if !ok {
+				continue
+			}
+			name, ver := pkg.Source.Name, pkg.Source.Version
+			if name == "" {
+				name = pkg.Package
+			}
+			if ver.Empty() {
+				ver = pkg.Version
+			}
+			addPrefix(path.Dir(pkg.Filename), name, poolVersion(ver))
+		}
+	}
+	if component.sourceWriter != nil {
+		for _, entry := range component.sourceWriter.entries {
+			if src, ok := entry.(Source); ok {
+				addPrefix(src.Directory, src.Package, poolVersion(src.Version))
+			}
+		}
+	}
+
+	dirs := []string{}
+	for dir := range prefixes {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	buf := bytes.Buffer{}
+	encoder, err := control.NewEncoder(&buf)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		targets, err := a.Store.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			if path.Dir(target) != dir || path.Ext(target) != ".buildinfo" {
+				continue
+			}
+			base := strings.TrimSuffix(path.Base(target), ".buildinfo")
+			parts := strings.SplitN(base, "_", 3)
+			if len(parts) != 3 || !prefixes[dir][parts[0]+"_"+parts[1]+"_"] {
+				continue
+			}
+
+			paragraph, err := a.buildinfoParagraph(target, parts)
+			if err != nil {
+				return err
+			}
+			if err := encoder.Encode(paragraph); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = a.commitCompressed(suite, release, files, path.Join(component.name, "Buildinfo"), buf.Bytes())
+	return err
+}
+
+// Get the entry of a .buildinfo in the Pool, from the parts of its
+// filename (the source, version without the epoch, and architecture), and
+// its hash.
+func (a Archive) buildinfoParagraph(target string, parts []string) (*control.Paragraph, error) {
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	hashWriter, hashers, err := newHashers([]string{"sha256"})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hashWriter, fd); err != nil {
+		return nil, err
+	}
+	fileHash := control.FileHashFromHasher(target, *hashers[0])
+
+	paragraph := control.Paragraph{Values: map[string]string{}, Order: []string{}}
+	paragraph.Set("Source", parts[0])
+	paragraph.Set("Version", parts[1])
+	paragraph.Set("Architecture", parts[2])
+	paragraph.Set("Filename", target)
+	paragraph.Set("Size", strconv.FormatInt(fileHash.Size, 10))
+	paragraph.Set("SHA256", fileHash.Hash)
+	return &paragraph, nil
+}
+
+// Get a function to check if a pool path is a .buildinfo that should be
+// kept, given the set of pool paths that are referenced; that is, if it's
+// next to a referenced .deb or .dsc of the same version, whether or not
+// any Buildinfo index lists it.
+func buildinfoReferences(references map[string]bool) func(string) bool {
+	/* "<dir> <version>" of every referenced pool file */
+	versions := map[string]bool{}
+	for target := range references {
+		parts := strings.SplitN(path.Base(target), "_", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		versions[path.Dir(target)+" "+strings.TrimSuffix(parts[1], ".dsc")] = true
+	}
+
+	return func(target string) bool {
+		if path.Ext(target) != ".buildinfo" {
+			return false
+		}
+		parts := strings.SplitN(path.Base(target), "_", 3)
+		return len(parts) == 3 && versions[path.Dir(target)+" "+parts[1]]
+	}
+}
+
+// Add every .buildinfo a published Buildinfo index lists to the set of
+// `references`.
+func (a Archive) addBuildinfoReferences(target string, references map[string]bool) error {
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	reader, err := decompress(fd)
+	if err != nil {
+		return err
+	}
+	decoder, err := control.NewDecoder(reader, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		entry := struct {
+			control.Paragraph
+			Filename string
+		}{}
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		references[entry.Filename] = true
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
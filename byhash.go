@@ -0,0 +1,57 @@
+package archive
+
+import (
+	"path"
+
+	"pault.ag/go/debian/control"
+)
+
+// By-Hash {{{
+
+// Publish every file the Suite's Release lists a second time, by its hash,
+// such as "main/binary-amd64/by-hash/SHA256/<sha256>", and set
+// "Acquire-By-Hash: yes" in the Release, so that apt fetches them by hash.
+// Clients that fetch indices while the Suite is being published get either
+// the old file or the new one, and never a hash mismatch.
+//
+// Each file is published by each of the Suite's hash algorithms. Only the
+// by-hash files listed in a published Release are kept by GCUnreferenced.
+func (s *Suite) SetByHash(byHash bool) {
+	s.features.ByHash = byHash
+}
+
+// Get the by-hash path of the file at `filePath` (relative to the Suite's
+// dists directory), for the given hash.
+func byHashPath(filePath string, fileHash control.FileHash) (string, bool) {
+	field, ok := releaseHashFields[fileHash.Algorithm]
+	if !ok {
+		return "", false
+	}
+	return path.Join(path.Dir(filePath), "by-hash", field, fileHash.Hash), true
+}
+
+// If the Suite publishes by-hash, register the Object at each of the
+// by-hash paths of `filePath` (relative to the Suite's dists directory) in
+// the ArchiveState.
+func (a Archive) registerByHash(
+	suite Suite,
+	files ArchiveState,
+	filePath string,
+	fileHashes []control.FileHash,
+	obj Object,
+) {
+	if !suite.features.ByHash {
+		return
+	}
+	for _, fileHash := range fileHashes {
+		hashPath, ok := byHashPath(filePath, fileHash)
+		if !ok {
+			continue
+		}
+		files[path.Join("dists", suite.Name, hashPath)] = obj
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,109 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"pault.ag/go/debian/deb"
+	"pault.ag/go/debian/version"
+)
+
+// Changelogs {{{
+
+// Get the path apt substitutes for "@CHANGEPATH@" in the Changelogs
+// field of a Release file, such as "main/f/foo/foo_1.0-1".
+func changePath(component, source string, ver version.Version) string {
+	return path.Join(
+		component,
+		poolPrefix(source),
+		fmt.Sprintf("%s_%s", source, poolVersion(ver)),
+	)
+}
+
+// Get the path the changelog of a given source package version is
+// published at, such as "changelogs/pool/main/f/foo/foo_1.0-1/changelog".
+func changelogPath(component, source string, ver version.Version) string {
+	return path.Join("changelogs", "pool", changePath(component, source, ver), "changelog")
+}
+
+// Set the Changelogs field of the Suite's Release file, so that `apt
+// changelog` will fetch changelogs included with IncludeChangelog from
+// the Archive served at `baseURL`.
+func (s *Suite) SetChangelogs(baseURL string) {
+	s.Set("Changelogs", fmt.Sprintf(
+		"%s/changelogs/pool/@CHANGEPATH@/changelog",
+		strings.TrimSuffix(baseURL, "/"),
+	))
+}
+
+// Extract the Debian changelog ("/usr/share/doc/<package>/changelog.Debian.gz")
+// from a .deb, and publish it uncompressed under changelogs/pool/, where
+// apt will look for it. This returns the path the changelog was published
+// at, or an empty string if the .deb doesn't contain a changelog (such as
+// when the doc directory is a symlink to another package's).
+//
+// Every binary built from a source package shares the same changelog, so
+// if one has already been published for the source version, it's left
+// alone.
+//
+// This reads through the .deb's data, so it must be called before anything
+// else reads debFile.Data.
+func (p Pool) IncludeChangelog(component string, debFile deb.Deb) (string, error) {
+	target := changelogPath(
+		component,
+		debFile.Control.SourceName(),
+		debFile.Control.SourceVersion(),
+	)
+
+	if _, err := p.Store.Lookup(target); err == nil {
+		return target, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	changelog := path.Join("usr/share/doc", debFile.Control.Package, "changelog.Debian.gz")
+	for {
+		hdr, err := debFile.Data.Next()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if path.Clean(strings.TrimPrefix(hdr.Name, "/")) == changelog && hdr.Typeflag == tar.TypeReg {
+			break
+		}
+	}
+
+	reader, err := gzip.NewReader(debFile.Data)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	writer, err := p.Store.Create()
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		return "", err
+	}
+
+	obj, err := p.Store.Commit(writer)
+	if err != nil {
+		return "", err
+	}
+
+	return target, p.Store.Link(*obj, target)
+}
+
+// }}}
+
+// vim: foldmethod=marker
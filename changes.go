@@ -0,0 +1,146 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"pault.ag/go/debian/control"
+)
+
+// ChangesVerifier {{{
+
+// ChangesVerifier checks an upload's .changes file before it's accepted
+// into the Archive. This ensures the .changes was OpenPGP signed by a key
+// in the Keyring, and that every file it lists matches the declared size,
+// MD5 (from the Files stanza) and SHA256 (from the Checksums-Sha256 stanza).
+type ChangesVerifier struct {
+	Keyring openpgp.EntityList
+}
+
+// Create a new ChangesVerifier, which will only accept uploads signed by
+// a key in `keyring`.
+func NewChangesVerifier(keyring openpgp.EntityList) *ChangesVerifier {
+	return &ChangesVerifier{Keyring: keyring}
+}
+
+// Verify the .changes file at `path`, and all the files it references.
+// This will return the parsed .changes, and the OpenPGP Entity that signed
+// it.
+func (v ChangesVerifier) Verify(path string) (*control.Changes, *openpgp.Entity, error) {
+	changes, signer, err := v.VerifySignature(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := v.VerifyFiles(changes); err != nil {
+		return nil, nil, err
+	}
+
+	return changes, signer, nil
+}
+
+// Parse the .changes file at `path`, ensuring that it has been signed
+// by a key in the Keyring. This does not check the files the .changes
+// references, see VerifyFiles.
+func (v ChangesVerifier) VerifySignature(path string) (*control.Changes, *openpgp.Entity, error) {
+	if len(v.Keyring) == 0 {
+		return nil, nil, fmt.Errorf("No keyring loaded")
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fd.Close()
+
+	plaintext, signer, err := readClearsigned(fd, v.Keyring)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s is not signed by a known key: %s", path, err)
+	}
+
+	decoder, err := control.NewDecoder(bytes.NewReader(plaintext), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := control.Changes{}
+	if err := decoder.Decode(&changes); err != nil {
+		return nil, nil, err
+	}
+	changes.Filename = path
+
+	return &changes, signer, nil
+}
+
+// Check every file listed in the Files and Checksums-Sha256 stanzas of
+// the .changes against the files on disk. Every file in Files must also
+// have an entry in Checksums-Sha256, and every file must be a bare
+// filename, in the same directory as the .changes.
+func (v ChangesVerifier) VerifyFiles(changes *control.Changes) error {
+	dir := filepath.Dir(changes.Filename)
+
+	for _, el := range changes.Files {
+		if err := checkChangesFilename(el.Filename); err != nil {
+			return err
+		}
+	}
+	for _, el := range changes.ChecksumsSha256 {
+		if err := checkChangesFilename(el.Filename); err != nil {
+			return err
+		}
+	}
+
+	sha256s := map[string]control.FileHash{}
+	for _, el := range changes.ChecksumsSha256 {
+		sha256s[el.Filename] = el.FileHash
+	}
+
+	for _, el := range changes.Files {
+		if _, ok := sha256s[el.Filename]; !ok {
+			return fmt.Errorf("%s has no Checksums-Sha256 entry", el.Filename)
+		}
+		if err := verifyFileHash(filepath.Join(dir, el.Filename), el.FileHash); err != nil {
+			return err
+		}
+	}
+
+	for _, el := range changes.ChecksumsSha256 {
+		if err := verifyFileHash(filepath.Join(dir, el.Filename), el.FileHash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check that a file listed in a .changes is just a filename, rather than
+// a path that could lead out of the directory the .changes is in.
+func checkChangesFilename(name string) error {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name || strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid filename in .changes: '%s'", name)
+	}
+	return nil
+}
+
+// Get the source name of an upload's .changes; the Source field may have a
+// version after it, for binary only uploads.
+func changesSource(changes control.Changes) string {
+	fields := strings.Fields(changes.Source)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// }}}
+
+// vim: foldmethod=marker
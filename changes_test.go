@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pault.ag/go/debian/control"
+)
+
+// ChangesVerifier {{{
+
+// Write `data` to `name` in `dir`, and get the Files and Checksums-Sha256
+// entries a .changes would list it with.
+func writeUploadFile(
+	t *testing.T,
+	dir, name string,
+	data []byte,
+) (control.FileListChangesFileHash, control.SHA256FileHash) {
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(data))
+	md5sum := control.FileListChangesFileHash{
+		FileHash: control.FileHash{
+			Algorithm: "md5",
+			Hash:      fmt.Sprintf("%x", md5.Sum(data)),
+			Size:      size,
+			Filename:  name,
+		},
+		Component: "main",
+		Priority:  "optional",
+	}
+	sha256sum := control.SHA256FileHash{FileHash: control.FileHash{
+		Algorithm: "sha256",
+		Hash:      fmt.Sprintf("%x", sha256.Sum256(data)),
+		Size:      size,
+		Filename:  name,
+	}}
+	return md5sum, sha256sum
+}
+
+func TestVerifyFiles(t *testing.T) {
+	dir := t.TempDir()
+	md5sum, sha256sum := writeUploadFile(t, dir, "foo_1.0.dsc", []byte("Source: foo\n"))
+	changes := control.Changes{
+		Filename:        filepath.Join(dir, "foo_1.0_source.changes"),
+		Files:           []control.FileListChangesFileHash{md5sum},
+		ChecksumsSha256: []control.SHA256FileHash{sha256sum},
+	}
+
+	if err := (ChangesVerifier{}).VerifyFiles(&changes); err != nil {
+		t.Fatalf("Matching upload was refused: %s", err)
+	}
+
+	/* Same size, different contents */
+	if err := os.WriteFile(filepath.Join(dir, "foo_1.0.dsc"), []byte("Source: bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := (ChangesVerifier{}).VerifyFiles(&changes)
+	if err == nil {
+		t.Fatalf("Upload with a changed file was accepted")
+	}
+	if !strings.Contains(err.Error(), "mismatch on") {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestVerifyFilesTraversal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "incoming")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	md5sum, sha256sum := writeUploadFile(t, root, "secret", []byte("hunter2\n"))
+
+	for _, name := range []string{"../secret", root + "/secret", "..", ""} {
+		md5sum.Filename = name
+		sha256sum.Filename = name
+		changes := control.Changes{
+			Filename:        filepath.Join(dir, "foo_1.0_source.changes"),
+			Files:           []control.FileListChangesFileHash{md5sum},
+			ChecksumsSha256: []control.SHA256FileHash{sha256sum},
+		}
+		err := (ChangesVerifier{}).VerifyFiles(&changes)
+		if err == nil || !strings.Contains(err.Error(), "Invalid filename") {
+			t.Errorf("Upload listing '%s' wasn't refused: %v", name, err)
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,379 @@
+// Command go-archive manages a Debian archive on the local filesystem.
+//
+//	go-archive [-root DIR] init [-name NAME] [-email EMAIL] [-type ed25519|rsa]
+//	go-archive [-root DIR] add SUITE COMPONENT FILE.deb...
+//	go-archive [-root DIR] publish SUITE
+//	go-archive [-root DIR] serve [-listen ADDR]
+//
+// `init` creates the archive and a signing key, `add` copies .debs into the
+// pool, and stages them for the suite, and `publish` writes out the suite's
+// indices and Release files, signs them, links them into place, and removes
+// anything no longer in use. `serve` serves the archive over HTTP, so it
+// can be tested with apt right away.
+//
+// What each suite contains is kept in Packages files under ".go-archive"
+// in the root of the archive, along with the signing key. The public key
+// is written to "archive.asc", for clients to import.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+
+	"pault.ag/go/archive"
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/deb"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: go-archive [-root DIR] <command> [arguments]
+
+commands:
+  init [-name NAME] [-email EMAIL] [-type ed25519|rsa]
+                                        create an archive and signing key
+  add SUITE COMPONENT FILE.deb...       add .deb files to a suite
+  publish SUITE                         sign and publish a suite
+  serve [-listen ADDR]                  serve the archive over HTTP
+`)
+	os.Exit(2)
+}
+
+func main() {
+	root := flag.String("root", ".", "root directory of the archive")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	var err error
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "init":
+		err = initArchive(*root, args)
+	case "add":
+		err = add(*root, args)
+	case "publish":
+		err = publish(*root, args)
+	case "serve":
+		err = serve(*root, args)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "go-archive: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Paths {{{
+
+func stateDir(root string) string {
+	return filepath.Join(root, ".go-archive")
+}
+
+func keyPath(root string) string {
+	return filepath.Join(stateDir(root), "signing.key")
+}
+
+func suiteDir(root, suite string) string {
+	return filepath.Join(stateDir(root), "suites", suite)
+}
+
+// }}}
+
+// init {{{
+
+func initArchive(root string, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	name := flags.String("name", "Archive Signing Key", "name on the signing key")
+	email := flags.String("email", "", "email address on the signing key")
+	keyType := flags.String("type", "ed25519", "type of signing key (ed25519 or rsa)")
+	flags.Parse(args)
+
+	config := packet.Config{}
+	switch *keyType {
+	case "ed25519":
+		config.Algorithm = packet.PubKeyAlgoEdDSA
+		config.Curve = packet.Curve25519
+	case "rsa":
+		config.Algorithm = packet.PubKeyAlgoRSA
+		config.RSABits = 4096
+	default:
+		return fmt.Errorf("Unknown key type: '%s'", *keyType)
+	}
+
+	if _, err := os.Stat(keyPath(root)); err == nil {
+		return fmt.Errorf("%s is already an archive", root)
+	}
+
+	a, err := archive.New(root, nil)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir(root), 0700); err != nil {
+		return err
+	}
+
+	entity, err := openpgp.NewEntity(*name, "", *email, &config)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(keyPath(root), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	err = writeArmored(fd, openpgp.PrivateKeyType, func(w io.Writer) error {
+		return entity.SerializePrivate(w, nil)
+	})
+	if err != nil {
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	/* Publish the public key through the Store, so it's served (and kept)
+	 * like anything else in the archive */
+	writer, err := a.Store.Create()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	if err := writeArmored(writer, openpgp.PublicKeyType, entity.Serialize); err != nil {
+		return err
+	}
+	obj, err := a.Store.Commit(writer)
+	if err != nil {
+		return err
+	}
+	return a.Store.Link(*obj, "archive.asc")
+}
+
+func writeArmored(out io.Writer, blockType string, fn func(io.Writer) error) error {
+	writer, err := armor.Encode(out, blockType, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(writer); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func loadArchive(root string) (*archive.Archive, error) {
+	fd, err := os.Open(keyPath(root))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is not an archive (try go-archive init)", root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	keyring, err := openpgp.ReadArmoredKeyRing(fd)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 || keyring[0].PrivateKey == nil {
+		return nil, fmt.Errorf("No private key in %s", keyPath(root))
+	}
+
+	return archive.New(root, keyring[0])
+}
+
+// }}}
+
+// add {{{
+
+func add(root string, args []string) error {
+	if len(args) < 3 {
+		usage()
+	}
+	suite, component, debs := args[0], args[1], args[2:]
+
+	a, err := loadArchive(root)
+	if err != nil {
+		return err
+	}
+
+	return a.WithLock(func() error {
+		for _, debPath := range debs {
+			if err := addDeb(a, suite, component, debPath); err != nil {
+				return fmt.Errorf("%s: %s", debPath, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Copy the .deb into the pool, and append its Package entry to the
+// suite's staged Packages file for the component and architecture.
+func addDeb(a *archive.Archive, suite, component, debPath string) error {
+	debFile, closer, err := deb.LoadFile(debPath)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	pkg, err := a.Pool.IncludeDeb(component, *debFile)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(suiteDir(a.Path(), suite), component)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(
+		filepath.Join(dir, pkg.Architecture.String()),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	encoder, err := control.NewEncoder(fd)
+	if err != nil {
+		return err
+	}
+	if err := encoder.Encode(pkg); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// }}}
+
+// publish {{{
+
+func publish(root string, args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	suiteName := args[0]
+
+	a, err := loadArchive(root)
+	if err != nil {
+		return err
+	}
+
+	return a.WithLock(func() error {
+		suite, err := a.Suite(suiteName)
+		if err != nil {
+			return err
+		}
+		/* Adding the same .deb twice should just pick up the newest entry */
+		suite.SetDuplicatePolicy(archive.ReplaceDuplicates)
+
+		if err := loadStaged(suite, suiteDir(root, suiteName)); err != nil {
+			return err
+		}
+
+		state, err := a.Engross(*suite)
+		if err != nil {
+			return err
+		}
+		if err := a.Link(state); err != nil {
+			return err
+		}
+		return a.GC()
+	})
+}
+
+// Add every staged Package entry to the Suite.
+func loadStaged(suite *archive.Suite, dir string) error {
+	components, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Nothing has been added to %s", suite.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range components {
+		if !entry.IsDir() {
+			continue
+		}
+		component, err := suite.Component(entry.Name())
+		if err != nil {
+			return err
+		}
+
+		files, err := filepath.Glob(filepath.Join(dir, entry.Name(), "*"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			packages, err := archive.LoadPackagesFile(file)
+			if err != nil {
+				return err
+			}
+			err = loadPackages(component, packages)
+			packages.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+func loadPackages(component *archive.Component, packages *archive.Packages) error {
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := component.AddPackage(*pkg); err != nil {
+			return err
+		}
+	}
+}
+
+// }}}
+
+// serve {{{
+
+func serve(root string, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:8080", "address to listen on")
+	flags.Parse(args)
+
+	if _, err := os.Stat(stateDir(root)); err != nil {
+		return fmt.Errorf("%s is not an archive (try go-archive init)", root)
+	}
+
+	store, err := archive.NewFilesystemStore(root)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Serving %s on http://%s/", store.Root(), *listen)
+	return http.ListenAndServe(*listen, archive.NewServer(store))
+}
+
+// }}}
+
+// vim: foldmethod=marker
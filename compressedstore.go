@@ -0,0 +1,212 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CompressedStore {{{
+
+// CompressedStore is a Store wrapping another Store, keeping every blob
+// gzip compressed in it, for Archives kept on expensive storage. Open
+// decompresses blobs, and Stat gives their uncompressed size, but Object
+// IDs are those of the wrapped Store, the hash of the compressed blob.
+// Blobs stored before the Store was wrapped are read back as they are.
+type CompressedStore struct {
+	Store
+
+	level int
+}
+
+// Create a CompressedStore, keeping blobs in `store` compressed with gzip
+// at `level` (such as gzip.BestCompression).
+func NewCompressedStore(store Store, level int) (*CompressedStore, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return &CompressedStore{Store: store, level: level}, nil
+}
+
+// Get a copy of the CompressedStore which makes every operation on the
+// wrapped Store with `ctx`, if it supports it.
+func (s CompressedStore) WithContext(ctx context.Context) Store {
+	s.Store = storeWithContext(s.Store, ctx)
+	return &s
+}
+
+// Every compressed blob starts with this, and then the size of the blob
+// before it was compressed, as a big-endian uint64, so that Stat doesn't
+// need to decompress the whole thing.
+var compressedMagic = []byte("\x89ARCHGZ\n")
+
+const compressedHeaderSize = 8 + 8
+
+// Blobs are compressed to a temporary file as they're written, since the
+// size isn't known until they're committed.
+type compressedWriter struct {
+	fd       *os.File
+	gz       *gzip.Writer
+	size     int64
+	closed   bool
+	finished bool
+}
+
+func (w *compressedWriter) Write(p []byte) (int, error) {
+	if w.finished {
+		return 0, fmt.Errorf("Write to a committed Writer")
+	}
+	n, err := w.gz.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *compressedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.fd.Close()
+	os.Remove(w.fd.Name())
+	return err
+}
+
+func (s CompressedStore) Create() (Writer, error) {
+	fd, err := os.CreateTemp("", "archive-blob-")
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewWriterLevel(fd, s.level)
+	if err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return nil, err
+	}
+	return &compressedWriter{fd: fd, gz: gz}, nil
+}
+
+func (s CompressedStore) Commit(writer Writer) (*Object, error) {
+	w, ok := writer.(*compressedWriter)
+	if !ok {
+		return nil, fmt.Errorf("Writer was not created by a CompressedStore")
+	}
+	defer w.Close()
+
+	w.finished = true
+	if err := w.gz.Close(); err != nil {
+		return nil, err
+	}
+	if _, err := w.fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	inner, err := s.Store.Create()
+	if err != nil {
+		return nil, err
+	}
+	defer inner.Close()
+
+	header := make([]byte, compressedHeaderSize)
+	copy(header, compressedMagic)
+	binary.BigEndian.PutUint64(header[len(compressedMagic):], uint64(w.size))
+	if _, err := inner.Write(header); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(inner, w.fd); err != nil {
+		return nil, err
+	}
+	return s.Store.Commit(inner)
+}
+
+// Read the header off a blob from the wrapped Store, if it's compressed,
+// returning its size before it was compressed, and the rest of the blob.
+func readCompressedHeader(fd io.Reader) (int64, bool, *bufio.Reader, error) {
+	reader := bufio.NewReader(fd)
+	header, err := reader.Peek(compressedHeaderSize)
+	if err != nil && err != io.EOF {
+		return 0, false, nil, err
+	}
+	if len(header) < compressedHeaderSize || !bytes.HasPrefix(header, compressedMagic) {
+		return 0, false, reader, nil
+	}
+	size := int64(binary.BigEndian.Uint64(header[len(compressedMagic):]))
+	if _, err := reader.Discard(compressedHeaderSize); err != nil {
+		return 0, false, nil, err
+	}
+	return size, true, reader, nil
+}
+
+type compressedReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r compressedReader) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s CompressedStore) Open(obj Object) (io.ReadCloser, error) {
+	fd, err := s.Store.Open(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	_, compressed, reader, err := readCompressedHeader(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if !compressed {
+		return compressedReader{Reader: reader, closers: []io.Closer{fd}}, nil
+	}
+
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return compressedReader{Reader: gz, closers: []io.Closer{gz, fd}}, nil
+}
+
+// Check the compressed blob against its Object ID, in the wrapped Store.
+func (s CompressedStore) Verify(obj Object) error {
+	return verifyObject(s.Store, obj)
+}
+
+// Get the size of the blob as it was written, and when it was committed.
+func (s CompressedStore) Stat(obj Object) (*ObjectInfo, error) {
+	info, err := s.Store.Stat(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := s.Store.Open(obj)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	size, compressed, _, err := readCompressedHeader(fd)
+	if err != nil {
+		return nil, err
+	}
+	if compressed {
+		info.Size = size
+	}
+	return info, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
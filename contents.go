@@ -0,0 +1,216 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Contents {{{
+
+// ContentsEntry is a single line of a Contents index, mapping a path
+// (relative to the root of the filesystem, such as "usr/bin/apt") to the
+// packages that ship it.
+type ContentsEntry struct {
+	Path string
+
+	// Qualified names of the packages shipping Path, such as "admin/apt"
+	// or "contrib/net/foo" (for packages outside of main).
+	Packages []string
+}
+
+// Get the names of the packages shipping the Path, without the component
+// or section qualifying them.
+func (c ContentsEntry) PackageNames() []string {
+	ret := []string{}
+	for _, pkg := range c.Packages {
+		ret = append(ret, pkg[strings.LastIndex(pkg, "/")+1:])
+	}
+	return ret
+}
+
+// Iterator to access the entries contained in a Contents index in an apt
+// repo, which answers which package(s) ship a given file.
+type Contents struct {
+	reader   *bufio.Reader
+	closer   io.Closer
+	preamble bool
+}
+
+// Older Contents files start with free-form text, ending with a line
+// with the column headings.
+var contentsHeader = regexp.MustCompile(`(?m)^FILE[ \t]+LOCATION[ \t]*$`)
+
+// How far into the file to look for the column headings.
+const contentsPreambleSize = 64 * 1024
+
+// Map {{{
+
+// Get any entries that match the criteria
+func (c *Contents) Map(q func(*ContentsEntry) bool) ([]ContentsEntry, error) {
+	ret := []ContentsEntry{}
+
+	for {
+		entry, err := c.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if q(entry) {
+			ret = append(ret, *entry)
+		}
+	}
+}
+
+// }}}
+
+// Next {{{
+
+// Get the next entry in the Contents index. This will return an io.EOF at
+// the last entry.
+func (c *Contents) Next() (*ContentsEntry, error) {
+	if !c.preamble {
+		c.preamble = true
+		if err := c.skipPreamble(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		/* The path may contain spaces, but the list of packages won't, so
+		 * split on the last run of whitespace */
+		i := strings.LastIndexAny(line, " \t")
+		if i == -1 {
+			return nil, fmt.Errorf("Malformed Contents line: '%s'", line)
+		}
+
+		return &ContentsEntry{
+			Path:     strings.TrimRight(line[:i], " \t"),
+			Packages: strings.Split(line[i+1:], ","),
+		}, nil
+	}
+}
+
+// Throw away the free-form preamble of the Contents file, if it has one.
+func (c *Contents) skipPreamble() error {
+	head, err := c.reader.Peek(contentsPreambleSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+
+	loc := contentsHeader.FindIndex(head)
+	if loc == nil {
+		return nil
+	}
+	_, err = c.reader.Discard(loc[1])
+	return err
+}
+
+// }}}
+
+// Close {{{
+
+// Close the underlying file, if this Contents iterator was created by
+// LoadContentsFile. This is a no-op otherwise.
+func (c *Contents) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// }}}
+
+// LoadContentsFile {{{
+
+// Given a path, create a Contents iterator. Note that the Contents file is
+// not OpenPGP signed, so one will need to verify the integrety of this
+// file from the InRelease file before trusting any output.
+func LoadContentsFile(path string) (*Contents, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := LoadContents(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	ret.closer = fd
+	return ret, nil
+}
+
+// }}}
+
+// LoadContents {{{
+
+// Given an io.Reader, create a Contents iterator. The data may be gzip, xz
+// or zstd compressed (as published in dists/), or uncompressed.
+func LoadContents(in io.Reader) (*Contents, error) {
+	reader, err := decompress(in)
+	if err != nil {
+		return nil, err
+	}
+	return &Contents{reader: bufio.NewReaderSize(reader, contentsPreambleSize)}, nil
+}
+
+// }}}
+
+// }}}
+
+// Decompression {{{
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Wrap the io.Reader with a decompressor, if the data is gzip, xz or zstd
+// compressed.
+func decompress(in io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(in)
+	magic, err := reader.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(reader)
+	case bytes.HasPrefix(magic, xzMagic):
+		return xz.NewReader(reader)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return reader, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
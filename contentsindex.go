@@ -0,0 +1,227 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/deb"
+	"pault.ag/go/debian/dependency"
+)
+
+// Contents Generation {{{
+
+// ContentsLayout decides which Contents indices a Suite publishes, mapping
+// every file shipped by its Packages to the Packages shipping it, for
+// apt-file and friends. Layouts can be combined, such as
+// SuiteContents|ComponentContents, which is what Debian publishes.
+type ContentsLayout int
+
+const (
+	// Don't publish any Contents indices. This is the default.
+	NoContents ContentsLayout = 0
+
+	// Publish "Contents-<arch>" at the top of the Suite, covering every
+	// Component; what apt-file used before it fetched them per Component.
+	SuiteContents ContentsLayout = 1 << (iota - 1)
+
+	// Publish "<component>/Contents-<arch>", covering just that Component.
+	ComponentContents
+)
+
+// Set which Contents indices the Suite publishes. In each layout, udebs
+// (installer packages) get a "Contents-udeb-<arch>" of their own, and are
+// left out of "Contents-<arch>". Contents indices are published in each of
+// the Suite's Compressions.
+//
+// Generating Contents means reading through every .deb in the Suite each
+// time it's Engrossed, so it's off by default.
+func (s *Suite) SetContents(layout ContentsLayout) {
+	s.features.Contents = layout
+}
+
+// Check if a Package is a udeb; only used by the Debian Installer.
+func isUdeb(pkg Package) bool {
+	return pkg.Paragraph.Values["Package-Type"] == "udeb" || strings.HasSuffix(pkg.Filename, ".udeb")
+}
+
+// The files of a single Contents index; by path, the qualified names of
+// the Packages shipping it.
+type contentsIndex map[string]map[string]bool
+
+func (c contentsIndex) add(paths []string, qualified string) {
+	for _, filePath := range paths {
+		if _, ok := c[filePath]; !ok {
+			c[filePath] = map[string]bool{}
+		}
+		c[filePath][qualified] = true
+	}
+}
+
+// Render the Contents index; a line for each path, sorted, with the
+// Packages shipping it, like "usr/bin/apt  admin/apt".
+func (c contentsIndex) render() []byte {
+	paths := []string{}
+	for filePath := range c {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+
+	buf := bytes.Buffer{}
+	for _, filePath := range paths {
+		names := []string{}
+		for name := range c[filePath] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&buf, "%-55s %s\n", filePath, strings.Join(names, ","))
+	}
+	return buf.Bytes()
+}
+
+// Add a Contents index to `indices`, by name, if it isn't there already.
+func getContentsIndex(indices map[string]contentsIndex, name string) contentsIndex {
+	if _, ok := indices[name]; !ok {
+		indices[name] = contentsIndex{}
+	}
+	return indices[name]
+}
+
+// Write out the Suite's Contents indices, according to its ContentsLayout,
+// and register them in the ArchiveState and Release.
+func (a Archive) commitContents(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	packageIndices map[string]map[dependency.Arch]*IndexWriter,
+) error {
+	layout := suite.features.Contents
+	if layout == NoContents {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "archive-contents-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	/* The same .deb (such as one built for "all") may be in more than
+	 * one index, but only needs reading once */
+	debPaths := map[string][]string{}
+	suiteIndices := map[string]contentsIndex{}
+
+	for _, name := range suite.componentNames() {
+		componentIndices := map[string]contentsIndex{}
+		indices := packageIndices[name]
+		for _, arch := range sortedArches(indices) {
+			for _, entry := range indices[arch].entries {
+				pkg, ok := entry.(Package)
+				if !ok {
+					continue
+				}
+				paths, ok := debPaths[pkg.Filename]
+				if !ok {
+					if paths, err = a.debContents(dir, pkg.Filename); err != nil {
+						return fmt.Errorf("%s: %s", pkg.Filename, err)
+					}
+					debPaths[pkg.Filename] = paths
+				}
+
+				indexName := "Contents-" + arch.String()
+				if isUdeb(pkg) {
+					indexName = "Contents-udeb-" + arch.String()
+				}
+				qualified := pkg.Package
+				if pkg.Section != "" {
+					qualified = pkg.Section + "/" + pkg.Package
+				}
+				getContentsIndex(suiteIndices, indexName).add(paths, qualified)
+				getContentsIndex(componentIndices, indexName).add(paths, qualified)
+			}
+		}
+
+		if layout&ComponentContents != 0 {
+			if err := a.commitContentsIndices(suite, release, files, name, componentIndices); err != nil {
+				return err
+			}
+		}
+	}
+
+	if layout&SuiteContents != 0 {
+		return a.commitContentsIndices(suite, release, files, "", suiteIndices)
+	}
+	return nil
+}
+
+func (a Archive) commitContentsIndices(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	dir string,
+	indices map[string]contentsIndex,
+) error {
+	names := []string{}
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		suitePath := path.Join(dir, name)
+		if _, err := a.commitCompressed(suite, release, files, suitePath, indices[name].render()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the paths of every file (but not directory) a published .deb
+// ships, relative to the root of the filesystem.
+func (a Archive) debContents(dir string, target string) ([]string, error) {
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return nil, err
+	}
+	localPath := filepath.Join(dir, "contents.deb")
+	err = writeLocalFile(localPath, fd)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	debFile, closer, err := deb.LoadFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	ret := []string{}
+	for {
+		hdr, err := debFile.Data.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		filePath := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if filePath == "." {
+			continue
+		}
+		ret = append(ret, filePath)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
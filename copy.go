@@ -0,0 +1,152 @@
+package archive
+
+import (
+	"fmt"
+
+	"pault.ag/go/debian/version"
+)
+
+// Copy {{{
+
+// Copy every binary Package named `name` at version `ver` (on any
+// architecture) from the Suite `from` into this Suite, keeping the
+// Component it was in. Both Suites must belong to the same Archive.
+//
+// The Package entries are copied as-is, so they continue to point at
+// the same files in the pool, meaning nothing has to be re-hashed or
+// re-uploaded. This is the common "promote from unstable to stable"
+// workflow.
+func (s *Suite) CopyPackage(from *Suite, name string, ver version.Version) ([]Package, error) {
+	if err := s.checkSameArchive(from); err != nil {
+		return nil, err
+	}
+
+	ret := []Package{}
+	for _, componentName := range from.componentNames() {
+		component := from.components[componentName]
+		for _, arch := range component.arches() {
+			found := component.packageWriters[arch].Find(func(entry interface{}) bool {
+				pkg, ok := entry.(Package)
+				return ok && pkg.Package == name && version.Compare(pkg.Version, ver) == 0
+			})
+			for _, entry := range found {
+				pkg := entry.(Package)
+				if err := s.addCopiedPackage(componentName, pkg); err != nil {
+					return nil, err
+				}
+				ret = append(ret, pkg)
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("No such package: %s %s", name, ver)
+	}
+	return ret, nil
+}
+
+// Copy the Source named `name` at version `ver` from the Suite `from` into
+// this Suite, just like CopyPackage. If `binaries` is set, every binary
+// Package built from that Source is copied along with it.
+func (s *Suite) CopySource(
+	from *Suite,
+	name string,
+	ver version.Version,
+	binaries bool,
+) ([]Source, []Package, error) {
+	if err := s.checkSameArchive(from); err != nil {
+		return nil, nil, err
+	}
+
+	sources := []Source{}
+	packages := []Package{}
+
+	for _, componentName := range from.componentNames() {
+		component := from.components[componentName]
+		if component.sourceWriter != nil {
+			found := component.sourceWriter.Find(func(entry interface{}) bool {
+				src, ok := entry.(Source)
+				return ok && src.Package == name && version.Compare(src.Version, ver) == 0
+			})
+			for _, entry := range found {
+				src := entry.(Source)
+				if err := s.addCopiedSource(componentName, src); err != nil {
+					return nil, nil, err
+				}
+				sources = append(sources, src)
+			}
+		}
+
+		if !binaries {
+			continue
+		}
+
+		for _, arch := range component.arches() {
+			found := component.packageWriters[arch].Find(func(entry interface{}) bool {
+				pkg, ok := entry.(Package)
+				return ok && builtFrom(pkg, name, ver)
+			})
+			for _, entry := range found {
+				pkg := entry.(Package)
+				if err := s.addCopiedPackage(componentName, pkg); err != nil {
+					return nil, nil, err
+				}
+				packages = append(packages, pkg)
+			}
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil, nil, fmt.Errorf("No such source: %s %s", name, ver)
+	}
+	return sources, packages, nil
+}
+
+// Pool paths are only meaningful within a single Archive, so refuse to
+// copy entries from a Suite in any other Archive.
+func (s *Suite) checkSameArchive(from *Suite) error {
+	if s.archive.Path() != from.archive.Path() {
+		return fmt.Errorf(
+			"Can't copy from %s into %s, they're in different archives",
+			from.Name, s.Name,
+		)
+	}
+	return nil
+}
+
+func (s *Suite) addCopiedPackage(componentName string, pkg Package) error {
+	component, err := s.Component(componentName)
+	if err != nil {
+		return err
+	}
+	return component.AddPackage(pkg)
+}
+
+func (s *Suite) addCopiedSource(componentName string, src Source) error {
+	component, err := s.Component(componentName)
+	if err != nil {
+		return err
+	}
+	return component.AddSource(src)
+}
+
+// Check to see if the binary Package was built from the Source `name` at
+// version `ver`. If the Package has no Source field, the source has the
+// same name and version as the binary.
+func builtFrom(pkg Package, name string, ver version.Version) bool {
+	sourceName := pkg.Source.Name
+	if sourceName == "" {
+		sourceName = pkg.Package
+	}
+
+	sourceVersion := pkg.Source.Version
+	if sourceVersion.Empty() {
+		sourceVersion = pkg.Version
+	}
+
+	return sourceName == name && version.Compare(sourceVersion, ver) == 0
+}
+
+// }}}
+
+// vim: foldmethod=marker
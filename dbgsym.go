@@ -0,0 +1,63 @@
+package archive
+
+import (
+	"strings"
+)
+
+// Debug Symbols {{{
+
+// Route debug symbol Packages (the "-dbgsym" Packages debhelper builds,
+// marked "Auto-Built-Package: debug-symbols") added to any Component of the
+// Suite into the Component named `component` of the Suite `debug` instead,
+// to keep them out of the main indices, like Debian's "-debug" Suites, or
+// Ubuntu's ddebs.
+//
+// If `debug` is nil, they're routed to a Component of this Suite, and if
+// `component` is "", they go to the Component with the same name as the
+// one they were added to; so, for Debian's layout, pass the "sid-debug"
+// Suite and "", and for a "main/debug" style Component of the same Suite,
+// pass nil and "main/debug". Passing nil and "" (the default) turns this
+// off. Only where the entry is added changes; the pool file stays where
+// it was included.
+func (s *Suite) SetDebugRouting(debug *Suite, component string) {
+	s.features.DebugSuite = debug
+	s.features.DebugComponent = component
+}
+
+// Check if a Package only holds debug symbols.
+func isDebugSymbols(pkg Package) bool {
+	if pkg.Paragraph.Values["Auto-Built-Package"] == "debug-symbols" {
+		return true
+	}
+	return strings.HasSuffix(pkg.Package, "-dbgsym")
+}
+
+// Get the Component a Package added to `c` should go in, if it's debug
+// symbols and the Suite routes them somewhere else, or nil if it belongs
+// in `c`.
+func (c *Component) debugComponent(pkg Package) (*Component, error) {
+	features := c.suite.features
+	if features.DebugSuite == nil && features.DebugComponent == "" {
+		return nil, nil
+	}
+	if !isDebugSymbols(pkg) {
+		return nil, nil
+	}
+
+	suite := c.suite
+	if features.DebugSuite != nil {
+		suite = features.DebugSuite
+	}
+	name := c.name
+	if features.DebugComponent != "" {
+		name = features.DebugComponent
+	}
+	if suite == c.suite && name == c.name {
+		return nil, nil
+	}
+	return suite.Component(name)
+}
+
+// }}}
+
+// vim: foldmethod=marker
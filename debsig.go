@@ -0,0 +1,251 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/deb"
+)
+
+// Embedded .deb Signatures {{{
+
+// Check the OpenPGP signatures embedded in the .deb at `debPath` against
+// the keyring, and return the Entity that made the first good one. Both
+// kinds of embedded signature are understood:
+//
+//   - debsigs, a detached signature (in the "_gpgorigin" member) over the
+//     "debian-binary", "control.tar" and "data.tar" members, in order.
+//   - dpkg-sig, a clearsigned list of the size, MD5 and SHA1 of each member
+//     (in a "_gpgbuilder" member, or any other "_gpg" member).
+//
+// If the .deb has no embedded signature, or none of them are good, an error
+// is returned.
+func VerifyDebSignature(debPath string, keyring openpgp.EntityList) (*openpgp.Entity, error) {
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("No keyring loaded")
+	}
+
+	signatures, err := readDebSignatures(debPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("%s has no embedded signature", filepath.Base(debPath))
+	}
+
+	names := []string{}
+	for name := range signatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := []string{}
+	for _, name := range names {
+		var signer *openpgp.Entity
+		if name == "_gpgorigin" {
+			signer, err = verifyDebsig(debPath, signatures[name], keyring)
+		} else {
+			signer, err = verifyDpkgSig(debPath, signatures[name], keyring)
+		}
+		if err == nil {
+			return signer, nil
+		}
+		problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+	}
+	return nil, fmt.Errorf(
+		"%s has no good embedded signature (%s)",
+		filepath.Base(debPath), strings.Join(problems, "; "),
+	)
+}
+
+// Create a DebCheck (see DebCheckHook) which rejects any .deb without a
+// good embedded signature from a key in `keyring`.
+func DebSignatureCheck(keyring openpgp.EntityList) DebCheck {
+	return func(debPath string) error {
+		if _, err := VerifyDebSignature(debPath, keyring); err != nil {
+			return Reject("%s", err)
+		}
+		return nil
+	}
+}
+
+// Only include .debs into the Pool (by IncludeDeb, or anything using it,
+// such as an Incoming queue) that have a good embedded signature from a key
+// in `keyring`; see VerifyDebSignature. This is on top of any checks on
+// the .changes they were uploaded with. Passing nil turns this back off.
+func (a *Archive) RequireDebSignatures(keyring openpgp.EntityList) {
+	a.Pool.debKeyring = keyring
+}
+
+// Call `fn` with each member of the ar archive (such as a .deb) at
+// `debPath`, in order, by name.
+func eachArEntry(debPath string, fn func(name string, entry *deb.ArEntry) error) error {
+	fd, err := os.Open(debPath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	ar, err := deb.LoadAr(fd)
+	if err != nil {
+		return err
+	}
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(strings.TrimRight(entry.Name, "/ "), entry); err != nil {
+			return err
+		}
+	}
+}
+
+// Read every signature member ("_gpg" something) out of the .deb.
+func readDebSignatures(debPath string) (map[string][]byte, error) {
+	ret := map[string][]byte{}
+	err := eachArEntry(debPath, func(name string, entry *deb.ArEntry) error {
+		if !strings.HasPrefix(name, "_gpg") {
+			return nil
+		}
+		data, err := io.ReadAll(entry.Data)
+		ret[name] = data
+		return err
+	})
+	return ret, err
+}
+
+// Check if a .deb member is one of the members a signature has to cover.
+func isSignedDebMember(name string) bool {
+	return name == "debian-binary" ||
+		strings.HasPrefix(name, "control.tar") ||
+		strings.HasPrefix(name, "data.tar")
+}
+
+// Check a debsigs signature, streaming the signed members of the .deb
+// through to the signature check, rather than reading it all in.
+func verifyDebsig(debPath string, signature []byte, keyring openpgp.EntityList) (*openpgp.Entity, error) {
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		writer.CloseWithError(eachArEntry(debPath, func(name string, entry *deb.ArEntry) error {
+			if !isSignedDebMember(name) {
+				return nil
+			}
+			_, err := io.Copy(writer, entry.Data)
+			return err
+		}))
+	}()
+
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		return openpgp.CheckArmoredDetachedSignature(keyring, reader, bytes.NewReader(signature), nil)
+	}
+	return openpgp.CheckDetachedSignature(keyring, reader, bytes.NewReader(signature), nil)
+}
+
+// Check a dpkg-sig signature, by checking the clearsigned list of members,
+// and then each member against it.
+func verifyDpkgSig(debPath string, signature []byte, keyring openpgp.EntityList) (*openpgp.Entity, error) {
+	plaintext, signer, err := readClearsigned(bytes.NewReader(signature), keyring)
+	if err != nil {
+		return nil, err
+	}
+	files, err := parseDpkgSigFiles(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachArEntry(debPath, func(name string, entry *deb.ArEntry) error {
+		expected, ok := files[name]
+		if !ok {
+			if isSignedDebMember(name) {
+				return fmt.Errorf("%s isn't signed", name)
+			}
+			return nil
+		}
+		delete(files, name)
+
+		writer, hashers, err := newHashers([]string{"md5", "sha1"})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, entry.Data); err != nil {
+			return err
+		}
+		for i, hasher := range hashers {
+			fileHash := control.FileHashFromHasher(name, *hasher)
+			if fileHash.Size != expected[i].Size || fileHash.Hash != expected[i].Hash {
+				return fmt.Errorf("%s doesn't match its signature", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 0 {
+		missing := []string{}
+		for name := range files {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%s signed, but not in the .deb", strings.Join(missing, ", "))
+	}
+	return signer, nil
+}
+
+// Parse the "Files" of a dpkg-sig signature; by member name, the MD5 and
+// SHA1 of each, like:
+//
+//	Files:
+//	 <md5> <sha1> <size> debian-binary
+func parseDpkgSigFiles(plaintext []byte) (map[string][]control.FileHash, error) {
+	ret := map[string][]control.FileHash{}
+	inFiles := false
+	scanner := bufio.NewScanner(bytes.NewReader(plaintext))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			inFiles = strings.HasPrefix(line, "Files:")
+			continue
+		}
+		if !inFiles {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Malformed Files line: '%s'", strings.TrimSpace(line))
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ret[fields[3]] = []control.FileHash{
+			{Algorithm: "md5", Hash: fields[0], Size: size, Filename: fields[3]},
+			{Algorithm: "sha1", Hash: fields[1], Size: size, Filename: fields[3]},
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("Signature lists no files")
+	}
+	return ret, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,99 @@
+package archive
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// Pool Deduplication {{{
+
+// DedupStats is how much pool deduplication has saved, since it was turned
+// on with EnablePoolDedup.
+type DedupStats struct {
+	// Number of .debs that were published by pointing at a pool file that
+	// was already there, rather than a new one.
+	Files int
+
+	// Total size of those .debs, in bytes.
+	Bytes int64
+}
+
+// Which pool path each blob is published at, by Object ID.
+type poolDedup struct {
+	lock  sync.Mutex
+	paths map[string]string
+	stats DedupStats
+}
+
+// Turn on pool deduplication. Once on, a .deb included into the Pool (with
+// IncludeDeb or IncludeDebs) that's byte-for-byte the same as a pool file
+// that's already there (such as the same .deb added to both "main" and
+// "contrib") isn't published at a second pool path; its Package entry gets
+// the existing pool file's Filename instead. See DedupStats for what this
+// saved.
+//
+// Every pool file that's already published is looked up when this is
+// called, which, on a FilesystemStore, means hashing all of them.
+func (a *Archive) EnablePoolDedup() error {
+	targets, err := a.Store.List("pool")
+	if err != nil {
+		return err
+	}
+
+	dedup := poolDedup{paths: map[string]string{}}
+	for _, target := range targets {
+		obj, err := a.Store.Lookup(target)
+		if err != nil {
+			return err
+		}
+		if _, ok := dedup.paths[obj.ID]; !ok {
+			dedup.paths[obj.ID] = target
+		}
+	}
+	a.Pool.dedup = &dedup
+	a.info("pool dedup enabled", "files", len(dedup.paths))
+	return nil
+}
+
+// Get how much pool deduplication has saved so far. This is empty unless
+// EnablePoolDedup was called.
+func (p Pool) DedupStats() DedupStats {
+	if p.dedup == nil {
+		return DedupStats{}
+	}
+	p.dedup.lock.Lock()
+	defer p.dedup.lock.Unlock()
+	return p.dedup.stats
+}
+
+// Find the pool path `obj` is already published at, if there is one (and
+// it's not `target`), so it can be used instead of linking `obj` again.
+// Otherwise, `target` is recorded as where `obj` is, once it's linked.
+func (p Pool) dedupPath(obj Object, target string) (string, bool, error) {
+	if p.dedup == nil {
+		return "", false, nil
+	}
+	p.dedup.lock.Lock()
+	defer p.dedup.lock.Unlock()
+
+	existing, ok := p.dedup.paths[obj.ID]
+	if ok && existing != target {
+		/* It may have been unlinked (say, by GCUnreferenced) since */
+		if current, err := p.Store.Lookup(existing); err == nil && current.ID == obj.ID {
+			info, err := p.Store.Stat(obj)
+			if err != nil {
+				return "", false, err
+			}
+			p.dedup.stats.Files++
+			p.dedup.stats.Bytes += info.Size
+			logEvent(p.logger, slog.LevelInfo, "deduplicated", "path", target, "existing", existing)
+			return existing, true, nil
+		}
+	}
+	p.dedup.paths[obj.ID] = target
+	return "", false, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,237 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/dependency"
+	"pault.ag/go/debian/version"
+)
+
+// Deltas {{{
+
+// DeltaFunc writes a delta that turns the .deb at the local path `from`
+// into the .deb at `to` (such as a .debdelta, as made by debdelta) to
+// `out`. If it can't, or the delta isn't worth having, it returns an
+// error, and no delta is published.
+type DeltaFunc func(from, to string, out io.Writer) error
+
+// Get a DeltaFunc that runs debdelta(1), with any extra `args` (such as
+// "--delta-algo=xdelta3" or "--max-percent=50") before the .debs.
+func DebdeltaCommand(args ...string) DeltaFunc {
+	return func(from, to string, out io.Writer) error {
+		dir, err := os.MkdirTemp("", "archive-debdelta-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		deltaPath := filepath.Join(dir, "delta")
+		cmdArgs := append(append([]string{}, args...), from, to, deltaPath)
+		output, err := exec.Command("debdelta", cmdArgs...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("debdelta failed: %s: %s", err, strings.TrimSpace(string(output)))
+		}
+
+		fd, err := os.Open(deltaPath)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		_, err = io.Copy(out, fd)
+		return err
+	}
+}
+
+// Generate deltas between consecutive versions of each binary Package
+// with `fn` when the Suite is Engrossed, for clients on slow or metered
+// links to upgrade with (such as with debpatch, or apt's debdelta
+// integration). Passing nil (the default) turns this off.
+//
+// For each version of a Package in the Suite's indices, a delta is made
+// from the version before it; either the one before it in the same index
+// (if the Suite keeps more than one, see SetRetention), or the one the
+// currently published index has, if its pool file is still around. Deltas
+// are published at "deltas/<pool directory>/<name>_<old>_<new>_<arch>.debdelta",
+// alongside the pool path of the newer .deb, and are only ever made once;
+// one that's already published is reused.
+func (s *Suite) SetDeltas(fn DeltaFunc) {
+	s.features.Deltas = fn
+}
+
+// Get the path a delta from `from` to `to` is published at.
+func deltaPath(from, to Package) string {
+	escape := func(ver version.Version) string {
+		return strings.ReplaceAll(ver.String(), ":", "%3a")
+	}
+	name := fmt.Sprintf("%s_%s_%s_%s.debdelta",
+		to.Package, escape(from.Version), escape(to.Version), to.Architecture)
+	return path.Join("deltas", path.Dir(to.Filename), name)
+}
+
+// Make (or find) a delta for each Package in the Suite's Packages
+// indices, and register them in the ArchiveState.
+func (a Archive) commitDeltas(
+	suite Suite,
+	files ArchiveState,
+	packageIndices map[string]map[dependency.Arch]*IndexWriter,
+) error {
+	if suite.features.Deltas == nil {
+		return nil
+	}
+
+	/* Versions the clients are most likely to have now */
+	previous := map[string][]Package{}
+	published, err := a.OpenSuite(suite.Name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if published != nil {
+		published.eachPackage(func(pkg Package) {
+			key := pkg.Package + " " + pkg.Architecture.String()
+			previous[key] = append(previous[key], pkg)
+		})
+	}
+
+	dir, err := os.MkdirTemp("", "archive-deltas-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range suite.componentNames() {
+		indices := packageIndices[name]
+		for _, arch := range sortedArches(indices) {
+			current := map[string][]Package{}
+			for _, entry := range indices[arch].entries {
+				pkg, ok := entry.(Package)
+				if !ok {
+					continue
+				}
+				key := pkg.Package + " " + pkg.Architecture.String()
+				current[key] = append(current[key], pkg)
+			}
+
+			keys := []string{}
+			for key := range current {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				if err := a.commitPackageDeltas(suite, files, dir, previous[key], current[key]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Make a delta to each of the `current` versions of a Package from the
+// version before it, out of the `current` and `previous` versions.
+func (a Archive) commitPackageDeltas(
+	suite Suite,
+	files ArchiveState,
+	dir string,
+	previous []Package,
+	current []Package,
+) error {
+	versions := []Package{}
+	isCurrent := map[string]bool{}
+	for _, pkg := range current {
+		isCurrent[pkg.Version.String()] = true
+		versions = append(versions, pkg)
+	}
+	for _, pkg := range previous {
+		if !isCurrent[pkg.Version.String()] {
+			versions = append(versions, pkg)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return version.Compare(versions[i].Version, versions[j].Version) < 0
+	})
+
+	for i := 1; i < len(versions); i++ {
+		from, to := versions[i-1], versions[i]
+		if !isCurrent[to.Version.String()] || from.Filename == to.Filename {
+			continue
+		}
+
+		target := deltaPath(from, to)
+		if obj, err := a.Store.Lookup(target); err == nil {
+			files[target] = *obj
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		obj, err := a.makeDelta(suite, dir, from, to)
+		if err != nil {
+			return err
+		}
+		if obj == nil {
+			continue
+		}
+		files[target] = *obj
+		a.info("delta written", "suite", suite.Name, "path", target, "object", obj.ID)
+	}
+	return nil
+}
+
+// Copy the pool files of `from` and `to` out of the Store, and commit a
+// delta between them. If either pool file is gone, or the Suite's DeltaFunc
+// fails, nil is returned, and no delta is published.
+func (a Archive) makeDelta(suite Suite, dir string, from, to Package) (*Object, error) {
+	fromPath := filepath.Join(dir, "from.deb")
+	toPath := filepath.Join(dir, "to.deb")
+	for target, localPath := range map[string]string{from.Filename: fromPath, to.Filename: toPath} {
+		fd, err := a.OpenPath(target)
+		if os.IsNotExist(err) {
+			a.debug("no pool file to make a delta with", "path", target)
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		err = writeLocalFile(localPath, fd)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	handle, err := a.Store.Create()
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	if err := suite.features.Deltas(fromPath, toPath, handle); err != nil {
+		a.warn("delta not made", "package", to.Package,
+			"from", from.Version.String(), "to", to.Version.String(), "error", err)
+		return nil, nil
+	}
+	return a.Store.Commit(handle)
+}
+
+func writeLocalFile(localPath string, in io.Reader) error {
+	fd, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fd, in); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/dependency"
+)
+
+// DEP-11 {{{
+
+// Set the DEP-11 (AppStream) Components YAML for an architecture of the
+// Component, replacing any set before. This will be published, gzip
+// compressed, as "dists/<suite>/<component>/dep11/Components-<arch>.yml.gz"
+// when the Suite is Engrossed, so that software centers (such as GNOME
+// Software or KDE Discover) can find the software in the Archive.
+//
+// `data` is the uncompressed YAML, including the header document, as
+// generated by a tool such as appstream-generator.
+func (c *Component) SetDEP11Components(arch dependency.Arch, data io.Reader) error {
+	return c.setDEP11(fmt.Sprintf("Components-%s.yml", arch.String()), data)
+}
+
+// Set the DEP-11 icon tarball for a given icon size (such as "64x64" or
+// "64x64@2"), replacing any set before. This will be published, gzip
+// compressed, as "dists/<suite>/<component>/dep11/icons-<size>.tar.gz".
+//
+// `data` is the uncompressed tarball of icons, as referenced by the
+// Components YAML.
+func (c *Component) SetDEP11Icons(size string, data io.Reader) error {
+	if size == "" || strings.ContainsAny(size, "/ ") {
+		return fmt.Errorf("Invalid icon size: '%s'", size)
+	}
+	return c.setDEP11(fmt.Sprintf("icons-%s.tar", size), data)
+}
+
+func (c *Component) setDEP11(name string, data io.Reader) error {
+	buf := bytes.Buffer{}
+	if _, err := io.Copy(&buf, data); err != nil {
+		return err
+	}
+	c.dep11[name] = buf.Bytes()
+	return nil
+}
+
+// Write out all of the Component's DEP-11 files, gzip compressed, and
+// register them in the ArchiveState and Release.
+func (a Archive) commitDEP11(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	component *Component,
+) error {
+	names := []string{}
+	for name := range component.dep11 {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		compressed := bytes.Buffer{}
+		/* No name or time in the header, to keep the output reproducible */
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(component.dep11[name]); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+
+		suitePath := path.Join(component.name, "dep11", name+".gz")
+		if err := a.commitFile(suite, release, files, suitePath, &compressed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,216 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/version"
+)
+
+// Diff {{{
+
+// PackageChange is a single package that differs between two indices. For
+// added packages, Old will be empty, and for removed packages, New will be
+// empty.
+type PackageChange struct {
+	Name string
+	Old  version.Version
+	New  version.Version
+}
+
+// IndexDiff is the set of changes between the same index (by Component
+// and Architecture) in two published Suites. Architecture is "source" for
+// the Sources index.
+type IndexDiff struct {
+	Component    string
+	Architecture string
+
+	Added      []PackageChange
+	Removed    []PackageChange
+	Upgraded   []PackageChange
+	Downgraded []PackageChange
+}
+
+// Check to see if there were any changes at all.
+func (d IndexDiff) Empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Upgraded)+len(d.Downgraded) == 0
+}
+
+// Compare two published Suites, and return the packages added, removed,
+// upgraded or downgraded going from `from` to `to`, for each index in
+// either Suite. Indices with no changes are omitted.
+//
+// `from` and `to` are the names of directories under dists/, so a
+// Snapshot may be compared by using "<suite>@<snapshot>".
+func (a Archive) Diff(from, to string) ([]IndexDiff, error) {
+	fromIndices, err := a.loadVersions(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toIndices, err := a.loadVersions(to)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for key := range fromIndices {
+		keys[key] = true
+	}
+	for key := range toIndices {
+		keys[key] = true
+	}
+
+	sortedKeys := []string{}
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	ret := []IndexDiff{}
+	for _, key := range sortedKeys {
+		i := strings.LastIndex(key, "/")
+		diff := diffVersions(fromIndices[key], toIndices[key])
+		diff.Component = key[:i]
+		diff.Architecture = key[i+1:]
+		if !diff.Empty() {
+			ret = append(ret, diff)
+		}
+	}
+	return ret, nil
+}
+
+func diffVersions(from, to map[string]version.Version) IndexDiff {
+	ret := IndexDiff{}
+
+	for name, newVersion := range to {
+		oldVersion, ok := from[name]
+		if !ok {
+			ret.Added = append(ret.Added, PackageChange{Name: name, New: newVersion})
+			continue
+		}
+
+		change := PackageChange{Name: name, Old: oldVersion, New: newVersion}
+		switch cmp := version.Compare(oldVersion, newVersion); {
+		case cmp < 0:
+			ret.Upgraded = append(ret.Upgraded, change)
+		case cmp > 0:
+			ret.Downgraded = append(ret.Downgraded, change)
+		}
+	}
+
+	for name, oldVersion := range from {
+		if _, ok := to[name]; !ok {
+			ret.Removed = append(ret.Removed, PackageChange{Name: name, Old: oldVersion})
+		}
+	}
+
+	for _, changes := range [][]PackageChange{
+		ret.Added, ret.Removed, ret.Upgraded, ret.Downgraded,
+	} {
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].Name < changes[j].Name
+		})
+	}
+
+	return ret
+}
+
+// Read every Packages and Sources index published under dists/<dist>/, and
+// return the newest version of each package, keyed by "<component>/<arch>".
+func (a Archive) loadVersions(dist string) (map[string]map[string]version.Version, error) {
+	root := path.Join("dists", dist)
+	targets, err := a.Store.List(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("Nothing is published in %s", root)
+	}
+
+	ret := map[string]map[string]version.Version{}
+	for _, target := range targets {
+		relDir := strings.TrimPrefix(path.Dir(target), root+"/")
+		component := path.Dir(relDir)
+		indexDir := path.Base(relDir)
+
+		/* Any compression of an index will do, since they're all the same */
+		switch index := stripCompression(path.Base(target)); {
+		case index == "Packages" && strings.HasPrefix(indexDir, "binary-"):
+			versions, err := a.loadPackagesVersions(target)
+			if err != nil {
+				return nil, err
+			}
+			ret[component+"/"+strings.TrimPrefix(indexDir, "binary-")] = versions
+		case index == "Sources" && indexDir == "source":
+			versions, err := a.loadSourcesVersions(target)
+			if err != nil {
+				return nil, err
+			}
+			ret[component+"/source"] = versions
+		}
+	}
+
+	return ret, nil
+}
+
+func (a Archive) loadPackagesVersions(target string) (map[string]version.Version, error) {
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	packages, err := LoadPackages(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]version.Version{}
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if current, ok := ret[pkg.Package]; !ok || version.Compare(pkg.Version, current) > 0 {
+			ret[pkg.Package] = pkg.Version
+		}
+	}
+}
+
+func (a Archive) loadSourcesVersions(target string) (map[string]version.Version, error) {
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	sources, err := LoadSources(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]version.Version{}
+	for {
+		src, err := sources.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if current, ok := ret[src.Package]; !ok || version.Compare(src.Version, current) > 0 {
+			ret[src.Package] = src.Version
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
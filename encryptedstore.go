@@ -0,0 +1,417 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// EncryptedStore {{{
+
+// KeyFunc gets the 32 byte AES-256 key with the given ID; from a config
+// file, or by asking a KMS to unwrap it. It's called at most once per key
+// ID by an EncryptedStore.
+type KeyFunc func(keyID string) ([]byte, error)
+
+// Get a KeyFunc for a single key, under any ID.
+func StaticKey(key []byte) KeyFunc {
+	return func(string) ([]byte, error) {
+		return key, nil
+	}
+}
+
+// EncryptedStore is a Store wrapping another Store, keeping every blob
+// encrypted in it with AES-256-GCM, so that an Archive (such as a staging
+// Archive with embargoed packages in it) can be kept on shared storage.
+// Open decrypts blobs, and Stat gives their plaintext size.
+//
+// Encryption is deterministic (each blob's key is derived from the key
+// and the blob itself), so the same blob committed twice is only stored
+// once; but anyone who can read the wrapped Store can tell when two blobs
+// are the same.
+type EncryptedStore struct {
+	Store
+
+	keyID string
+	keys  *encryptionKeys
+}
+
+// The keys an EncryptedStore (and every copy of it) has fetched so far.
+type encryptionKeys struct {
+	lock  sync.Mutex
+	fetch KeyFunc
+	keys  map[string][]byte
+}
+
+// Create an EncryptedStore, encrypting new blobs in `store` with the key
+// named `keyID`, fetched with `keys`. Blobs encrypted with other keys (say,
+// before the key was rotated) can still be read, so long as `keys` can
+// still get them.
+func NewEncryptedStore(store Store, keyID string, keys KeyFunc) (*EncryptedStore, error) {
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("Key ID is too long: '%s'", keyID)
+	}
+	s := EncryptedStore{
+		Store: store,
+		keyID: keyID,
+		keys:  &encryptionKeys{fetch: keys, keys: map[string][]byte{}},
+	}
+	/* Find out about a bad key now, not on the first Commit */
+	if _, err := s.key(keyID); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s EncryptedStore) key(keyID string) ([]byte, error) {
+	s.keys.lock.Lock()
+	defer s.keys.lock.Unlock()
+
+	if key, ok := s.keys.keys[keyID]; ok {
+		return key, nil
+	}
+	key, err := s.keys.fetch(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Key '%s' is %d bytes, not 32", keyID, len(key))
+	}
+	s.keys.keys[keyID] = key
+	return key, nil
+}
+
+// Get a copy of the EncryptedStore which makes every operation on the
+// wrapped Store with `ctx`, if it supports it.
+func (s EncryptedStore) WithContext(ctx context.Context) Store {
+	s.Store = storeWithContext(s.Store, ctx)
+	return &s
+}
+
+// Every encrypted blob starts with this, then the key ID (prefixed with
+// its length, as a single byte), the 32 byte salt the blob's own key is
+// derived from, and the size of the blob before it was encrypted, as a
+// big-endian uint64. The rest is the blob, in encryptedChunkSize chunks,
+// each sealed on its own.
+var encryptedMagic = []byte("\x89ARCHEN\n")
+
+const encryptedChunkSize = 64 * 1024
+
+// Blobs are written to a temporary file until they're committed, since
+// the key they're encrypted with depends on all of their contents. The
+// temporary file is itself encrypted, chunk by chunk, with a random key
+// that's only ever kept in memory, so nothing is written out in the clear,
+// even if the process dies before the temporary file is removed.
+type encryptedWriter struct {
+	fd       *os.File
+	stage    cipher.AEAD
+	mac      hash.Hash
+	key      []byte
+	size     int64
+	index    uint64
+	buf      []byte
+	closed   bool
+	finished bool
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	if w.finished {
+		return 0, fmt.Errorf("Write to a committed Writer")
+	}
+	w.buf = append(w.buf, p...)
+	w.mac.Write(p)
+	w.size += int64(len(p))
+
+	/* The last chunk is sealed differently, so always hold one back until
+	 * it's known if there's any more to come */
+	for len(w.buf) > encryptedChunkSize {
+		if err := w.sealChunk(w.buf[:encryptedChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[encryptedChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Seal the next chunk of the blob with the staging key, and write it out
+// to the temporary file.
+func (w *encryptedWriter) sealChunk(chunk []byte, last bool) error {
+	_, err := w.fd.Write(w.stage.Seal(nil, chunkNonce(w.index, last), chunk, nil))
+	w.index++
+	return err
+}
+
+func (w *encryptedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.fd.Close()
+	os.Remove(w.fd.Name())
+	return err
+}
+
+func (s EncryptedStore) Create() (Writer, error) {
+	key, err := s.key(s.keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	stageKey := make([]byte, 32)
+	if _, err := rand.Read(stageKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(stageKey)
+	if err != nil {
+		return nil, err
+	}
+	stage, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.CreateTemp("", "archive-blob-")
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedWriter{
+		fd:    fd,
+		stage: stage,
+		mac:   hmac.New(sha256.New, key),
+		key:   key,
+		buf:   make([]byte, 0, 2*encryptedChunkSize),
+	}, nil
+}
+
+// Get the AEAD a single blob is sealed with, from the key and the blob's
+// salt.
+func blobAEAD(key []byte, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("blob key"))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Get the nonce for the `index`th chunk of a blob. Since every blob has
+// its own key, the chunk's index is enough; the last chunk is marked, so
+// that a blob that's been cut short can't be mistaken for a whole one.
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (s EncryptedStore) Commit(writer Writer) (*Object, error) {
+	w, ok := writer.(*encryptedWriter)
+	if !ok {
+		return nil, fmt.Errorf("Writer was not created by an EncryptedStore")
+	}
+	defer w.Close()
+
+	w.finished = true
+	if err := w.sealChunk(w.buf, true); err != nil {
+		return nil, err
+	}
+	w.buf = nil
+
+	salt := w.mac.Sum(nil)
+	aead, err := blobAEAD(w.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	staged := &encryptedReader{
+		fd:        w.fd,
+		reader:    bufio.NewReader(w.fd),
+		aead:      w.stage,
+		remaining: w.size,
+		sealed:    make([]byte, encryptedChunkSize+w.stage.Overhead()),
+	}
+
+	inner, err := s.Store.Create()
+	if err != nil {
+		return nil, err
+	}
+	defer inner.Close()
+
+	header := bytes.Buffer{}
+	header.Write(encryptedMagic)
+	header.WriteByte(byte(len(s.keyID)))
+	header.WriteString(s.keyID)
+	header.Write(salt)
+	binary.Write(&header, binary.BigEndian, uint64(w.size))
+	if _, err := inner.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	chunk := make([]byte, encryptedChunkSize)
+	remaining := w.size
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(staged, chunk[:min(remaining, encryptedChunkSize)])
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		remaining -= int64(n)
+		last := remaining == 0
+		if _, err := inner.Write(aead.Seal(nil, chunkNonce(index, last), chunk[:n], nil)); err != nil {
+			return nil, err
+		}
+		if last {
+			break
+		}
+	}
+	return s.Store.Commit(inner)
+}
+
+// The header of an encrypted blob.
+type encryptedHeader struct {
+	keyID string
+	salt  []byte
+	size  int64
+}
+
+func readEncryptedHeader(reader *bufio.Reader) (*encryptedHeader, error) {
+	magic := make([]byte, len(encryptedMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, encryptedMagic) {
+		return nil, fmt.Errorf("Blob is not encrypted")
+	}
+	keyLen, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	keyID := make([]byte, keyLen)
+	if _, err := io.ReadFull(reader, keyID); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(reader, salt); err != nil {
+		return nil, err
+	}
+	var size uint64
+	if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	return &encryptedHeader{keyID: string(keyID), salt: salt, size: int64(size)}, nil
+}
+
+// Decrypts a blob chunk by chunk, as it's read.
+type encryptedReader struct {
+	fd        io.ReadCloser
+	reader    *bufio.Reader
+	aead      cipher.AEAD
+	index     uint64
+	remaining int64
+	buf       []byte
+	sealed    []byte
+	done      bool
+}
+
+func (r *encryptedReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		size := min(r.remaining, encryptedChunkSize)
+		sealed := r.sealed[:size+int64(r.aead.Overhead())]
+		if _, err := io.ReadFull(r.reader, sealed); err != nil {
+			return 0, fmt.Errorf("Encrypted blob is truncated: %s", err)
+		}
+		r.remaining -= size
+		last := r.remaining == 0
+		plain, err := r.aead.Open(sealed[:0], chunkNonce(r.index, last), sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("Can't decrypt blob: %s", err)
+		}
+		r.index++
+		r.buf = plain
+		r.done = last
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *encryptedReader) Close() error {
+	return r.fd.Close()
+}
+
+func (s EncryptedStore) Open(obj Object) (io.ReadCloser, error) {
+	fd, err := s.Store.Open(obj)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(fd)
+
+	header, err := readEncryptedHeader(reader)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("%s: %s", obj.ID, err)
+	}
+	key, err := s.key(header.keyID)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	aead, err := blobAEAD(key, header.salt)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &encryptedReader{
+		fd:        fd,
+		reader:    reader,
+		aead:      aead,
+		remaining: header.size,
+		sealed:    make([]byte, encryptedChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// Check the encrypted blob against its Object ID, in the wrapped Store.
+func (s EncryptedStore) Verify(obj Object) error {
+	return verifyObject(s.Store, obj)
+}
+
+// Get the size of the blob as it was written, and when it was committed.
+func (s EncryptedStore) Stat(obj Object) (*ObjectInfo, error) {
+	info, err := s.Store.Stat(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := s.Store.Open(obj)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	header, err := readEncryptedHeader(bufio.NewReader(fd))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", obj.ID, err)
+	}
+	info.Size = header.size
+	return info, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// EncryptedStore {{{
+
+func newTestEncryptedStore(t *testing.T) (*EncryptedStore, *MemoryStore) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	inner := NewMemoryStore()
+	store, err := NewEncryptedStore(inner, "test", StaticKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, inner
+}
+
+func readBlob(store Store, obj Object) ([]byte, error) {
+	fd, err := store.Open(obj)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return io.ReadAll(fd)
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	store, inner := newTestEncryptedStore(t)
+
+	/* Either side of the chunk size, to catch the last chunk going astray */
+	for _, size := range []int{0, 10, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 7} {
+		data := bytes.Repeat([]byte("plaintext "), size/10+1)[:size]
+		obj := commitBlob(t, store, data)
+
+		got, err := readBlob(store, obj)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: read back %d different bytes", size, len(got))
+		}
+
+		info, err := store.Stat(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(size) {
+			t.Errorf("%d bytes: Stat gave a size of %d", size, info.Size)
+		}
+
+		sealed, err := readBlob(inner, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && bytes.Contains(sealed, []byte("plaintext")) {
+			t.Errorf("%d bytes: plaintext found in the wrapped Store", size)
+		}
+	}
+}
+
+func TestEncryptedStoreTamper(t *testing.T) {
+	store, inner := newTestEncryptedStore(t)
+	obj := commitBlob(t, store, bytes.Repeat([]byte("secret "), 1000))
+
+	inner.lock.Lock()
+	blob := inner.blobs[obj.ID]
+	blob.data[len(blob.data)-1] ^= 0x01
+	inner.lock.Unlock()
+
+	if _, err := readBlob(store, obj); err == nil {
+		t.Errorf("Tampered blob was read back without an error")
+	}
+	if err := store.Verify(obj); err == nil {
+		t.Errorf("Tampered blob was verified")
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
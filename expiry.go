@@ -0,0 +1,160 @@
+package archive
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Expiry {{{
+
+// KeyExpiry is when one of the Archive's signing keys (or one of its
+// signing subkeys) expires.
+type KeyExpiry struct {
+	Fingerprint string
+	Subkey      bool
+	Created     time.Time
+
+	// When the key expires, or the zero Time if it never does.
+	Expires time.Time
+}
+
+// ReleaseExpiry is when a published Release file's Valid-Until lapses.
+type ReleaseExpiry struct {
+	Path string
+
+	// When the Release stops being valid, or the zero Time if it has no
+	// Valid-Until.
+	ValidUntil time.Time
+}
+
+// ExpiryReport is everything that will stop an Archive from validating
+// once it's expired.
+type ExpiryReport struct {
+	Keys     []KeyExpiry
+	Releases []ReleaseExpiry
+}
+
+// Get the earliest time anything in the ExpiryReport expires, or the zero
+// Time if nothing ever does.
+func (r ExpiryReport) First() time.Time {
+	ret := time.Time{}
+	check := func(when time.Time) {
+		if !when.IsZero() && (ret.IsZero() || when.Before(ret)) {
+			ret = when
+		}
+	}
+	for _, key := range r.Keys {
+		check(key.Expires)
+	}
+	for _, release := range r.Releases {
+		check(release.ValidUntil)
+	}
+	return ret
+}
+
+// Check if anything in the ExpiryReport expires before `when`, such as
+// `time.Now().Add(7 * 24 * time.Hour)`, to be alerted a week ahead.
+func (r ExpiryReport) ExpiresBefore(when time.Time) bool {
+	first := r.First()
+	return !first.IsZero() && first.Before(when)
+}
+
+// Find when the Archive's signing keys (and their signing subkeys) expire,
+// and when every published Release file (of any Suite or Snapshot) stops
+// being valid, so that they can be renewed or Resigned in time.
+func (a Archive) Expiry() (*ExpiryReport, error) {
+	ret := ExpiryReport{
+		Keys:     []KeyExpiry{},
+		Releases: []ReleaseExpiry{},
+	}
+
+	for _, key := range a.SigningKeys() {
+		ret.Keys = append(ret.Keys, keyExpiry(key)...)
+	}
+
+	targets, err := a.Store.List("dists")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		if !isSuiteRelease(target) {
+			continue
+		}
+
+		fd, err := a.OpenPath(target)
+		if err != nil {
+			return nil, err
+		}
+		release, err := LoadInRelease(fd, nil)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		expiry := ReleaseExpiry{Path: target}
+		if release.ValidUntil != "" {
+			expiry.ValidUntil, err = parseReleaseTime(release.ValidUntil)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", target, err)
+			}
+		}
+		ret.Releases = append(ret.Releases, expiry)
+	}
+
+	return &ret, nil
+}
+
+// Get when an Entity's primary key expires, along with each of its
+// subkeys that can sign.
+func keyExpiry(entity *openpgp.Entity) []KeyExpiry {
+	primary := KeyExpiry{
+		Fingerprint: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint),
+		Created:     entity.PrimaryKey.CreationTime,
+	}
+	if sig, _ := entity.PrimarySelfSignature(); sig != nil {
+		primary.Expires = lifetimeExpiry(entity.PrimaryKey.CreationTime, sig.KeyLifetimeSecs)
+	}
+
+	ret := []KeyExpiry{primary}
+	for _, subkey := range entity.Subkeys {
+		if subkey.Sig == nil || !subkey.Sig.FlagsValid || !subkey.Sig.FlagSign {
+			continue
+		}
+		ret = append(ret, KeyExpiry{
+			Fingerprint: fmt.Sprintf("%X", subkey.PublicKey.Fingerprint),
+			Subkey:      true,
+			Created:     subkey.PublicKey.CreationTime,
+			Expires:     lifetimeExpiry(subkey.PublicKey.CreationTime, subkey.Sig.KeyLifetimeSecs),
+		})
+	}
+	return ret
+}
+
+func lifetimeExpiry(created time.Time, lifetime *uint32) time.Time {
+	if lifetime == nil || *lifetime == 0 {
+		return time.Time{}
+	}
+	return created.Add(time.Duration(*lifetime) * time.Second)
+}
+
+// Parse a Date or Valid-Until from a Release file. These are meant to be
+// RFC 1123 dates with a numeric zone, but plenty of archives use "UTC".
+func parseReleaseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123} {
+		if when, err := time.Parse(layout, value); err == nil {
+			return when, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Malformed date: '%s'", value)
+}
+
+// }}}
+
+// vim: foldmethod=marker
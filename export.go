@@ -0,0 +1,152 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Export {{{
+
+// Get every path a published Suite (or Snapshot) needs to be used on its
+// own; its Release files, every index the Release lists, and every pool
+// file those indices list, sorted.
+func (a Archive) exportPaths(suite string) ([]string, error) {
+	suiteRoot := path.Join("dists", suite)
+	targets, err := a.Store.List(suiteRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	published := map[string]bool{}
+	for _, target := range targets {
+		published[target] = true
+	}
+
+	releasePath := path.Join(suiteRoot, "Release")
+	if !published[releasePath] {
+		return nil, fmt.Errorf("Suite %s isn't published", suite)
+	}
+
+	references := map[string]bool{}
+	if err := a.addReleaseReferences(releasePath, published, references); err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for target := range references {
+		/* Only the pool paths haven't been checked for already */
+		if !published[target] {
+			if _, err := a.Store.Lookup(target); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		ret = append(ret, target)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Write a published Suite (or Snapshot, such as "unstable@2024-01-01") to
+// `out` as a tarball, containing its dists/ tree and exactly the pool files
+// it references; a self-contained repository that can be unpacked and used
+// offline (such as with a "file:" apt source) on an air-gapped machine.
+//
+// Every file in the tarball is given the Archive's PublishTime, so that
+// exporting the same Suite twice gives the same bytes.
+func (a Archive) ExportSuite(suite string, out io.Writer) error {
+	targets, err := a.exportPaths(suite)
+	if err != nil {
+		return err
+	}
+
+	when, err := a.PublishTime()
+	if err != nil {
+		return err
+	}
+
+	writer := tar.NewWriter(out)
+	for _, target := range targets {
+		obj, err := a.Store.Lookup(target)
+		if err != nil {
+			return err
+		}
+		info, err := a.Store.Stat(*obj)
+		if err != nil {
+			return err
+		}
+
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     target,
+			Mode:     0644,
+			Size:     info.Size,
+			ModTime:  when,
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+
+		fd, err := a.Store.Open(*obj)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, fd)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	a.info("suite exported", "suite", suite, "files", len(targets))
+	return writer.Close()
+}
+
+// Export a published Suite (or Snapshot), just like ExportSuite, but into
+// the directory at `dir` rather than a tarball. The directory is created
+// if it doesn't exist, and any files already in it are overwritten.
+func (a Archive) ExportSuiteDir(suite string, dir string) error {
+	targets, err := a.exportPaths(suite)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		if err := a.exportFile(target, filepath.Join(dir, filepath.FromSlash(target))); err != nil {
+			return err
+		}
+	}
+	a.info("suite exported", "suite", suite, "files", len(targets), "path", dir)
+	return nil
+}
+
+func (a Archive) exportFile(target string, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, fd); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,121 @@
+package archive
+
+import (
+	"iter"
+	"path"
+	"strings"
+
+	"pault.ag/go/debian/dependency"
+)
+
+// Filters {{{
+
+// PackageFilter decides if a Package entry should be kept while scanning
+// a Packages list. Any func(*Package) bool can be used as a PackageFilter.
+type PackageFilter func(*Package) bool
+
+// Keep Package entries built for any of the given Architectures. Entries
+// for "all" are only kept if "all" is given.
+func ByArchitecture(arches ...dependency.Arch) PackageFilter {
+	return func(pkg *Package) bool {
+		for _, arch := range arches {
+			if pkg.Architecture.Is(&arch) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Keep Package entries in any of the given Sections. A Section given
+// without a component (such as "net") also matches entries with one (such
+// as "contrib/net").
+func BySection(sections ...string) PackageFilter {
+	return func(pkg *Package) bool {
+		for _, section := range sections {
+			if pkg.Section == section {
+				return true
+			}
+			if !strings.Contains(section, "/") && path.Base(pkg.Section) == section {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Keep Package entries whose name matches the glob, using the same syntax
+// as path.Match (such as "lib*-dev"). A malformed glob matches nothing.
+func ByName(glob string) PackageFilter {
+	return func(pkg *Package) bool {
+		matched, err := path.Match(glob, pkg.Package)
+		return err == nil && matched
+	}
+}
+
+// Keep Package entries that the filter doesn't keep.
+func Not(filter PackageFilter) PackageFilter {
+	return func(pkg *Package) bool {
+		return !filter(pkg)
+	}
+}
+
+// Keep Package entries that any of the filters keep.
+func AnyOf(filters ...PackageFilter) PackageFilter {
+	return func(pkg *Package) bool {
+		for _, filter := range filters {
+			if filter(pkg) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Keep Package entries that every one of the filters keeps.
+func AllOf(filters ...PackageFilter) PackageFilter {
+	return func(pkg *Package) bool {
+		for _, filter := range filters {
+			if !filter(pkg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// }}}
+
+// Filter {{{
+
+// Get an iterator over the rest of the Package entries in the Packages
+// list that every one of the filters keeps, just like All. Entries are
+// filtered as they're read, so nothing else is held on to.
+//
+//	for pkg, err := range packages.Filter(
+//		archive.ByArchitecture(amd64),
+//		archive.ByName("lib*-dev"),
+//	) {
+//		...
+//	}
+func (p *Packages) Filter(filters ...PackageFilter) iter.Seq2[*Package, error] {
+	keep := AllOf(filters...)
+	return func(yield func(*Package, error) bool) {
+		for pkg, err := range p.All() {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !keep(pkg) {
+				continue
+			}
+			if !yield(pkg, nil) {
+				return
+			}
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
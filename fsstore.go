@@ -0,0 +1,417 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FilesystemStore {{{
+
+// FilesystemStore is a Store kept on the local filesystem. Blobs live in
+// the ".blobs" directory under the root, named by their ID, and are
+// published by hardlinking them to their paths under the root (or however
+// SetLinkStrategy says), so that the root can be served as-is by any web
+// server.
+type FilesystemStore struct {
+	root     string
+	strategy LinkStrategy
+}
+
+// LinkStrategy is how a FilesystemStore publishes a blob at a path.
+type LinkStrategy int
+
+const (
+	// Hardlink the blob to the path. This takes no extra space, and is
+	// the default.
+	LinkHardlink LinkStrategy = iota
+
+	// Symlink the path to the blob, with a relative symlink, so the root
+	// can be moved. The web server must be willing to follow symlinks
+	// into the hidden ".blobs" directory.
+	LinkSymlink
+
+	// Copy the blob to the path. This takes twice the space, and makes
+	// GC slower (since every copy has to be hashed to find its blob), but
+	// works anywhere, such as on an NFS export, or as an rsync source for
+	// object storage.
+	LinkCopy
+)
+
+func (l LinkStrategy) String() string {
+	switch l {
+	case LinkHardlink:
+		return "hardlink"
+	case LinkSymlink:
+		return "symlink"
+	case LinkCopy:
+		return "copy"
+	}
+	return fmt.Sprintf("LinkStrategy(%d)", int(l))
+}
+
+// Create a new FilesystemStore at `root`, creating the directory if it
+// doesn't already exist.
+func NewFilesystemStore(root string) (*FilesystemStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	store := FilesystemStore{root: root}
+	if err := os.MkdirAll(store.tempPath(), 0755); err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
+
+func (s FilesystemStore) Root() string {
+	return s.root
+}
+
+// Set how blobs are published from now on. Paths that are already
+// published are left as they are until they're next linked; every
+// strategy can be read back (and GC'd) no matter how a path was linked.
+func (s *FilesystemStore) SetLinkStrategy(strategy LinkStrategy) error {
+	switch strategy {
+	case LinkHardlink, LinkSymlink, LinkCopy:
+	default:
+		return fmt.Errorf("Unknown link strategy: %s", strategy)
+	}
+	s.strategy = strategy
+	return nil
+}
+
+func (s FilesystemStore) blobsPath() string {
+	return filepath.Join(s.root, ".blobs")
+}
+
+func (s FilesystemStore) tempPath() string {
+	return filepath.Join(s.blobsPath(), "tmp")
+}
+
+func (s FilesystemStore) objectPath(obj Object) string {
+	return filepath.Join(s.blobsPath(), obj.ID)
+}
+
+func (s FilesystemStore) targetPath(target string) string {
+	return filepath.Join(s.root, filepath.FromSlash(target))
+}
+
+type filesystemWriter struct {
+	fd        *os.File
+	hash      hash.Hash
+	committed bool
+	closed    bool
+}
+
+func (w *filesystemWriter) Write(p []byte) (int, error) {
+	n, err := w.fd.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// Close the Writer. If it was never committed, the data is thrown away.
+func (w *filesystemWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.fd.Close()
+	if !w.committed {
+		os.Remove(w.fd.Name())
+	}
+	return err
+}
+
+func (s FilesystemStore) Create() (Writer, error) {
+	fd, err := os.CreateTemp(s.tempPath(), "blob-")
+	if err != nil {
+		return nil, err
+	}
+	return &filesystemWriter{fd: fd, hash: sha256.New()}, nil
+}
+
+func (s FilesystemStore) Commit(writer Writer) (*Object, error) {
+	w, ok := writer.(*filesystemWriter)
+	if !ok {
+		return nil, fmt.Errorf("Writer was not created by a FilesystemStore")
+	}
+
+	obj := Object{ID: fmt.Sprintf("%x", w.hash.Sum(nil))}
+	tempPath := w.fd.Name()
+
+	w.committed = true
+	if err := w.Close(); err != nil {
+		os.Remove(tempPath)
+		return nil, err
+	}
+
+	/* Since we're content addressed, if we already have this blob, we
+	 * can just throw the new one away */
+	if _, err := os.Stat(s.objectPath(obj)); err == nil {
+		return &obj, os.Remove(tempPath)
+	}
+
+	if err := os.Chmod(tempPath, 0644); err != nil {
+		os.Remove(tempPath)
+		return nil, err
+	}
+
+	if err := os.Rename(tempPath, s.objectPath(obj)); err != nil {
+		os.Remove(tempPath)
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (s FilesystemStore) Open(obj Object) (io.ReadCloser, error) {
+	return os.Open(s.objectPath(obj))
+}
+
+// Link the blob to the target path, according to the LinkStrategy. The
+// link is created next to the target and renamed over it, so the swap is
+// atomic.
+func (s FilesystemStore) Link(obj Object, target string) error {
+	fsTarget := s.targetPath(target)
+	dir := filepath.Dir(fsTarget)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tempPath := filepath.Join(dir, fmt.Sprintf(".%s.%s", filepath.Base(fsTarget), obj.ID))
+	os.Remove(tempPath)
+
+	var err error
+	switch s.strategy {
+	case LinkSymlink:
+		var relPath string
+		relPath, err = filepath.Rel(dir, s.objectPath(obj))
+		if err == nil {
+			err = os.Symlink(relPath, tempPath)
+		}
+	case LinkCopy:
+		err = s.copyBlob(obj, tempPath)
+	default:
+		err = os.Link(s.objectPath(obj), tempPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Rename(tempPath, fsTarget); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func (s FilesystemStore) copyBlob(obj Object, dest string) error {
+	in, err := os.Open(s.objectPath(obj))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (s FilesystemStore) Unlink(target string) error {
+	return os.Remove(s.targetPath(target))
+}
+
+// Find the Object linked to the target path, by hashing the file.
+func (s FilesystemStore) Lookup(target string) (*Object, error) {
+	fd, err := os.Open(s.targetPath(target))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fd); err != nil {
+		return nil, err
+	}
+
+	obj := Object{ID: fmt.Sprintf("%x", hash.Sum(nil))}
+	if _, err := os.Stat(s.objectPath(obj)); err != nil {
+		return nil, fmt.Errorf("%s is not linked to any blob", target)
+	}
+	return &obj, nil
+}
+
+// Open the file published at the target path directly, without hashing
+// it to find its blob, the way Lookup does.
+func (s FilesystemStore) OpenPath(target string) (io.ReadCloser, *ObjectInfo, error) {
+	fd, err := os.Open(s.targetPath(target))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		fd.Close()
+		return nil, nil, &os.PathError{Op: "open", Path: target, Err: os.ErrNotExist}
+	}
+	return fd, &ObjectInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Walk every published file under `prefix`, skipping any hidden file
+// or directory (such as the ".blobs" directory). Symlinks are followed,
+// and `fn` is given what they point to.
+func (s FilesystemStore) walk(prefix string, fn func(string, os.FileInfo) error) error {
+	err := filepath.Walk(s.targetPath(prefix), func(fsPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(info.Name(), ".") && fsPath != s.root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			info, err = os.Stat(fsPath)
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(s.root, fsPath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(relPath), info)
+	})
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s FilesystemStore) List(prefix string) ([]string, error) {
+	ret := []string{}
+	err := s.walk(prefix, func(target string, info os.FileInfo) error {
+		ret = append(ret, target)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s FilesystemStore) Stat(obj Object) (*ObjectInfo, error) {
+	info, err := os.Stat(s.objectPath(obj))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Object: obj, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Find every blob that isn't linked to any published path. Published
+// files that aren't the blob itself (copies, from LinkCopy) are hashed to
+// find out which blob they're a copy of.
+func (s FilesystemStore) Garbage() ([]Object, error) {
+	entries, err := os.ReadDir(s.blobsPath())
+	if err != nil {
+		return nil, err
+	}
+
+	/* Index the blobs by size, so we only need to compare each published
+	 * file against blobs it could possibly be linked to. */
+	blobs := map[int64][]os.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		blobs[info.Size()] = append(blobs[info.Size()], info)
+	}
+
+	linked := map[string]bool{}
+	err = s.walk("", func(target string, info os.FileInfo) error {
+		candidates := blobs[info.Size()]
+		for _, blob := range candidates {
+			if os.SameFile(blob, info) {
+				linked[blob.Name()] = true
+				return nil
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		obj, err := s.Lookup(target)
+		if err == nil {
+			linked[obj.ID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []Object{}
+	for _, candidates := range blobs {
+		for _, blob := range candidates {
+			if !linked[blob.Name()] {
+				ret = append(ret, Object{ID: blob.Name()})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Remove a single blob. Anything it's hardlinked to stays as it is.
+func (s FilesystemStore) Remove(obj Object) error {
+	return os.Remove(s.objectPath(obj))
+}
+
+// Remove every blob that isn't linked to any published path.
+func (s FilesystemStore) GC() error {
+	garbage, err := s.Garbage()
+	if err != nil {
+		return err
+	}
+	for _, obj := range garbage {
+		if err := s.Remove(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,587 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/deb"
+	"pault.ag/go/debian/dependency"
+)
+
+// apt-ftparchive {{{
+
+// FtpArchiveConfig is the subset of an apt-ftparchive "generate"
+// configuration file needed to drive an Archive, to ease migrating an
+// existing apt-ftparchive setup.
+//
+// Packages are indexed where they are (relative to ArchiveDir), just like
+// apt-ftparchive does, rather than being copied into the Pool, so the
+// Archive should be rooted at ArchiveDir.
+type FtpArchiveConfig struct {
+	ArchiveDir  string
+	OverrideDir string
+
+	Trees []FtpArchiveTree
+}
+
+// FtpArchiveTree is a "Tree" section of an apt-ftparchive configuration,
+// with any settings from "TreeDefault" already applied.
+type FtpArchiveTree struct {
+	// Name of the Tree, such as "dists/unstable".
+	Name string
+
+	Sections      []string
+	Architectures []string
+
+	// Directories to scan for .deb and .dsc files, relative to
+	// ArchiveDir. "$(DIST)", "$(SECTION)" and "$(ARCH)" are replaced as
+	// they are by apt-ftparchive.
+	Directory    string
+	SrcDirectory string
+
+	// Override files, relative to OverrideDir. "$(DIST)" and "$(SECTION)"
+	// are replaced as in Directory.
+	BinOverride string
+	SrcOverride string
+}
+
+// Get the name of the Suite the Tree is for, such as "unstable" for the
+// Tree "dists/unstable".
+func (t FtpArchiveTree) Suite() string {
+	return strings.TrimPrefix(path.Clean(t.Name), "dists/")
+}
+
+func (t FtpArchiveTree) substitute(value, section, arch string) string {
+	return strings.NewReplacer(
+		"$(DIST)", t.Name,
+		"$(SECTION)", section,
+		"$(ARCH)", arch,
+	).Replace(value)
+}
+
+// Load an apt-ftparchive configuration file from the filesystem.
+func LoadFtpArchiveConfigFile(path string) (*FtpArchiveConfig, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return LoadFtpArchiveConfig(fd)
+}
+
+// Load an apt-ftparchive configuration. Only the Dir, TreeDefault and
+// Tree sections are used; anything else (such as the Default or BinDirectory
+// sections) is ignored.
+func LoadFtpArchiveConfig(in io.Reader) (*FtpArchiveConfig, error) {
+	root, err := parseAptConfig(in)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := FtpArchiveConfig{
+		ArchiveDir:  root.get("Dir::ArchiveDir", "."),
+		OverrideDir: root.get("Dir::OverrideDir", "."),
+		Trees:       []FtpArchiveTree{},
+	}
+
+	defaults := root.child("TreeDefault")
+	for _, node := range root.children {
+		if node.key != "Tree" {
+			continue
+		}
+
+		get := func(key, fallback string) string {
+			return node.get(key, defaults.get(key, fallback))
+		}
+
+		tree := FtpArchiveTree{
+			Name:          node.value,
+			Sections:      strings.Fields(get("Sections", "")),
+			Architectures: strings.Fields(get("Architectures", "")),
+			Directory:     get("Directory", "$(DIST)/$(SECTION)/binary-$(ARCH)/"),
+			SrcDirectory:  get("SrcDirectory", "$(DIST)/$(SECTION)/source/"),
+			BinOverride:   get("BinOverride", ""),
+			SrcOverride:   get("SrcOverride", ""),
+		}
+
+		if tree.Name == "" {
+			return nil, fmt.Errorf("Tree without a name")
+		}
+		if len(tree.Sections) == 0 || len(tree.Architectures) == 0 {
+			return nil, fmt.Errorf("Tree %s needs both Sections and Architectures", tree.Name)
+		}
+		ret.Trees = append(ret.Trees, tree)
+	}
+
+	return &ret, nil
+}
+
+// Create a Suite in the Archive for each Tree in the configuration, with a
+// Component for each Section, containing every .deb and .dsc found in the
+// Tree's directories (with any overrides applied).
+func (c FtpArchiveConfig) Suites(a *Archive) ([]*Suite, error) {
+	ret := []*Suite{}
+	scanned := map[string][]string{}
+
+	for _, tree := range c.Trees {
+		suite, err := a.Suite(tree.Suite())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, section := range tree.Sections {
+			component, err := suite.Component(section)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.fillComponent(tree, section, component, scanned); err != nil {
+				return nil, err
+			}
+		}
+		ret = append(ret, suite)
+	}
+
+	return ret, nil
+}
+
+// Generate every Tree in the configuration, returning the combined
+// ArchiveState of every Suite, fit for passage to Link.
+func (c FtpArchiveConfig) Generate(a *Archive) (ArchiveState, error) {
+	suites, err := c.Suites(a)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := ArchiveState{}
+	for _, suite := range suites {
+		state, err := a.Engross(*suite)
+		if err != nil {
+			return nil, err
+		}
+		for target, obj := range state {
+			ret[target] = obj
+		}
+	}
+	return ret, nil
+}
+
+func (c FtpArchiveConfig) fillComponent(
+	tree FtpArchiveTree,
+	section string,
+	component *Component,
+	scanned map[string][]string,
+) error {
+	binOverrides := map[string]Override{}
+	if tree.BinOverride != "" {
+		overridePath := filepath.Join(c.OverrideDir, tree.substitute(tree.BinOverride, section, ""))
+		overrides, err := loadOverrides(overridePath, false)
+		if err != nil {
+			return err
+		}
+		binOverrides = overrides
+	}
+
+	srcOverrides := map[string]Override{}
+	if tree.SrcOverride != "" {
+		overridePath := filepath.Join(c.OverrideDir, tree.substitute(tree.SrcOverride, section, ""))
+		overrides, err := loadOverrides(overridePath, true)
+		if err != nil {
+			return err
+		}
+		srcOverrides = overrides
+	}
+
+	for _, arch := range tree.Architectures {
+		if arch == "source" {
+			dir := tree.substitute(tree.SrcDirectory, section, arch)
+			if err := c.addSources(component, dir, srcOverrides, scanned); err != nil {
+				return err
+			}
+			continue
+		}
+
+		dir := tree.substitute(tree.Directory, section, arch)
+		if err := c.addPackages(component, dir, arch, binOverrides, scanned); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get every file with the given extension under `dir` (relative to the
+// ArchiveDir), caching the result, since the same directory is often
+// scanned once per Architecture.
+func (c FtpArchiveConfig) scan(dir, ext string, scanned map[string][]string) ([]string, error) {
+	key := dir + " " + ext
+	if files, ok := scanned[key]; ok {
+		return files, nil
+	}
+
+	root := filepath.Join(c.ArchiveDir, filepath.FromSlash(dir))
+	files := []string{}
+	err := filepath.Walk(root, func(fsPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), ext) {
+			relPath, err := filepath.Rel(c.ArchiveDir, fsPath)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	scanned[key] = files
+	return files, nil
+}
+
+func (c FtpArchiveConfig) addPackages(
+	component *Component,
+	dir string,
+	arch string,
+	overrides map[string]Override,
+	scanned map[string][]string,
+) error {
+	indexArch, err := dependency.ParseArch(arch)
+	if err != nil {
+		return err
+	}
+
+	debs, err := c.scan(dir, ".deb", scanned)
+	if err != nil {
+		return err
+	}
+
+	for _, debPath := range debs {
+		pkg, err := c.loadPackage(debPath)
+		if err != nil {
+			return err
+		}
+
+		debArch := pkg.Architecture.String()
+		if debArch != arch && debArch != "all" {
+			continue
+		}
+
+		if override, ok := overrides[pkg.Package]; ok {
+			*pkg = override.apply(*pkg)
+		}
+
+		/* Like apt-ftparchive, Architecture: all packages go into every
+		 * Architecture's Packages */
+		if err := component.addPackageTo(*pkg, *indexArch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash the .deb in place, and create its Package entry, with the Filename
+// relative to the ArchiveDir.
+func (c FtpArchiveConfig) loadPackage(debPath string) (*Package, error) {
+	fsPath := filepath.Join(c.ArchiveDir, filepath.FromSlash(debPath))
+	debFile, closer, err := deb.LoadFile(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	fd, err := os.Open(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	writer, hashers, err := newHashers(poolHashes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(writer, fd); err != nil {
+		return nil, err
+	}
+
+	return packageFromHashers(*debFile, debPath, hashers)
+}
+
+func (c FtpArchiveConfig) addSources(
+	component *Component,
+	dir string,
+	overrides map[string]Override,
+	scanned map[string][]string,
+) error {
+	dscs, err := c.scan(dir, ".dsc", scanned)
+	if err != nil {
+		return err
+	}
+
+	for _, dscPath := range dscs {
+		fsPath := filepath.Join(c.ArchiveDir, filepath.FromSlash(dscPath))
+		dsc, err := control.ParseDscFile(fsPath)
+		if err != nil {
+			return err
+		}
+
+		src, err := SourceFromDsc(&dsc, path.Dir(dscPath))
+		if err != nil {
+			return err
+		}
+
+		/* The .dsc lists every file but itself */
+		for _, algorithm := range poolHashes {
+			hasher, err := newFileHash(fsPath, path.Base(dscPath), algorithm)
+			if err != nil {
+				return err
+			}
+			if err := src.addHash(*hasher); err != nil {
+				return err
+			}
+		}
+
+		if override, ok := overrides[src.Package]; ok && override.Section != "" {
+			src.Section = override.Section
+			src.Set("Section", override.Section)
+		}
+
+		if err := component.AddSource(*src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash the file at `fsPath` with `algorithm`, returning a FileHash with
+// the given Filename.
+func newFileHash(fsPath, filename, algorithm string) (*control.FileHash, error) {
+	fd, err := os.Open(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	writer, hashers, err := newHashers([]string{algorithm})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(writer, fd); err != nil {
+		return nil, err
+	}
+
+	hash := control.FileHashFromHasher(filename, *hashers[0])
+	return &hash, nil
+}
+
+// Load an apt-ftparchive override file, mapping each package name to its
+// Override. Lines of a binary override file are "package priority section",
+// and of a source override file, "package section"; anything after that
+// (such as a maintainer) is ignored.
+func loadOverrides(path string, source bool) (map[string]Override, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret := map[string]Override{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		override := Override{}
+		if source {
+			if len(fields) > 1 {
+				override.Section = fields[1]
+			}
+		} else {
+			if len(fields) > 1 {
+				override.Priority = fields[1]
+			}
+			if len(fields) > 2 {
+				override.Section = fields[2]
+			}
+		}
+		ret[fields[0]] = override
+	}
+	return ret, scanner.Err()
+}
+
+// }}}
+
+// Configuration Parser {{{
+
+// A node of an APT style configuration file, such as:
+//
+//	Dir { ArchiveDir "/srv/archive"; };
+//	Tree "dists/unstable" { Sections "main"; };
+type aptConfigNode struct {
+	key      string
+	value    string
+	children []*aptConfigNode
+}
+
+// Get the first child with the given key, or an empty node if there is
+// none.
+func (n *aptConfigNode) child(key string) *aptConfigNode {
+	for _, el := range n.children {
+		if el.key == key {
+			return el
+		}
+	}
+	return &aptConfigNode{}
+}
+
+// Get the value of a (possibly "::" separated) key, or `fallback` if the
+// key isn't set.
+func (n *aptConfigNode) get(key, fallback string) string {
+	node := n
+	for _, part := range strings.Split(key, "::") {
+		found := false
+		for _, el := range node.children {
+			if el.key == part {
+				node, found = el, true
+				break
+			}
+		}
+		if !found {
+			return fallback
+		}
+	}
+	return node.value
+}
+
+func parseAptConfig(in io.Reader) (*aptConfigNode, error) {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := tokenizeAptConfig(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	root := aptConfigNode{}
+	rest, err := parseAptConfigBlock(&root, tokens)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("Unexpected '%s' in configuration", rest[0])
+	}
+	return &root, nil
+}
+
+// Parse statements into `parent` until the end of the tokens, or a
+// closing brace, returning whatever is left.
+func parseAptConfigBlock(parent *aptConfigNode, tokens []string) ([]string, error) {
+	for len(tokens) > 0 {
+		switch tokens[0] {
+		case "}":
+			return tokens, nil
+		case ";":
+			tokens = tokens[1:]
+			continue
+		case "{":
+			return nil, fmt.Errorf("Unexpected '{' in configuration")
+		}
+
+		/* "Dir::ArchiveDir" is the same as "Dir { ArchiveDir" */
+		parts := strings.Split(tokens[0], "::")
+		tokens = tokens[1:]
+
+		node := parent
+		for _, part := range parts {
+			child := &aptConfigNode{key: part}
+			if existing := node.child(part); existing.key == part && part != "Tree" {
+				child = existing
+			} else {
+				node.children = append(node.children, child)
+			}
+			node = child
+		}
+
+		if len(tokens) > 0 && tokens[0] != ";" && tokens[0] != "{" && tokens[0] != "}" {
+			node.value = strings.Trim(tokens[0], "\"")
+			tokens = tokens[1:]
+		}
+
+		if len(tokens) > 0 && tokens[0] == "{" {
+			rest, err := parseAptConfigBlock(node, tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			if len(rest) == 0 {
+				return nil, fmt.Errorf("Missing '}' in configuration")
+			}
+			tokens = rest[1:]
+		}
+	}
+	return tokens, nil
+}
+
+// Split the configuration into words, quoted strings (kept quoted) and
+// punctuation, dropping any comments.
+func tokenizeAptConfig(data string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(data); {
+		switch ch := data[i]; {
+		case unicode.IsSpace(rune(ch)):
+			i++
+		case ch == '#' || strings.HasPrefix(data[i:], "//"):
+			end := strings.Index(data[i:], "\n")
+			if end == -1 {
+				return tokens, nil
+			}
+			i += end
+		case strings.HasPrefix(data[i:], "/*"):
+			end := strings.Index(data[i:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("Unterminated comment in configuration")
+			}
+			i += end + 2
+		case ch == '{' || ch == '}' || ch == ';':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '"':
+			end := strings.Index(data[i+1:], "\"")
+			if end == -1 {
+				return nil, fmt.Errorf("Unterminated string in configuration")
+			}
+			tokens = append(tokens, data[i:i+end+2])
+			i += end + 2
+		default:
+			end := strings.IndexFunc(data[i:], func(r rune) bool {
+				return unicode.IsSpace(r) || strings.ContainsRune("{};\"", r)
+			})
+			if end == -1 {
+				end = len(data) - i
+			}
+			tokens = append(tokens, data[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,49 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// apt-ftparchive {{{
+
+func TestLoadOverrides(t *testing.T) {
+	dir := t.TempDir()
+	binPath := filepath.Join(dir, "override.main")
+	srcPath := filepath.Join(dir, "override.main.src")
+	if err := os.WriteFile(binPath, []byte(
+		"# comment\nfoo optional net Some Maintainer\nbar important\n",
+	), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(srcPath, []byte("foo contrib/net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overrides, err := loadOverrides(binPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 2 {
+		t.Fatalf("Expected 2 binary overrides, got %d", len(overrides))
+	}
+	if o := overrides["foo"]; o.Priority != "optional" || o.Section != "net" {
+		t.Errorf("Unexpected override for foo: %+v", o)
+	}
+	if o := overrides["bar"]; o.Priority != "important" || o.Section != "" {
+		t.Errorf("Unexpected override for bar: %+v", o)
+	}
+
+	overrides, err = loadOverrides(srcPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := overrides["foo"]; o.Section != "contrib/net" || o.Priority != "" {
+		t.Errorf("Unexpected source override for foo: %+v", o)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
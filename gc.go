@@ -0,0 +1,280 @@
+package archive
+
+import (
+	"context"
+	"os"
+	"path"
+)
+
+// Reference GC {{{
+
+// Walk every Release file published under dists/ (including those of
+// Snapshots), and return the set of every path referenced by any of them;
+// the Release files themselves, every index they list, and every pool file
+// those indices list.
+func (a Archive) references() (map[string]bool, error) {
+	targets, err := a.Store.List("dists")
+	if err != nil {
+		return nil, err
+	}
+
+	published := map[string]bool{}
+	for _, target := range targets {
+		published[target] = true
+	}
+
+	ret := map[string]bool{}
+	for _, target := range targets {
+		if !isSuiteRelease(target) {
+			continue
+		}
+		if err := a.addReleaseReferences(target, published, ret); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// Add the Release file at `target`, its signatures, every index it lists
+// that's `published` (and its by-hash paths), and every pool file those
+// indices list, to the set of `references`.
+func (a Archive) addReleaseReferences(
+	target string,
+	published map[string]bool,
+	references map[string]bool,
+) error {
+	dir := path.Dir(target)
+	for _, name := range []string{"Release", "Release.gpg", "InRelease"} {
+		references[path.Join(dir, name)] = true
+	}
+
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return err
+	}
+	release, err := LoadInRelease(fd, nil)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+
+	for filename, fileHashes := range release.Indices() {
+		indexPath := path.Join(dir, filename)
+		/* Uncompressed indices are listed even if they're not present */
+		if !published[indexPath] {
+			continue
+		}
+		references[indexPath] = true
+		for _, fileHash := range fileHashes {
+			if hashPath, ok := byHashPath(filename, fileHash); ok {
+				references[path.Join(dir, hashPath)] = true
+			}
+		}
+
+		switch stripCompression(path.Base(indexPath)) {
+		case "Packages":
+			err = a.addPackagesReferences(indexPath, references)
+		case "Sources":
+			err = a.addSourcesReferences(indexPath, references)
+		case "Buildinfo":
+			err = a.addBuildinfoReferences(indexPath, references)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get every path published under dists/ or pool/ that isn't referenced by
+// any published Release file.
+func (a Archive) unreferenced() ([]string, error) {
+	references, err := a.references()
+	if err != nil {
+		return nil, err
+	}
+
+	/* .buildinfo files aren't in any index (unless there's a Buildinfo
+	 * index), but are kept as long as what they built is */
+	kept := buildinfoReferences(references)
+
+	ret := []string{}
+	for _, prefix := range []string{"dists", "pool"} {
+		targets, err := a.Store.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			if !references[target] && !kept(target) {
+				ret = append(ret, target)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Garbage collect the Archive by reference, rather than by link. Every
+// published Release file (of any Suite or Snapshot) is walked to find the
+// indices and pool files still in use, and anything else published under
+// dists/ or pool/ is unlinked before the Store's GC removes the blobs that
+// are no longer linked anywhere. This returns the paths that were
+// unlinked.
+//
+// Pool files that have been included but not yet published by Engross and
+// Link are not referenced by anything, and will be removed. This should
+// only be run while holding the Archive's Lock.
+func (a Archive) GCUnreferenced() ([]string, error) {
+	return a.GCUnreferencedContext(context.Background())
+}
+
+// GCUnreferenced, stopping once `ctx` is done. Anything unlinked before
+// then stays unlinked.
+func (a Archive) GCUnreferencedContext(ctx context.Context) ([]string, error) {
+	a = a.withContext(ctx)
+	targets, err := a.unreferenced()
+	if err != nil {
+		return nil, err
+	}
+	targets, err = a.gcDuePaths(targets, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	freed := []string{}
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
+		if a.gcGrace > 0 {
+			if obj, err := a.Store.Lookup(target); err == nil {
+				freed = append(freed, obj.ID)
+			}
+		}
+		err := a.Store.Unlink(target)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return ret, err
+		}
+		a.debug("unlinked", "path", target)
+		ret = append(ret, target)
+	}
+	a.info("unlinked unreferenced", "paths", len(ret))
+	if err := a.gcMarkFreed(freed); err != nil {
+		return ret, err
+	}
+
+	return ret, a.gc(ctx, ret)
+}
+
+// }}}
+
+// Dry Run {{{
+
+// Garbage is a blob that garbage collection would remove.
+type Garbage struct {
+	ObjectInfo
+
+	// Published paths that would be unlinked, leaving nothing else linked
+	// to this blob. This is empty if the blob isn't linked anywhere.
+	Paths []string
+}
+
+// Get every blob that GC would remove, without removing anything.
+func (a Archive) GCDryRun() ([]Garbage, error) {
+	garbage, err := a.garbage(nil)
+	if err != nil {
+		return nil, err
+	}
+	return a.gcDueGarbage(garbage)
+}
+
+// Get every blob that GCUnreferenced would remove, along with the paths
+// it would unlink, without removing anything.
+func (a Archive) GCUnreferencedDryRun() ([]Garbage, error) {
+	targets, err := a.unreferenced()
+	if err != nil {
+		return nil, err
+	}
+	targets, err = a.gcDuePaths(targets, true)
+	if err != nil {
+		return nil, err
+	}
+	garbage, err := a.garbage(targets)
+	if err != nil {
+		return nil, err
+	}
+	return a.gcDueGarbage(garbage)
+}
+
+// Get every blob that's not linked anywhere, as well as every blob that
+// would no longer be linked anywhere once `unlink` has been unlinked.
+func (a Archive) garbage(unlink []string) ([]Garbage, error) {
+	ret := []Garbage{}
+
+	unlinked, err := a.Store.Garbage()
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range unlinked {
+		info, err := a.Store.Stat(obj)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Garbage{ObjectInfo: *info, Paths: []string{}})
+	}
+
+	if len(unlink) == 0 {
+		return ret, nil
+	}
+
+	unlinking := map[string]bool{}
+	for _, target := range unlink {
+		unlinking[target] = true
+	}
+
+	targets, err := a.Store.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	/* For each blob, the paths that would be unlinked, and if anything
+	 * would still be linked to it after */
+	freed := map[string][]string{}
+	kept := map[string]bool{}
+	order := []string{}
+	for _, target := range targets {
+		obj, err := a.Store.Lookup(target)
+		if err != nil {
+			/* Not linked to a blob, so there's nothing to free */
+			continue
+		}
+		if !unlinking[target] {
+			kept[obj.ID] = true
+			continue
+		}
+		if _, ok := freed[obj.ID]; !ok {
+			order = append(order, obj.ID)
+		}
+		freed[obj.ID] = append(freed[obj.ID], target)
+	}
+
+	for _, id := range order {
+		if kept[id] {
+			continue
+		}
+		info, err := a.Store.Stat(Object{ID: id})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Garbage{ObjectInfo: *info, Paths: freed[id]})
+	}
+	return ret, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,205 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// GC Grace Period {{{
+
+// Only let GC remove a blob once it's gone unlinked for at least `grace`,
+// and only let GCUnreferenced unlink a path once it's gone unreferenced for
+// at least `grace`; so that a publish that went wrong can be undone (say,
+// with RestoreSnapshot, or by publishing the old Suite again), and clients
+// partway through fetching the old indices and pool files can finish.
+//
+// When each blob and path was first seen unlinked or unreferenced is kept
+// in ".gc-pending" under the root of the Archive, so the grace period
+// carries over from one GC to the next; anything that's linked or
+// referenced again in the meantime starts over. Removing single blobs
+// needs a Store that supports it, such as the FilesystemStore.
+//
+// Passing 0 (the default) removes everything straight away.
+func (a *Archive) SetGCGracePeriod(grace time.Duration) error {
+	if grace < 0 {
+		return fmt.Errorf("Invalid grace period: %s", grace)
+	}
+	if grace > 0 {
+		if a.path == "" {
+			return fmt.Errorf("Archive has no local path to keep GC state in")
+		}
+		if _, ok := a.Store.(ObjectRemover); !ok {
+			return fmt.Errorf("Store can't remove single blobs")
+		}
+	}
+	a.gcGrace = grace
+	return nil
+}
+
+// When each blob and path was first seen unlinked or unreferenced.
+type gcPending struct {
+	Blobs map[string]time.Time `json:"blobs"`
+	Paths map[string]time.Time `json:"paths"`
+}
+
+func (a Archive) gcPendingPath() string {
+	return filepath.Join(a.path, ".gc-pending")
+}
+
+func (a Archive) loadGCPending() (*gcPending, error) {
+	pending := gcPending{}
+	data, err := os.ReadFile(a.gcPendingPath())
+	if err == nil {
+		err = json.Unmarshal(data, &pending)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pending.Blobs == nil {
+		pending.Blobs = map[string]time.Time{}
+	}
+	if pending.Paths == nil {
+		pending.Paths = map[string]time.Time{}
+	}
+	return &pending, nil
+}
+
+func (a Archive) saveGCPending(pending gcPending) error {
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	tempPath := a.gcPendingPath() + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, a.gcPendingPath())
+}
+
+// Split `keys` into those that were seen before `now`, at least the grace
+// period ago, and those that weren't, which are returned along with when
+// they were first seen. Anything in `seen` that isn't in `keys` any more is
+// forgotten.
+func (a Archive) gcDue(keys []string, seen map[string]time.Time, now time.Time) ([]string, map[string]time.Time) {
+	due := []string{}
+	waiting := map[string]time.Time{}
+	for _, key := range keys {
+		first, ok := seen[key]
+		if !ok {
+			first = now
+		}
+		if now.Sub(first) >= a.gcGrace {
+			due = append(due, key)
+		} else {
+			waiting[key] = first
+		}
+	}
+	return due, waiting
+}
+
+// Remove every blob that's gone unlinked for the grace period, one at a
+// time, rather than with the Store's GC.
+func (a Archive) gcBlobs() (int, error) {
+	remover, ok := a.Store.(ObjectRemover)
+	if !ok {
+		return 0, fmt.Errorf("Store can't remove single blobs")
+	}
+
+	pending, err := a.loadGCPending()
+	if err != nil {
+		return 0, err
+	}
+	garbage, err := a.Store.Garbage()
+	if err != nil {
+		return 0, err
+	}
+	ids := []string{}
+	for _, obj := range garbage {
+		ids = append(ids, obj.ID)
+	}
+
+	due, waiting := a.gcDue(ids, pending.Blobs, time.Now())
+	for _, id := range due {
+		if err := remover.Remove(Object{ID: id}); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	pending.Blobs = waiting
+	if err := a.saveGCPending(*pending); err != nil {
+		return 0, err
+	}
+	if len(waiting) > 0 {
+		a.info("gc waiting out grace period", "blobs", len(waiting))
+	}
+	return len(due), nil
+}
+
+// Get which of the unreferenced `targets` have been unreferenced for the
+// grace period, recording when the rest were first seen unless this is a
+// `dryRun`.
+func (a Archive) gcDuePaths(targets []string, dryRun bool) ([]string, error) {
+	if a.gcGrace == 0 {
+		return targets, nil
+	}
+	pending, err := a.loadGCPending()
+	if err != nil {
+		return nil, err
+	}
+	due, waiting := a.gcDue(targets, pending.Paths, time.Now())
+	if dryRun {
+		return due, nil
+	}
+	pending.Paths = waiting
+	if len(waiting) > 0 {
+		a.info("gc waiting out grace period", "paths", len(waiting))
+	}
+	return due, a.saveGCPending(*pending)
+}
+
+// Record that the blobs `ids` were linked to paths that have just been
+// unlinked after waiting out the grace period, so they don't have to wait
+// it out all over again.
+func (a Archive) gcMarkFreed(ids []string) error {
+	if a.gcGrace == 0 || len(ids) == 0 {
+		return nil
+	}
+	pending, err := a.loadGCPending()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		pending.Blobs[id] = time.Time{}
+	}
+	return a.saveGCPending(*pending)
+}
+
+// Drop any blob from `garbage` that hasn't gone unlinked for the grace
+// period yet.
+func (a Archive) gcDueGarbage(garbage []Garbage) ([]Garbage, error) {
+	if a.gcGrace == 0 {
+		return garbage, nil
+	}
+	pending, err := a.loadGCPending()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ret := []Garbage{}
+	for _, el := range garbage {
+		/* Paths have already waited it out, so their blobs don't have to */
+		first, ok := pending.Blobs[el.ID]
+		if len(el.Paths) > 0 || (ok && now.Sub(first) >= a.gcGrace) {
+			ret = append(ret, el)
+		}
+	}
+	return ret, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
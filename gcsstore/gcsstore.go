@@ -0,0 +1,277 @@
+// Package gcsstore provides an archive.Store that keeps an Archive in a
+// Google Cloud Storage bucket, so that it can be served using GCS static
+// hosting.
+//
+// Blobs are kept under the ".blobs/" prefix, named by their ID, and are
+// published by copying them to their path in the bucket. Each published
+// object records the ID of its blob in its metadata, which is used to
+// Lookup paths and to decide what's still in use during GC.
+package gcsstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+
+	"pault.ag/go/archive"
+)
+
+// Metadata key each published object stores its blob's ID under.
+const blobMetadata = "archive-blob"
+
+// Store {{{
+
+// Store is an archive.Store backed by a GCS bucket.
+type Store struct {
+	bucket *storage.BucketHandle
+	prefix string
+	ctx    context.Context
+}
+
+// Create a new Store, keeping the Archive in `bucket`, with every object
+// name prefixed by `prefix` (which may be empty, to use the whole bucket).
+func New(client *storage.Client, bucket, prefix string) *Store {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return &Store{bucket: client.Bucket(bucket), prefix: prefix}
+}
+
+// Get a copy of the Store, which makes every request with `ctx`, so that
+// they can be cancelled, or given a deadline.
+func (s Store) WithContext(ctx context.Context) archive.Store {
+	s.ctx = ctx
+	return &s
+}
+
+func (s Store) requestContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func (s Store) object(target string) *storage.ObjectHandle {
+	return s.bucket.Object(s.prefix + strings.TrimPrefix(target, "/"))
+}
+
+func (s Store) blob(obj archive.Object) *storage.ObjectHandle {
+	return s.object(path.Join(".blobs", obj.ID))
+}
+
+// Blobs are written to a local temporary file first, since we need to
+// know the hash of the data before we know where it's going to live.
+type writer struct {
+	fd     *os.File
+	hash   hash.Hash
+	closed bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.fd.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.fd.Close()
+	os.Remove(w.fd.Name())
+	return err
+}
+
+func (s Store) Create() (archive.Writer, error) {
+	fd, err := os.CreateTemp("", "archive-gcs-")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{fd: fd, hash: sha256.New()}, nil
+}
+
+func (s Store) Commit(w archive.Writer) (*archive.Object, error) {
+	blob, ok := w.(*writer)
+	if !ok {
+		return nil, fmt.Errorf("Writer was not created by a gcsstore.Store")
+	}
+	defer blob.Close()
+
+	obj := archive.Object{ID: fmt.Sprintf("%x", blob.hash.Sum(nil))}
+	ctx := s.requestContext()
+
+	/* Content addressed, so if it's already there, we're done */
+	_, err := s.blob(obj).Attrs(ctx)
+	if err == nil {
+		return &obj, nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, err
+	}
+
+	if _, err := blob.fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	gcsWriter := s.blob(obj).NewWriter(ctx)
+	if _, err := io.Copy(gcsWriter, blob.fd); err != nil {
+		gcsWriter.Close()
+		return nil, err
+	}
+	if err := gcsWriter.Close(); err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (s Store) Open(obj archive.Object) (io.ReadCloser, error) {
+	reader, err := s.blob(obj).NewReader(s.requestContext())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Copy the blob to the target object. GCS replaces objects atomically, so
+// readers will see either the old or new object.
+func (s Store) Link(obj archive.Object, target string) error {
+	copier := s.object(target).CopierFrom(s.blob(obj))
+	copier.Metadata = map[string]string{blobMetadata: obj.ID}
+	_, err := copier.Run(s.requestContext())
+	return err
+}
+
+func (s Store) Unlink(target string) error {
+	err := s.object(target).Delete(s.requestContext())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (s Store) Lookup(target string) (*archive.Object, error) {
+	attrs, err := s.object(target).Attrs(s.requestContext())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := attrs.Metadata[blobMetadata]
+	if !ok {
+		return nil, fmt.Errorf("%s is not linked to any blob", target)
+	}
+	return &archive.Object{ID: id}, nil
+}
+
+// Call `fn` with the attributes of every object under the prefix, along
+// with its name relative to the Store's own prefix.
+func (s Store) walk(prefix string, fn func(string, *storage.ObjectAttrs) error) error {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	it := s.bucket.Objects(s.requestContext(), &storage.Query{
+		Prefix: s.prefix + prefix,
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(strings.TrimPrefix(attrs.Name, s.prefix), attrs); err != nil {
+			return err
+		}
+	}
+}
+
+func (s Store) List(prefix string) ([]string, error) {
+	ret := []string{}
+	err := s.walk(prefix, func(target string, attrs *storage.ObjectAttrs) error {
+		if !strings.HasPrefix(target, ".blobs/") {
+			ret = append(ret, target)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s Store) Stat(obj archive.Object) (*archive.ObjectInfo, error) {
+	attrs, err := s.blob(obj).Attrs(s.requestContext())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &archive.ObjectInfo{Object: obj, Size: attrs.Size, ModTime: attrs.Created}, nil
+}
+
+// Find every blob that no published object points to. Listing the bucket
+// returns each object's metadata, so this only needs a single pass over
+// the bucket to find what's still in use.
+func (s Store) Garbage() ([]archive.Object, error) {
+	linked := map[string]bool{}
+	blobs := []string{}
+
+	err := s.walk("", func(target string, attrs *storage.ObjectAttrs) error {
+		if strings.HasPrefix(target, ".blobs/") {
+			blobs = append(blobs, path.Base(target))
+		} else if id, ok := attrs.Metadata[blobMetadata]; ok {
+			linked[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []archive.Object{}
+	for _, id := range blobs {
+		if !linked[id] {
+			ret = append(ret, archive.Object{ID: id})
+		}
+	}
+	return ret, nil
+}
+
+// Remove every blob that no published object points to.
+func (s Store) GC() error {
+	garbage, err := s.Garbage()
+	if err != nil {
+		return err
+	}
+	for _, obj := range garbage {
+		err := s.blob(obj).Delete(s.requestContext())
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,276 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"pault.ag/go/debian/control"
+)
+
+// Upload {{{
+
+// Upload is a .changes file from an Incoming queue which has passed the
+// ChangesVerifier, and is waiting to be accepted into its target Suite.
+type Upload struct {
+	Path    string
+	Changes *control.Changes
+	Signer  *openpgp.Entity
+	Suite   *Suite
+}
+
+// Get the fingerprint of the key that signed the Upload, as an upper case
+// hex string.
+func (u Upload) Fingerprint() string {
+	if u.Signer == nil || u.Signer.PrimaryKey == nil {
+		return ""
+	}
+	return fmt.Sprintf("%X", u.Signer.PrimaryKey.Fingerprint)
+}
+
+// }}}
+
+// Rejection {{{
+
+// Rejection is the reason an Upload was not accepted, and which check
+// (such as a Hook) refused it. Any Details (such as each problem an
+// external checker found) are written out after the Reason, one per line.
+type Rejection struct {
+	Path   string
+	Hook   string
+	Reason string
+
+	Details []string
+
+	/* The .changes wasn't signed by a known key */
+	unsigned bool
+}
+
+func (r Rejection) Error() string {
+	return fmt.Sprintf("%s rejected by %s: %s", r.Path, r.Hook, r.Reason)
+}
+
+// Reject an Upload with the given reason. This is intended to be
+// returned from an UploadHook.
+func Reject(format string, args ...interface{}) *Rejection {
+	return &Rejection{Reason: fmt.Sprintf(format, args...)}
+}
+
+// }}}
+
+// UploadHook {{{
+
+// An UploadHook is run against every Upload before it is accepted into the
+// Archive. If the UploadHook returns an error, the Upload will be rejected.
+// Returning a *Rejection (such as from Reject) allows the UploadHook to
+// control the reason given.
+type UploadHook func(Upload) error
+
+type namedUploadHook struct {
+	name string
+	hook UploadHook
+}
+
+// Create an UploadHook which only accepts Uploads signed by one of the
+// given OpenPGP key fingerprints.
+func SignedByHook(fingerprints ...string) UploadHook {
+	allowed := map[string]bool{}
+	for _, fingerprint := range fingerprints {
+		allowed[normalizeFingerprint(fingerprint)] = true
+	}
+
+	return func(upload Upload) error {
+		fingerprint := upload.Fingerprint()
+		if !allowed[fingerprint] {
+			return Reject("%s is not allowed to upload", fingerprint)
+		}
+		return nil
+	}
+}
+
+// Create an UploadHook which only accepts Uploads targeting one of the
+// given Suites, by Name.
+func SuiteHook(suites ...string) UploadHook {
+	allowed := map[string]bool{}
+	for _, suite := range suites {
+		allowed[suite] = true
+	}
+
+	return func(upload Upload) error {
+		if !allowed[upload.Changes.Distribution] {
+			return Reject("uploads to %s are not allowed", upload.Changes.Distribution)
+		}
+		return nil
+	}
+}
+
+// Create an UploadHook which rejects any Upload that introduces a source
+// or binary package name that's not yet known to the Archive (that is to
+// say, would be in the NEW queue). The `known` function is called with the
+// name of each source and binary package in the Upload.
+func NewPackageHook(known func(name string) bool) UploadHook {
+	return func(upload Upload) error {
+		names := append([]string{changesSource(*upload.Changes)}, upload.Changes.Binaries...)
+		for _, name := range names {
+			if !known(name) {
+				return Reject("%s is NEW", name)
+			}
+		}
+		return nil
+	}
+}
+
+// Fingerprints are often written with spaces between each block, and in
+// lower case. Make them match what Upload.Fingerprint returns.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.Replace(fingerprint, " ", "", -1))
+}
+
+// }}}
+
+// Package Checks {{{
+
+// A DebCheck is run against a single .deb (or .udeb, or .ddeb) of an
+// Upload, by its local path, before it's accepted. Returning a *Rejection
+// (such as from Reject) allows the DebCheck to control the reason given,
+// and add Details.
+type DebCheck func(debPath string) error
+
+// Create an UploadHook which runs `check` against every .deb in an Upload,
+// in the order the .changes lists them, rejecting the Upload at the first
+// one that fails.
+func DebCheckHook(check DebCheck) UploadHook {
+	return func(upload Upload) error {
+		for _, file := range upload.Changes.AbsFiles() {
+			switch path.Ext(file.Filename) {
+			case ".deb", ".udeb", ".ddeb":
+			default:
+				continue
+			}
+			if err := check(file.Filename); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Create a DebCheck which runs the command `name`, with `args` and then
+// the path to the .deb, and fails if it exits non-zero, with each line of
+// its output as a Detail.
+func CommandCheck(name string, args ...string) DebCheck {
+	return func(debPath string) error {
+		cmdArgs := append(append([]string{}, args...), debPath)
+		output, err := exec.Command(name, cmdArgs...).CombinedOutput()
+		if _, ok := err.(*exec.ExitError); ok {
+			rejection := Reject("%s failed %s: %s", filepath.Base(debPath), name, err)
+			rejection.Details = outputLines(output)
+			return rejection
+		}
+		return err
+	}
+}
+
+// How serious each kind of lintian tag is, by the letter lintian prints
+// before it; lower is more serious.
+var lintianSeverities = map[string]int{
+	"E": 0,
+	"W": 1,
+	"I": 2,
+	"P": 3,
+}
+
+// Names of the thresholds LintianCheck takes, and the most trivial kind of
+// tag each one fails on.
+var lintianThresholds = map[string]int{
+	"error":    0,
+	"warning":  1,
+	"info":     2,
+	"pedantic": 3,
+}
+
+// Create a DebCheck which runs lintian(1), with any extra `args` (such as
+// "--profile" "debian"), and fails if it emits any tag as serious as
+// `threshold` or worse; one of "error", "warning", "info" or "pedantic".
+// Each such tag is a Detail of the Rejection. Overridden tags, and any
+// other output, are ignored. If lintian itself fails (rather than finding
+// problems), the .deb is rejected too, with what lintian had to say.
+func LintianCheck(threshold string, args ...string) (DebCheck, error) {
+	limit, ok := lintianThresholds[threshold]
+	if !ok {
+		return nil, fmt.Errorf("No such lintian threshold: '%s'", threshold)
+	}
+
+	return func(debPath string) error {
+		stderr := bytes.Buffer{}
+		cmd := exec.Command("lintian", append(append([]string{}, args...), debPath)...)
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+
+		/* lintian exits 1 if it found anything serious, and 2 (or more)
+		 * if it couldn't check the .deb at all */
+		failed := func(format string, args ...interface{}) error {
+			rejection := Reject(format, args...)
+			rejection.Details = outputLines(stderr.Bytes())
+			return rejection
+		}
+		exitCode := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			return err
+		}
+		if exitCode > 1 || exitCode < 0 {
+			return failed("lintian failed on %s: %s", filepath.Base(debPath), err)
+		}
+
+		found := 0
+		tags := []string{}
+		for _, line := range outputLines(output) {
+			kind, _, ok := strings.Cut(line, ": ")
+			if !ok {
+				continue
+			}
+			severity, ok := lintianSeverities[kind]
+			if !ok {
+				continue
+			}
+			found++
+			if severity <= limit {
+				tags = append(tags, line)
+			}
+		}
+		if exitCode != 0 && found == 0 {
+			return failed("lintian failed on %s, without saying why: %s", filepath.Base(debPath), err)
+		}
+		if len(tags) == 0 {
+			return nil
+		}
+
+		rejection := Reject("%s has %d lintian tag(s) at %s or above",
+			filepath.Base(debPath), len(tags), threshold)
+		rejection.Details = tags
+		return rejection
+	}, nil
+}
+
+// Split command output into its non-empty lines.
+func outputLines(output []byte) []string {
+	ret := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+// }}}
+
+// vim: foldmethod=marker
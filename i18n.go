@@ -0,0 +1,305 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// Translations {{{
+
+// Set the Translation file for a language (such as "en" or "pt_BR") of the
+// Component, replacing any set before. This will be published, in each of
+// the Suite's index compressions, as
+// "dists/<suite>/<component>/i18n/Translation-<lang>", along with an
+// "i18n/Index" listing every Translation file the Component has.
+//
+// `data` is the uncompressed Translation file; a Package, Description-md5
+// and Description-<lang> paragraph for each translated Description. To
+// build one up a Description at a time instead, use AddTranslation.
+func (c *Component) SetTranslation(lang string, data io.Reader) error {
+	if err := checkLanguage(lang); err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	if _, err := io.Copy(&buf, data); err != nil {
+		return err
+	}
+	c.translations[lang] = buf.Bytes()
+	delete(c.translated, lang)
+	return nil
+}
+
+func checkLanguage(lang string) error {
+	if lang == "" || strings.ContainsAny(lang, "/ ") {
+		return fmt.Errorf("Invalid language: '%s'", lang)
+	}
+	return nil
+}
+
+// Translation is a single translated Description of a Package, as listed
+// in a Translation-<lang> file.
+type Translation struct {
+	Package string
+
+	// MD5 of the untranslated Description, as the Package's Description-md5,
+	// so that apt only uses the Translation for the Description it was
+	// translated from.
+	DescriptionMD5 string
+
+	// The translated Description; a synopsis, then the long description,
+	// just like a Package's Description.
+	Description string
+}
+
+// Get a Translation of the Package's Description. If the Package has no
+// Description-md5, it's worked out from the Description.
+func NewTranslation(pkg Package, description string) Translation {
+	descriptionMD5 := pkg.DescriptionMD5
+	if descriptionMD5 == "" {
+		descriptionMD5 = fmt.Sprintf("%x", md5.Sum([]byte(pkg.Description+"\n")))
+	}
+	return Translation{
+		Package:        pkg.Package,
+		DescriptionMD5: descriptionMD5,
+		Description:    description,
+	}
+}
+
+// Add a translated Description to the Translation file for a language
+// (such as "de" or "pt_BR") of the Component, after anything set with
+// SetTranslation, replacing any Translation of the same Description added
+// before. Every language with a Translation is published just like one set
+// with SetTranslation, sorted by Package.
+func (c *Component) AddTranslation(lang string, translation Translation) error {
+	if err := checkLanguage(lang); err != nil {
+		return err
+	}
+	if translation.Package == "" || translation.DescriptionMD5 == "" || translation.Description == "" {
+		return fmt.Errorf("Translation of '%s' is incomplete", translation.Package)
+	}
+	if _, ok := c.translated[lang]; !ok {
+		c.translated[lang] = map[string]Translation{}
+	}
+	c.translated[lang][translation.Package+" "+translation.DescriptionMD5] = translation
+	return nil
+}
+
+// Get the languages the Component has a Translation file for, sorted.
+func (c Component) translationLangs() []string {
+	langs := []string{}
+	for lang := range c.translations {
+		langs = append(langs, lang)
+	}
+	for lang := range c.translated {
+		if _, ok := c.translations[lang]; !ok {
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Render the Translation file for a language; whatever was set with
+// SetTranslation, and then every Translation added with AddTranslation.
+func (c Component) translationFile(lang string) ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.Write(c.translations[lang])
+
+	translations := []Translation{}
+	for _, translation := range c.translated[lang] {
+		translations = append(translations, translation)
+	}
+	if len(translations) == 0 {
+		return buf.Bytes(), nil
+	}
+	sort.Slice(translations, func(i, j int) bool {
+		if translations[i].Package != translations[j].Package {
+			return translations[i].Package < translations[j].Package
+		}
+		return translations[i].DescriptionMD5 < translations[j].DescriptionMD5
+	})
+
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("\n")
+	}
+	encoder, err := control.NewEncoder(&buf)
+	if err != nil {
+		return nil, err
+	}
+	for _, translation := range translations {
+		paragraph := control.Paragraph{Values: map[string]string{}, Order: []string{}}
+		paragraph.Set("Package", translation.Package)
+		paragraph.Set("Description-md5", translation.DescriptionMD5)
+		paragraph.Set("Description-"+lang, translation.Description)
+		if err := encoder.Encode(paragraph); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Write out all of the Component's Translation files, and the i18n/Index
+// summarizing them, and register them in the ArchiveState and Release.
+func (a Archive) commitTranslations(
+	suite Suite,
+	release *Release,
+	files ArchiveState,
+	component *Component,
+) error {
+	langs := component.translationLangs()
+	if len(langs) == 0 {
+		return nil
+	}
+
+	/* Hashes of every Translation file, by algorithm, for the Index */
+	index := map[string][]control.FileHash{}
+	for _, lang := range langs {
+		data, err := component.translationFile(lang)
+		if err != nil {
+			return err
+		}
+		suitePath := path.Join(component.name, "i18n", "Translation-"+lang)
+		fileHashes, err := a.commitCompressed(suite, release, files, suitePath, data)
+		if err != nil {
+			return err
+		}
+		for _, fileHash := range fileHashes {
+			fileHash.Filename = path.Base(fileHash.Filename)
+			index[fileHash.Algorithm] = append(index[fileHash.Algorithm], fileHash)
+		}
+	}
+
+	suitePath := path.Join(component.name, "i18n", "Index")
+	return a.commitFile(suite, release, files, suitePath, translationIndex(suite, index))
+}
+
+// Render the i18n/Index; a hash field for each of the Suite's hash
+// algorithms, listing the hash, size and name of every Translation file.
+func translationIndex(suite Suite, index map[string][]control.FileHash) io.Reader {
+	buf := bytes.Buffer{}
+	for _, algorithm := range suite.features.Hashes {
+		fileHashes, ok := index[algorithm]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s:\n", releaseHashFields[algorithm])
+		for _, fileHash := range fileHashes {
+			fmt.Fprintf(&buf, " %s %d %s\n", fileHash.Hash, fileHash.Size, fileHash.Filename)
+		}
+	}
+	return &buf
+}
+
+// }}}
+
+// LoadTranslations {{{
+
+// Translations is an iterator over the entries of a Translation file.
+type Translations struct {
+	decoder *control.Decoder
+}
+
+type translationParagraph struct {
+	control.Paragraph
+
+	Package        string
+	DescriptionMD5 string `control:"Description-md5"`
+}
+
+// Given an io.Reader, create a Translations iterator, such as for an
+// upstream archive's "main/i18n/Translation-de". The data may be gzip, xz
+// or zstd compressed (as published in dists/), or uncompressed.
+func LoadTranslations(in io.Reader) (*Translations, error) {
+	reader, err := decompress(in)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := control.NewDecoder(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Translations{decoder: decoder}, nil
+}
+
+// Get the next Translation in the file. This will return an io.EOF at the
+// last entry.
+func (t *Translations) Next() (*Translation, error) {
+	next := translationParagraph{}
+	if err := t.decoder.Decode(&next); err != nil {
+		return nil, err
+	}
+
+	ret := Translation{Package: next.Package, DescriptionMD5: next.DescriptionMD5}
+	for _, key := range next.Paragraph.Order {
+		if strings.HasPrefix(key, "Description-") && key != "Description-md5" {
+			ret.Description = next.Paragraph.Values[key]
+			break
+		}
+	}
+	return &ret, nil
+}
+
+// Add the Translations from an existing Translation file for a language
+// (such as one from the upstream archive the Component's Packages were
+// rebuilt from, fetched with Remote.Open), but only those of the
+// Description of a Package the Component has, on any Architecture; so that
+// the Component's Translation files only cover what it actually publishes.
+// The Packages must already have been added. This returns how many
+// Translations were added.
+func (c *Component) ImportTranslations(lang string, in io.Reader) (int, error) {
+	if err := checkLanguage(lang); err != nil {
+		return 0, err
+	}
+
+	wanted := map[string]bool{}
+	for _, writer := range c.packageWriters {
+		for _, entry := range writer.entries {
+			if pkg, ok := entry.(Package); ok {
+				translation := NewTranslation(pkg, "")
+				wanted[translation.Package+" "+translation.DescriptionMD5] = true
+			}
+		}
+	}
+
+	translations, err := LoadTranslations(in)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		translation, err := translations.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if !wanted[translation.Package+" "+translation.DescriptionMD5] {
+			continue
+		}
+		if err := c.AddTranslation(lang, *translation); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	c.suite.archive.info("translations imported",
+		"suite", c.suite.Name, "component", c.name, "lang", lang, "count", count)
+	return count, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,328 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/dependency"
+)
+
+// Import {{{
+
+// Import an existing apt repository from the filesystem at `root` (with
+// dists/ and pool/ directories, such as one made by reprepro, aptly or
+// apt-ftparchive), so that it can be published by this Archive without
+// having to start over from the original .debs and .dscs.
+//
+// Each of the named Suites (or every Suite with a Release file under
+// dists/, if none are named) is read back into a new Suite, with the
+// Description, Origin, Label and Version of its Release, and a Component
+// for each Component it lists, holding every Package and Source entry of
+// its indices. Every index is checked against the Release, and every pool
+// file against its index, before the pool file is copied into the
+// Archive's Pool, at the same path. Nothing under `root` is modified.
+//
+// The returned Suites aren't published until they're Engrossed and Linked.
+// Release signatures aren't checked; run Verify against `root` first if
+// the repository isn't already trusted. Packages built for "all" that the
+// repository copied into every Architecture's index are only added once;
+// use SetArchAllPolicy to publish them the same way again.
+func (a *Archive) Import(root string, suites ...string) ([]*Suite, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	/* Only used to read, so there's no need to set up the .blobs dir */
+	source := FilesystemStore{root: root}
+
+	if len(suites) == 0 {
+		targets, err := source.List("dists")
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			if isSuiteRelease(target) {
+				suites = append(suites, strings.TrimPrefix(path.Dir(target), "dists/"))
+			}
+		}
+		if len(suites) == 0 {
+			return nil, fmt.Errorf("No Release files under %s", root)
+		}
+	}
+
+	ret := []*Suite{}
+	for _, name := range suites {
+		suite, err := a.importSuite(source, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		ret = append(ret, suite)
+	}
+	return ret, nil
+}
+
+func (a *Archive) importSuite(source FilesystemStore, name string) (*Suite, error) {
+	dir := path.Join("dists", name)
+	fd, err := os.Open(source.targetPath(path.Join(dir, "Release")))
+	if err != nil {
+		return nil, err
+	}
+	release, err := LoadInRelease(fd, nil)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	suite, err := a.suiteFromRelease(name, *release)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := release.Indices()
+	for _, base := range releaseEntryIndices(*release) {
+		kind := path.Base(base)
+		componentName := path.Dir(path.Dir(base))
+		component, err := suite.Component(componentName)
+		if err != nil {
+			return nil, err
+		}
+
+		indexPath, err := importIndexPath(source, dir, base, indices)
+		if err != nil {
+			return nil, err
+		}
+		if indexPath == "" {
+			continue
+		}
+
+		switch kind {
+		case "Packages":
+			err = a.importPackages(source, indexPath, component)
+		case "Sources":
+			err = a.importSources(source, indexPath, component)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a.info("suite imported", "suite", name, "root", source.root)
+	return suite, nil
+}
+
+// Get every Packages and Sources index (without any compression's
+// extension, relative to the Suite's dists directory) the Release lists,
+// sorted. Only "<component>/binary-<arch>/" and "<component>/source/" of the
+// Release's Components are included; not debian-installer, or anything else
+// apt doesn't fetch.
+func releaseEntryIndices(release Release) []string {
+	bases := []string{}
+	for filename := range release.Indices() {
+		base := stripCompression(filename)
+		kind := path.Base(base)
+		if kind != "Packages" && kind != "Sources" {
+			continue
+		}
+		if !slices.Contains(release.Components, path.Dir(path.Dir(base))) {
+			continue
+		}
+		if !slices.Contains(bases, base) {
+			bases = append(bases, base)
+		}
+	}
+	slices.Sort(bases)
+	return bases
+}
+
+// Create a new Suite, with the Description, Origin, Label and Version of
+// the `release` it's being copied from.
+func (a *Archive) suiteFromRelease(name string, release Release) (*Suite, error) {
+	suite, err := a.Suite(name)
+	if err != nil {
+		return nil, err
+	}
+	suite.Description = release.Description
+	suite.Origin = release.Origin
+	suite.Label = release.Label
+	suite.Version = release.Version
+	return suite, nil
+}
+
+// Find a published compression of the index `base` (relative to `dir`),
+// and check it against every hash the Release lists for it, returning
+// its path, or "" if no compression of it is there.
+func importIndexPath(
+	source FilesystemStore,
+	dir string,
+	base string,
+	indices map[string]control.FileHashes,
+) (string, error) {
+	for _, ext := range indexCompressions {
+		hashes, ok := indices[base+ext]
+		if !ok {
+			continue
+		}
+		indexPath := path.Join(dir, base+ext)
+		if _, err := os.Stat(source.targetPath(indexPath)); os.IsNotExist(err) {
+			continue
+		}
+
+		for _, hash := range hashes {
+			fd, err := os.Open(source.targetPath(indexPath))
+			if err != nil {
+				return "", err
+			}
+			err = verifyHash(indexPath, fd, hash)
+			fd.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+		return indexPath, nil
+	}
+	return "", nil
+}
+
+func (a Archive) importPackages(source FilesystemStore, indexPath string, component *Component) error {
+	fd, err := os.Open(source.targetPath(indexPath))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	packages, err := LoadPackages(fd)
+	if err != nil {
+		return err
+	}
+
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		/* "all" Packages are often listed in every Architecture's index */
+		if component.hasEntry(pkg.Architecture, *pkg) {
+			continue
+		}
+
+		hash, ok := packageFileHash(*pkg)
+		if !ok {
+			return fmt.Errorf("%s %s has no checksums", pkg.Package, pkg.Version)
+		}
+		if err := a.importPoolFile(source, pkg.Filename, hash); err != nil {
+			return err
+		}
+		if err := component.AddPackage(*pkg); err != nil {
+			return err
+		}
+	}
+}
+
+func (a Archive) importSources(source FilesystemStore, indexPath string, component *Component) error {
+	fd, err := os.Open(source.targetPath(indexPath))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	sources, err := LoadSources(fd)
+	if err != nil {
+		return err
+	}
+
+	for {
+		src, err := sources.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for filename, hash := range sourceFileHashes(*src) {
+			target := path.Join(src.Directory, filename)
+			if err := a.importPoolFile(source, target, hash); err != nil {
+				return err
+			}
+		}
+		if err := component.AddSource(*src); err != nil {
+			return err
+		}
+	}
+}
+
+// Check if the Component already has an entry with the same name, version
+// and architecture in the index for `arch`.
+func (c *Component) hasEntry(arch dependency.Arch, entry interface{}) bool {
+	writer, ok := c.packageWriters[arch]
+	if !ok {
+		return false
+	}
+	_, ok = writer.seen[seenKey(entry)]
+	return ok
+}
+
+// Copy the pool file at `target` from the repository being imported into
+// the Pool, at the same path, after checking it against `hash`. Files
+// already in the Pool (with the same hash) aren't copied again.
+func (a Archive) importPoolFile(source FilesystemStore, target string, hash control.FileHash) error {
+	if err := checkPoolPath(target); err != nil {
+		return err
+	}
+
+	if ok, err := a.Pool.hasFile(target, hash); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	fsPath := source.targetPath(target)
+	obj, hashers, err := a.Pool.copyHashed(fsPath, []string{hash.Algorithm})
+	if err != nil {
+		return err
+	}
+
+	/* The blob is left for GC if it doesn't match */
+	hasher := hashers[0]
+	if size := hasher.Size(); size != hash.Size {
+		return fmt.Errorf(
+			"Size mismatch on %s: expected %d, got %d",
+			target, hash.Size, size,
+		)
+	}
+	if sum := fmt.Sprintf("%x", hasher.Sum(nil)); sum != hash.Hash {
+		return fmt.Errorf(
+			"%s mismatch on %s: expected %s, got %s",
+			hash.Algorithm, target, hash.Hash, sum,
+		)
+	}
+
+	if err := a.Pool.Store.Link(*obj, target); err != nil {
+		return err
+	}
+	a.debug("imported", "path", target, "object", obj.ID)
+	return nil
+}
+
+// Make sure a pool path from somebody else's index can't be used to link
+// something outside of pool/.
+func checkPoolPath(target string) error {
+	if !strings.HasPrefix(target, "pool/") || path.Clean(target) != target {
+		return fmt.Errorf("Pool path '%s' is not a clean path under pool/", target)
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,424 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/deb"
+	"pault.ag/go/debian/transput"
+)
+
+// Incoming {{{
+
+// Incoming is a queue directory that uploads (a .changes file, and all the
+// files it references) are dropped into. Processing the queue will check
+// each upload, copy the files into the Pool, and add the Package and Source
+// entries to the Suite named in the upload's Distribution field.
+//
+// Uploads that fail verification, or are refused by an UploadHook, are
+// moved into the reject directory, along with a .reason file explaining
+// why.
+//
+// This is the core loop of a dak or mini-dinstall style archive.
+type Incoming struct {
+	archive    *Archive
+	path       string
+	rejectPath string
+	suites     map[string]*Suite
+	verifier   *ChangesVerifier
+	hooks      []namedUploadHook
+}
+
+// Create a new Incoming queue, reading uploads out of the directory at
+// `path`. Rejected uploads are moved into the "reject" directory under
+// `path`, unless changed with SetRejectPath.
+//
+// Uploads must be signed by a key in `keyring`, and will only be accepted
+// into Suites that have been registered with AddSuite, anything else will
+// be rejected.
+func (a *Archive) Incoming(path string, keyring openpgp.EntityList) (*Incoming, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Incoming{
+		archive:    a,
+		path:       path,
+		rejectPath: filepath.Join(path, "reject"),
+		suites:     map[string]*Suite{},
+		verifier:   NewChangesVerifier(keyring),
+		hooks:      []namedUploadHook{},
+	}, nil
+}
+
+// Allow uploads targeting the given Suite (by Name) to be processed.
+func (i *Incoming) AddSuite(suite *Suite) {
+	i.suites[suite.Name] = suite
+}
+
+// Register an UploadHook to be run against every Upload. Hooks are run
+// in the order they were added, and the first to fail will reject the
+// Upload. The `name` is used as the Hook in the resulting Rejection.
+func (i *Incoming) AddHook(name string, hook UploadHook) {
+	i.hooks = append(i.hooks, namedUploadHook{name: name, hook: hook})
+}
+
+// Set the directory rejected uploads are moved into.
+func (i *Incoming) SetRejectPath(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	i.rejectPath = path
+	return nil
+}
+
+func (i Incoming) Path() string {
+	return i.path
+}
+
+func (i Incoming) RejectPath() string {
+	return i.rejectPath
+}
+
+// Get a sorted list of paths to every .changes file waiting in the queue.
+func (i Incoming) Pending() ([]string, error) {
+	ret, err := filepath.Glob(filepath.Join(i.path, "*.changes"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Process every .changes file waiting in the queue, in order. Rejected
+// uploads are moved aside and processing carries on, but any other error
+// will stop processing, leaving that upload (and anything after it) in the
+// queue.
+func (i Incoming) Process() ([]*Upload, []*Rejection, error) {
+	pending, err := i.Pending()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accepted := []*Upload{}
+	rejected := []*Rejection{}
+	for _, changesPath := range pending {
+		upload, err := i.Include(changesPath)
+		if rejection, ok := err.(*Rejection); ok {
+			rejected = append(rejected, rejection)
+			continue
+		}
+		if err != nil {
+			return accepted, rejected, err
+		}
+		accepted = append(accepted, upload)
+	}
+	return accepted, rejected, nil
+}
+
+// Include a single upload, by the path to its .changes file. The upload
+// is checked by the Incoming's ChangesVerifier and UploadHooks, and then
+// all the files listed in the .changes are copied into the Pool, and added
+// to the target Suite. Once everything has been included, the upload is
+// removed from the queue.
+//
+// If the upload is rejected, it's moved to the reject directory, and the
+// error returned will be a *Rejection.
+func (i Incoming) Include(changesPath string) (*Upload, error) {
+	upload, err := i.check(changesPath)
+	if rejection, ok := err.(*Rejection); ok {
+		if err := i.reject(rejection); err != nil {
+			return nil, err
+		}
+		return nil, rejection
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.archive.includeChanges(upload.Suite, *upload.Changes); err != nil {
+		return nil, err
+	}
+
+	files := upload.Changes.AbsFiles()
+	for _, file := range files {
+		if err := os.Remove(file.Filename); err != nil {
+			return nil, err
+		}
+	}
+
+	return upload, os.Remove(upload.Path)
+}
+
+// Verify the .changes at `changesPath`, and run it past each of the
+// UploadHooks. Any reason not to accept the upload is returned as a
+// *Rejection.
+func (i Incoming) check(changesPath string) (*Upload, error) {
+	rejection := func(hook, reason string) *Rejection {
+		return &Rejection{Path: changesPath, Hook: hook, Reason: reason}
+	}
+
+	changes, signer, err := i.verifier.VerifySignature(changesPath)
+	if err != nil {
+		ret := rejection("verify", err.Error())
+		ret.unsigned = true
+		return nil, ret
+	}
+	if err := i.verifier.VerifyFiles(changes); err != nil {
+		return nil, rejection("verify", err.Error())
+	}
+
+	suite, ok := i.suites[changes.Distribution]
+	if !ok {
+		return nil, rejection("suite", fmt.Sprintf("No such suite: '%s'", changes.Distribution))
+	}
+
+	upload := Upload{
+		Path:    changes.Filename,
+		Changes: changes,
+		Signer:  signer,
+		Suite:   suite,
+	}
+
+	for _, hook := range i.hooks {
+		err := hook.hook(upload)
+		if err == nil {
+			continue
+		}
+		if r, ok := err.(*Rejection); ok {
+			ret := rejection(hook.name, r.Reason)
+			ret.Details = r.Details
+			return nil, ret
+		}
+		return nil, rejection(hook.name, err.Error())
+	}
+
+	return &upload, nil
+}
+
+// Move a rejected upload (the .changes, and any files it references that
+// exist) into the reject directory, and write out the reason next to it.
+//
+// If the .changes isn't signed by a known key, nothing it says can be
+// trusted, so only the .changes itself is moved; the files it references
+// are left for whoever cleans up the queue. Even when it is, files that
+// aren't bare filenames in the queue directory are never touched.
+func (i Incoming) reject(rejection *Rejection) error {
+	if err := os.MkdirAll(i.rejectPath, 0755); err != nil {
+		return err
+	}
+
+	paths := []string{rejection.Path}
+	if !rejection.unsigned {
+		if changes, err := control.ParseChangesFile(rejection.Path); err == nil {
+			dir := filepath.Dir(rejection.Path)
+			for _, file := range changes.Files {
+				if checkChangesFilename(file.Filename) != nil {
+					continue
+				}
+				paths = append(paths, filepath.Join(dir, file.Filename))
+			}
+		}
+	}
+
+	for _, el := range paths {
+		if _, err := os.Stat(el); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(el, filepath.Join(i.rejectPath, filepath.Base(el))); err != nil {
+			return err
+		}
+	}
+
+	reasonPath := filepath.Join(
+		i.rejectPath,
+		fmt.Sprintf("%s.reason", filepath.Base(rejection.Path)),
+	)
+	reason := rejection.Error() + "\n"
+	for _, detail := range rejection.Details {
+		reason += "  " + detail + "\n"
+	}
+	return os.WriteFile(reasonPath, []byte(reason), 0644)
+}
+
+// }}}
+
+// Archive Include {{{
+
+// Include an upload straight into the Suite named `suite`, from its parsed
+// .changes (such as from control.ParseChangesFile, which sets the Filename
+// the files it lists are found next to), and publish it; the equivalent of
+// "reprepro include".
+//
+// Every file the .changes lists is checked against its size and checksums
+// (but the .changes' signature isn't; see ChangesVerifier to check that
+// too), copied into the Pool, and added to the Suite, which starts off
+// with whatever's currently published in it (see OpenSuite). The files are
+// left where they are. The Suite is then Engrossed and Linked, and returned
+// for any further changes.
+//
+// This should only be run while holding the Archive's Lock.
+func (a *Archive) Include(suite string, changes control.Changes) (*Suite, error) {
+	if err := (ChangesVerifier{}).VerifyFiles(&changes); err != nil {
+		return nil, err
+	}
+
+	target, err := a.OpenSuite(suite)
+	if os.IsNotExist(err) {
+		target, err = a.Suite(suite)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.includeChanges(target, changes); err != nil {
+		return nil, err
+	}
+
+	files, err := a.Engross(*target)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Link(files); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// Copy every .deb and .dsc (along with the files it references) the
+// .changes lists into the Pool, and add them to the Component of the Suite
+// their Section belongs to. Any .buildinfo is copied into the Pool next to
+// them (see IncludeBuildinfo).
+func (a Archive) includeChanges(suite *Suite, changes control.Changes) error {
+	for _, file := range changes.AbsFiles() {
+		component, err := suite.Component(componentFromSection(file.Component))
+		if err != nil {
+			return err
+		}
+
+		switch path.Ext(file.Filename) {
+		case ".deb", ".udeb", ".ddeb":
+			err = a.includeDeb(component, file.Filename)
+		case ".dsc":
+			err = a.includeDsc(component, changesSource(changes), file.Filename)
+		case ".buildinfo":
+			_, err = a.Pool.IncludeBuildinfo(component.Name(), changesSource(changes), file.Filename)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy a .deb (and its changelog) into the Pool, and add its Package
+// entry to the Component.
+func (a Archive) includeDeb(component *Component, debPath string) error {
+	debFile, closer, err := deb.LoadFile(debPath)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	pkg, err := a.Pool.IncludeDeb(component.Name(), *debFile)
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.Pool.IncludeChangelog(component.Name(), *debFile); err != nil {
+		return err
+	}
+
+	return component.AddPackage(*pkg)
+}
+
+// Copy a .dsc (and the files it references) into the Pool, and add its
+// Source entry to the Component. The .dsc must be for the same `source`
+// as the .changes it was uploaded with.
+func (a Archive) includeDsc(component *Component, source, dscPath string) error {
+	dsc, err := control.ParseDscFile(dscPath)
+	if err != nil {
+		return err
+	}
+	if dsc.Source != source {
+		return fmt.Errorf(
+			"%s is for source '%s', but the .changes is for '%s'",
+			filepath.Base(dscPath), dsc.Source, source,
+		)
+	}
+
+	src, err := a.Pool.IncludeSources(component.Name(), dsc)
+	if err != nil {
+		return err
+	}
+
+	return component.AddSource(*src)
+}
+
+// }}}
+
+// Helpers {{{
+
+// The Section of a file in a .changes is either a bare section (such as
+// "net"), which lives in main, or is prefixed by the component (such as
+// "contrib/net").
+func componentFromSection(section string) string {
+	if i := strings.Index(section, "/"); i != -1 {
+		return section[:i]
+	}
+	return "main"
+}
+
+// Check that the file at `path` matches the size and checksum declared
+// in the FileHash.
+func verifyFileHash(path string, hash control.FileHash) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return verifyHash(path, fd, hash)
+}
+
+// Check that the data read from `in` matches the size and checksum
+// declared in the FileHash. The `name` is only used for error messages.
+func verifyHash(name string, in io.Reader, hash control.FileHash) error {
+	hasher, err := transput.NewHasher(hash.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(hasher, in)
+	if err != nil {
+		return err
+	}
+
+	if size != hash.Size {
+		return fmt.Errorf(
+			"Size mismatch on %s: expected %d, got %d",
+			name, hash.Size, size,
+		)
+	}
+
+	if sum := fmt.Sprintf("%x", hasher.Sum(nil)); sum != hash.Hash {
+		return fmt.Errorf(
+			"%s mismatch on %s: expected %s, got %s",
+			hash.Algorithm, name, hash.Hash, sum,
+		)
+	}
+
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,179 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"pault.ag/go/debian/control"
+)
+
+// Incoming {{{
+
+func newTestKey(t *testing.T) *openpgp.Entity {
+	key, err := openpgp.NewEntity("Archive Test", "", "test@example.com", &packet.Config{
+		Algorithm: packet.PubKeyAlgoEdDSA,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Create an Archive with an "unstable" Suite, and an Incoming queue for
+// it, taking uploads signed by `key`.
+func newTestIncoming(t *testing.T, key *openpgp.Entity) *Incoming {
+	root := t.TempDir()
+	a, err := New(filepath.Join(root, "archive"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := filepath.Join(root, "incoming")
+	if err := os.Mkdir(queue, 0755); err != nil {
+		t.Fatal(err)
+	}
+	incoming, err := a.Incoming(queue, openpgp.EntityList{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming.AddSuite(suite)
+	return incoming
+}
+
+// Write a .changes for "foo" into `dir`, listing the given files, and
+// clearsigned by `key`, unless it's nil.
+func writeTestChanges(
+	t *testing.T,
+	dir string,
+	key *openpgp.Entity,
+	files []control.FileListChangesFileHash,
+	sha256s []control.SHA256FileHash,
+) string {
+	text := "Format: 1.8\nSource: foo\nVersion: 1.0\nDistribution: unstable\nFiles:\n"
+	for _, el := range files {
+		text += fmt.Sprintf(" %s %d %s %s %s\n", el.Hash, el.Size, el.Component, el.Priority, el.Filename)
+	}
+	text += "Checksums-Sha256:\n"
+	for _, el := range sha256s {
+		text += fmt.Sprintf(" %s %d %s\n", el.Hash, el.Size, el.Filename)
+	}
+
+	data := []byte(text)
+	if key != nil {
+		buf := bytes.Buffer{}
+		writer, err := clearsign.Encode(&buf, key.PrivateKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data = buf.Bytes()
+	}
+
+	changesPath := filepath.Join(dir, "foo_1.0_source.changes")
+	if err := os.WriteFile(changesPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return changesPath
+}
+
+// Process the queue, expecting exactly one upload to be rejected, by the
+// given hook.
+func processRejected(t *testing.T, incoming *Incoming, hook string) *Rejection {
+	accepted, rejected, err := incoming.Process()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accepted) != 0 || len(rejected) != 1 {
+		t.Fatalf("Expected a single rejection, got %d accepted and %d rejected", len(accepted), len(rejected))
+	}
+	if rejected[0].Hook != hook {
+		t.Fatalf("Rejected by '%s' rather than '%s': %s", rejected[0].Hook, hook, rejected[0])
+	}
+	return rejected[0]
+}
+
+func exists(t *testing.T, path string) bool {
+	_, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestIncomingRejectsUnsigned(t *testing.T) {
+	incoming := newTestIncoming(t, newTestKey(t))
+	queue := incoming.Path()
+
+	md5sum, sha256sum := writeUploadFile(t, queue, "foo_1.0.dsc", []byte("Source: foo\n"))
+	changesPath := writeTestChanges(t, queue, nil,
+		[]control.FileListChangesFileHash{md5sum},
+		[]control.SHA256FileHash{sha256sum},
+	)
+
+	processRejected(t, incoming, "verify")
+
+	if exists(t, changesPath) {
+		t.Errorf("Unsigned .changes was left in the queue")
+	}
+	if !exists(t, filepath.Join(incoming.RejectPath(), "foo_1.0_source.changes")) {
+		t.Errorf("Unsigned .changes wasn't moved to the reject directory")
+	}
+	if !exists(t, filepath.Join(incoming.RejectPath(), "foo_1.0_source.changes.reason")) {
+		t.Errorf("No reason was written for the rejection")
+	}
+
+	/* Nothing an unsigned .changes says can be trusted */
+	if !exists(t, filepath.Join(queue, "foo_1.0.dsc")) {
+		t.Errorf("File listed by an unsigned .changes was moved")
+	}
+}
+
+func TestIncomingRejectsTraversal(t *testing.T) {
+	key := newTestKey(t)
+	incoming := newTestIncoming(t, key)
+	queue := incoming.Path()
+
+	outside := filepath.Dir(queue)
+	md5sum, sha256sum := writeUploadFile(t, outside, "secret", []byte("hunter2\n"))
+	md5sum.Filename = "../secret"
+	sha256sum.Filename = "../secret"
+	writeTestChanges(t, queue, key,
+		[]control.FileListChangesFileHash{md5sum},
+		[]control.SHA256FileHash{sha256sum},
+	)
+
+	rejection := processRejected(t, incoming, "verify")
+	if !strings.Contains(rejection.Reason, "Invalid filename") {
+		t.Errorf("Unexpected reason: %s", rejection.Reason)
+	}
+
+	if !exists(t, filepath.Join(outside, "secret")) {
+		t.Errorf("File outside the queue was moved")
+	}
+	if exists(t, filepath.Join(incoming.RejectPath(), "secret")) {
+		t.Errorf("File outside the queue was moved to the reject directory")
+	}
+	if !exists(t, filepath.Join(incoming.RejectPath(), "foo_1.0_source.changes")) {
+		t.Errorf(".changes wasn't moved to the reject directory")
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,186 @@
+package archive
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"pault.ag/go/debian/control"
+)
+
+// Incremental Publish {{{
+
+// Get the hashes of every file the Suite's currently published Release
+// lists, or nil if it's never been published.
+func (a Archive) publishedIndices(suite Suite) (map[string]control.FileHashes, error) {
+	fd, err := a.OpenPath(path.Join("dists", suite.Name, "Release"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	release, err := LoadInRelease(fd, nil)
+	if err != nil {
+		return nil, err
+	}
+	return release.Indices(), nil
+}
+
+// Find the hash in `hashes` made with `algorithm`.
+func findFileHash(hashes control.FileHashes, algorithm string) (control.FileHash, bool) {
+	for _, fileHash := range hashes {
+		if fileHash.Algorithm == algorithm {
+			return fileHash, true
+		}
+	}
+	return control.FileHash{}, false
+}
+
+// If the index the IndexWriter would write out at `suitePath` (relative to
+// the Suite's dists directory) is the same as the one the `published`
+// Release lists, and every compression of it the Suite publishes is still
+// there, set the IndexWriter up to reuse those blobs rather than writing
+// new ones.
+//
+// This only encodes the entries to hash them, which is a good deal cheaper
+// than compressing them (with xz, in particular).
+func (a Archive) reuseIndex(
+	suite Suite,
+	published map[string]control.FileHashes,
+	suitePath string,
+	writer *IndexWriter,
+) (bool, error) {
+	if published == nil {
+		return false, nil
+	}
+	previous, ok := published[suitePath]
+	if !ok {
+		/* The Release may not list the uncompressed index at all */
+		var err error
+		if previous, err = a.decompressedHashes(suite, published, suitePath); err != nil || previous == nil {
+			return false, err
+		}
+	}
+
+	hashWriter, hashers, err := getHashers(writer.suite)
+	if err != nil {
+		return false, err
+	}
+	if len(hashers) == 0 {
+		return false, nil
+	}
+	if err := writer.encode(hashWriter); err != nil {
+		return false, err
+	}
+	for _, hasher := range hashers {
+		fileHash := control.FileHashFromHasher(suitePath, *hasher)
+		old, ok := findFileHash(previous, fileHash.Algorithm)
+		if !ok || old.Hash != fileHash.Hash || old.Size != fileHash.Size {
+			return false, nil
+		}
+	}
+
+	files := []*indexFile{}
+	for _, suffix := range suite.features.Compressions {
+		filePath := suitePath + suffix
+		fileHashes, ok := published[filePath]
+		if !ok {
+			return false, nil
+		}
+		for _, algorithm := range suite.features.Hashes {
+			if _, ok := findFileHash(fileHashes, algorithm); !ok {
+				return false, nil
+			}
+		}
+
+		target := path.Join("dists", suite.Name, filePath)
+		obj, err := a.Store.Lookup(target)
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if ok, err := a.publishedMatches(target, *obj, fileHashes); err != nil || !ok {
+			return false, err
+		}
+		files = append(files, &indexFile{suffix: suffix, obj: obj, reused: fileHashes})
+	}
+
+	if err := writer.Close(); err != nil {
+		return false, err
+	}
+	writer.files = files
+	writer.hashers = hashers
+	return true, nil
+}
+
+// Hash the uncompressed form of an index at `suitePath`, by decompressing
+// one of its published forms, for a Release that doesn't list it. If it
+// isn't published in any of the Suite's compressions, nil is returned.
+func (a Archive) decompressedHashes(
+	suite Suite,
+	published map[string]control.FileHashes,
+	suitePath string,
+) (control.FileHashes, error) {
+	for _, suffix := range suite.features.Compressions {
+		if _, ok := published[suitePath+suffix]; !ok || suffix == "" {
+			continue
+		}
+		fd, err := a.OpenPath(path.Join("dists", suite.Name, suitePath+suffix))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+
+		reader, err := decompress(fd)
+		if err != nil {
+			return nil, err
+		}
+		hashWriter, hashers, err := getHashers(&suite)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(hashWriter, reader); err != nil {
+			return nil, err
+		}
+
+		ret := control.FileHashes{}
+		for _, hasher := range hashers {
+			ret = append(ret, control.FileHashFromHasher(suitePath, *hasher))
+		}
+		return ret, nil
+	}
+	return nil, nil
+}
+
+// Check that what's published at `target` is still what the Release said
+// it was; if the Object ID is its SHA256, that's enough, otherwise (such as
+// on a CompressedStore) it's read back and hashed.
+func (a Archive) publishedMatches(target string, obj Object, fileHashes control.FileHashes) (bool, error) {
+	fileHash, ok := findFileHash(fileHashes, "sha256")
+	if ok && obj.ID == fileHash.Hash {
+		return true, nil
+	}
+	if !ok {
+		fileHash = fileHashes[0]
+	}
+
+	fd, err := a.Store.Open(obj)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	if err := verifyHash(target, fd, fileHash); err != nil {
+		a.warn("published index doesn't match its Release", "path", target, "error", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// Incremental Publish {{{
+
+func TestEngrossReusesUnchangedIndices(t *testing.T) {
+	a, err := New(t.TempDir(), newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := bytes.Buffer{}
+	a.SetLogger(slog.New(slog.NewTextHandler(&log, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for component, pkg := range map[string]Package{
+		"main":    newTestPackage(t, "foo", "1.0", "amd64"),
+		"contrib": newTestPackage(t, "bar", "1.0", "amd64"),
+	} {
+		c, err := suite.Component(component)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.AddPackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	/* Publish, then get the indices left alone by the next Engross */
+	publish := func() []string {
+		log.Reset()
+		files, err := a.Engross(*suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Link(files); err != nil {
+			t.Fatal(err)
+		}
+		ret := []string{}
+		for _, line := range strings.Split(log.String(), "\n") {
+			if !strings.Contains(line, `msg="index unchanged"`) {
+				continue
+			}
+			ret = append(ret, line[strings.Index(line, "path=")+len("path="):])
+		}
+		return ret
+	}
+
+	if unchanged := publish(); len(unchanged) != 0 {
+		t.Errorf("Indices reused on the first publish: %v", unchanged)
+	}
+
+	main, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := main.AddPackage(newTestPackage(t, "foo", "2.0", "amd64")); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := publish()
+	if len(unchanged) != 1 || unchanged[0] != "contrib/binary-amd64/Packages" {
+		t.Errorf("Expected only the contrib index to be reused, got %v", unchanged)
+	}
+
+	if unchanged := publish(); len(unchanged) != 2 {
+		t.Errorf("Expected every index to be reused, got %v", unchanged)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
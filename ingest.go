@@ -0,0 +1,90 @@
+package archive
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"pault.ag/go/debian/deb"
+)
+
+// Batch Ingestion {{{
+
+// Copy a batch of .deb files (by path) into the Pool, just like
+// IncludeDeb, hashing and committing up to `workers` of them at once. If
+// `workers` is less than 1, one worker per CPU is used.
+//
+// The Package entries are returned in the same order as the paths, so the
+// result is the same no matter how the work was scheduled. If any .deb
+// fails, no more are started, and the first failure (in path order) is
+// returned once the rest of the running workers are done.
+//
+// The Pool's Store must be safe for concurrent use, which every Store in
+// this package is.
+func (p Pool) IncludeDebs(component string, paths []string, workers int) ([]Package, error) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	packages := make([]Package, len(paths))
+	errs := make([]error, len(paths))
+
+	jobs := make(chan int)
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				pkg, err := p.includeDebFile(component, paths[n])
+				if err != nil {
+					errs[n] = fmt.Errorf("%s: %s", paths[n], err)
+					failOnce.Do(func() { close(failed) })
+					continue
+				}
+				packages[n] = *pkg
+			}
+		}()
+	}
+
+feed:
+	for n := range paths {
+		select {
+		case jobs <- n:
+		case <-failed:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return packages, nil
+}
+
+func (p Pool) includeDebFile(component, debPath string) (*Package, error) {
+	if p.ctx != nil {
+		if err := p.ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	debFile, closer, err := deb.LoadFile(debPath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	return p.IncludeDeb(component, *debFile)
+}
+
+// }}}
+
+// vim: foldmethod=marker
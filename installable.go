@@ -0,0 +1,248 @@
+package archive
+
+import (
+	"fmt"
+
+	"pault.ag/go/debian/dependency"
+	"pault.ag/go/debian/version"
+)
+
+// Installability {{{
+
+// Uninstallable is a Package entry whose Depends or Pre-Depends can't be
+// satisfied by anything else in the Suite, on a given Architecture.
+type Uninstallable struct {
+	Package Package
+
+	// Architecture the Package was checked on. This is only different
+	// from the Package's Architecture for "all" Packages, which are
+	// checked on every Architecture in the Suite.
+	Architecture dependency.Arch
+
+	// The first Relation that couldn't be satisfied.
+	Relation dependency.Relation
+}
+
+func (u Uninstallable) String() string {
+	relation := dependency.Dependency{Relations: []dependency.Relation{u.Relation}}
+	return fmt.Sprintf(
+		"%s %s on %s: can't satisfy '%s'",
+		u.Package.Package, u.Package.Version.String(),
+		u.Architecture.String(), relation.String(),
+	)
+}
+
+// Check that the Depends and Pre-Depends of every Package entry in the
+// Suite can be satisfied by the Suite itself, on each Architecture (those
+// declared with SetArchitectures, and any others Packages were added for),
+// returning the Package entries that can't be installed. A Suite holding
+// only "all" Packages is checked once, as "all".
+//
+// This is a quick sanity check, not a full solver: Provides are taken into
+// account, and anything depending on an uninstallable Package is itself
+// uninstallable, but Conflicts and Breaks are not considered.
+func (s Suite) CheckInstallable() ([]Uninstallable, error) {
+	arches := map[string]dependency.Arch{}
+	for _, arch := range s.Architectures() {
+		arches[arch.String()] = arch
+	}
+	archAll := false
+	s.eachPackage(func(pkg Package) {
+		if pkg.Architecture.String() == "all" {
+			archAll = true
+			return
+		}
+		arches[pkg.Architecture.String()] = pkg.Architecture
+	})
+
+	/* With nothing but "all" Packages, check them once, on their own */
+	if len(arches) == 0 && archAll {
+		all, err := dependency.ParseArch("all")
+		if err != nil {
+			return nil, err
+		}
+		arches["all"] = *all
+	}
+
+	sorted := []dependency.Arch{}
+	for _, arch := range arches {
+		sorted = append(sorted, arch)
+	}
+	sortArches(sorted)
+
+	ret := []Uninstallable{}
+	for _, arch := range sorted {
+		broken, err := s.checkInstallable(arch)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, broken...)
+	}
+	return ret, nil
+}
+
+// Something a Relation can be satisfied by; either a real Package, or a
+// Package Providing a virtual package.
+type installCandidate struct {
+	pkg     *installPackage
+	version *version.Version
+}
+
+type installPackage struct {
+	Package
+	broken bool
+}
+
+func (s Suite) checkInstallable(arch dependency.Arch) ([]Uninstallable, error) {
+	packages := []*installPackage{}
+	candidates := map[string][]installCandidate{}
+
+	var err error
+	s.eachPackage(func(pkg Package) {
+		if err != nil {
+			return
+		}
+		if pkg.Architecture.String() != "all" && !pkg.Architecture.Is(&arch) {
+			return
+		}
+
+		el := &installPackage{Package: pkg}
+		packages = append(packages, el)
+
+		ver := pkg.Version
+		candidates[pkg.Package] = append(candidates[pkg.Package], installCandidate{
+			pkg: el, version: &ver,
+		})
+
+		provides, provideErr := packageProvides(pkg)
+		if provideErr != nil {
+			err = fmt.Errorf("%s %s: %s", pkg.Package, pkg.Version.String(), provideErr)
+			return
+		}
+		for name, ver := range provides {
+			candidates[name] = append(candidates[name], installCandidate{
+				pkg: el, version: ver,
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	/* Breaking one Package may break everything depending on it, so keep
+	 * going until nothing else breaks */
+	ret := []Uninstallable{}
+	for {
+		changed := false
+		for _, pkg := range packages {
+			if pkg.broken {
+				continue
+			}
+			relation, ok := unsatisfiable(pkg.Package, arch, candidates)
+			if !ok {
+				continue
+			}
+			pkg.broken = true
+			changed = true
+			ret = append(ret, Uninstallable{
+				Package:      pkg.Package,
+				Architecture: arch,
+				Relation:     relation,
+			})
+		}
+		if !changed {
+			return ret, nil
+		}
+	}
+}
+
+// Get the virtual packages a Package Provides, along with the version
+// provided, or nil for an unversioned Provides.
+func packageProvides(pkg Package) (map[string]*version.Version, error) {
+	ret := map[string]*version.Version{}
+
+	field := pkg.Paragraph.Values["Provides"]
+	if field == "" {
+		return ret, nil
+	}
+	provides, err := dependency.Parse(field)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, possibility := range provides.GetAllPossibilities() {
+		if possibility.Version == nil {
+			ret[possibility.Name] = nil
+			continue
+		}
+		ver, err := version.Parse(possibility.Version.Number)
+		if err != nil {
+			return nil, err
+		}
+		ret[possibility.Name] = &ver
+	}
+	return ret, nil
+}
+
+// Find the first Relation in the Package's Pre-Depends or Depends that
+// nothing (that isn't already broken) can satisfy on `arch`.
+func unsatisfiable(
+	pkg Package,
+	arch dependency.Arch,
+	candidates map[string][]installCandidate,
+) (dependency.Relation, bool) {
+	relations := append(
+		append([]dependency.Relation{}, pkg.PreDepends.Relations...),
+		pkg.Depends.Relations...,
+	)
+
+	for _, relation := range relations {
+		possibilities := []dependency.Possibility{}
+		for _, possibility := range relation.Possibilities {
+			if possibility.Substvar {
+				continue
+			}
+			restriction := possibility.Architectures
+			if restriction != nil && len(restriction.Architectures) != 0 &&
+				!restriction.Matches(&arch) {
+				continue
+			}
+			possibilities = append(possibilities, possibility)
+		}
+
+		/* Nothing is needed on this arch */
+		if len(possibilities) == 0 {
+			continue
+		}
+
+		if !satisfiable(possibilities, candidates) {
+			return relation, true
+		}
+	}
+	return dependency.Relation{}, false
+}
+
+func satisfiable(
+	possibilities []dependency.Possibility,
+	candidates map[string][]installCandidate,
+) bool {
+	for _, possibility := range possibilities {
+		for _, candidate := range candidates[possibility.Name] {
+			if candidate.pkg.broken {
+				continue
+			}
+			if possibility.Version == nil {
+				return true
+			}
+			/* Unversioned Provides never satisfy a versioned Relation */
+			if candidate.version != nil && possibility.Version.SatisfiedBy(*candidate.version) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,97 @@
+package archive
+
+import (
+	"crypto"
+	"fmt"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Key Rotation {{{
+
+// Sign everything the Archive publishes with `key` too, alongside the
+// Archive's signing key. The InRelease file is clearsigned by both, and
+// Release.gpg holds a detached signature from each, so clients trusting
+// either key keep validating while they move over to the new one.
+//
+// Once every client has the new key, PromoteSigningKey makes it the only
+// key.
+func (a *Archive) AddSigningKey(key *openpgp.Entity) error {
+	if key == nil || key.PrivateKey == nil {
+		return fmt.Errorf("No private key given")
+	}
+	for _, el := range a.SigningKeys() {
+		if el.PrimaryKey.KeyId == key.PrimaryKey.KeyId {
+			return fmt.Errorf("Already signing with key %X", key.PrimaryKey.Fingerprint)
+		}
+	}
+	a.rotationKeys = append(a.rotationKeys, key)
+	return nil
+}
+
+// Make a key added with AddSigningKey the Archive's signing key, and stop
+// signing with the old one, ending the rotation. Any other keys added with
+// AddSigningKey are kept.
+func (a *Archive) PromoteSigningKey(key *openpgp.Entity) error {
+	keys := []*openpgp.Entity{}
+	found := false
+	for _, el := range a.rotationKeys {
+		if el.PrimaryKey.KeyId == key.PrimaryKey.KeyId {
+			found = true
+			continue
+		}
+		keys = append(keys, el)
+	}
+	if !found {
+		return fmt.Errorf("Key %X was never added with AddSigningKey", key.PrimaryKey.Fingerprint)
+	}
+
+	a.signingKey = key
+	a.rotationKeys = keys
+	return nil
+}
+
+// Write Release.gpg files ASCII armored, rather than as binary OpenPGP
+// packets, for Suites that haven't been set otherwise with
+// Suite.SetArmoredSignature. apt accepts either.
+func (a *Archive) SetArmoredSignatures(armored bool) {
+	a.armoredSignatures = armored
+}
+
+// Get every key the Archive signs with; the signing key first, followed by
+// any added with AddSigningKey.
+func (a Archive) SigningKeys() []*openpgp.Entity {
+	ret := []*openpgp.Entity{}
+	if a.signingKey != nil {
+		ret = append(ret, a.signingKey)
+	}
+	return append(ret, a.rotationKeys...)
+}
+
+// Get the private key each signing key signs with at `when`; its signing
+// subkey, if it has one, or the primary key otherwise.
+func (a Archive) signers(when time.Time) []*packet.PrivateKey {
+	ret := []*packet.PrivateKey{}
+	for _, entity := range a.SigningKeys() {
+		if key, ok := entity.SigningKey(when); ok && key.PrivateKey != nil {
+			ret = append(ret, key.PrivateKey)
+			continue
+		}
+		ret = append(ret, entity.PrivateKey)
+	}
+	return ret
+}
+
+// Get the packet.Config everything is signed with, pinned to `when`.
+func signatureConfig(when time.Time) *packet.Config {
+	return &packet.Config{
+		DefaultHash: crypto.SHA512,
+		Time:        func() time.Time { return when },
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
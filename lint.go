@@ -0,0 +1,276 @@
+package archive
+
+import (
+	"fmt"
+	"strings"
+
+	"pault.ag/go/debian/dependency"
+)
+
+// LintProblem {{{
+
+// LintSeverity is how seriously a LintProblem is taken. Only LintErrors
+// stop a Suite from being Engrossed.
+type LintSeverity int
+
+const (
+	LintError LintSeverity = iota
+	LintWarning
+)
+
+func (s LintSeverity) String() string {
+	switch s {
+	case LintError:
+		return "error"
+	case LintWarning:
+		return "warning"
+	}
+	return fmt.Sprintf("LintSeverity(%d)", int(s))
+}
+
+// LintProblem is something a LintCheck found wrong with a Package entry
+// in a Suite.
+type LintProblem struct {
+	Check     string
+	Severity  LintSeverity
+	Component string
+
+	Package      string
+	Version      string
+	Architecture string
+
+	Reason string
+}
+
+func (p LintProblem) Error() string {
+	return fmt.Sprintf(
+		"%s: %s %s on %s (%s): %s",
+		p.Severity, p.Package, p.Version, p.Architecture, p.Check, p.Reason,
+	)
+}
+
+// Flag a Package entry as broken, which stops the Suite from being
+// Engrossed when linting is enabled. This is intended to be returned
+// from a LintCheck.
+func LintFail(format string, args ...interface{}) *LintProblem {
+	return &LintProblem{Severity: LintError, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Flag a Package entry as suspicious, without stopping the Suite from
+// being Engrossed. This is intended to be returned from a LintCheck.
+func LintWarn(format string, args ...interface{}) *LintProblem {
+	return &LintProblem{Severity: LintWarning, Reason: fmt.Sprintf(format, args...)}
+}
+
+// LintReport is every LintProblem found in a Suite. If it contains any
+// LintErrors, it's returned as an error from Engross.
+type LintReport struct {
+	Problems []LintProblem
+}
+
+// Get only the LintProblems which are LintErrors.
+func (r LintReport) Errors() []LintProblem {
+	ret := []LintProblem{}
+	for _, problem := range r.Problems {
+		if problem.Severity == LintError {
+			ret = append(ret, problem)
+		}
+	}
+	return ret
+}
+
+func (r LintReport) Error() string {
+	errors := r.Errors()
+	if len(errors) == 0 {
+		return "No lint errors"
+	}
+	return fmt.Sprintf("%d lint error(s), first: %s", len(errors), errors[0].Error())
+}
+
+// }}}
+
+// LintCheck {{{
+
+// A LintCheck is run against every Package entry in a Suite. Returning
+// a *LintProblem (such as from LintFail or LintWarn) sets how serious the
+// problem is; any other error is treated as a LintError.
+type LintCheck func(Package) error
+
+type namedLintCheck struct {
+	name  string
+	check LintCheck
+}
+
+// The LintChecks every Suite is checked with, before any added with
+// AddLintCheck.
+var builtinLintChecks = []namedLintCheck{
+	{"required-fields", RequiredFieldsCheck},
+	{"size", SizeCheck},
+	{"description", DescriptionCheck},
+	{"filename", FilenameCheck},
+	{"provides", ProvidesCheck},
+}
+
+// Check that every field a Package entry needs is set.
+func RequiredFieldsCheck(pkg Package) error {
+	missing := []string{}
+	if pkg.Package == "" {
+		missing = append(missing, "Package")
+	}
+	if pkg.Version.Empty() {
+		missing = append(missing, "Version")
+	}
+	if pkg.Architecture.String() == "" {
+		missing = append(missing, "Architecture")
+	}
+	if pkg.Maintainer == "" {
+		missing = append(missing, "Maintainer")
+	}
+	if pkg.Filename == "" {
+		missing = append(missing, "Filename")
+	}
+	if len(missing) != 0 {
+		return LintFail("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Anything bigger than this is almost certainly a mistake.
+const lintMaxSize = 4 << 30
+
+// Check that the Size of a Package entry is believable.
+func SizeCheck(pkg Package) error {
+	if pkg.Size <= 0 {
+		return LintFail("Size is %d", pkg.Size)
+	}
+	if pkg.Size > lintMaxSize {
+		return LintWarn("Size is %d bytes", pkg.Size)
+	}
+	return nil
+}
+
+// Check that a Package entry has a Description, and that it has a
+// synopsis on the first line.
+func DescriptionCheck(pkg Package) error {
+	if strings.TrimSpace(pkg.Description) == "" {
+		return LintFail("empty Description")
+	}
+	synopsis := strings.SplitN(pkg.Description, "\n", 2)[0]
+	if strings.TrimSpace(synopsis) == "" {
+		return LintWarn("Description has no synopsis")
+	}
+	return nil
+}
+
+// Check that the Filename of a Package entry is a clean path under pool/.
+func FilenameCheck(pkg Package) error {
+	if !strings.HasPrefix(pkg.Filename, "pool/") {
+		return LintFail("Filename '%s' is outside of pool/", pkg.Filename)
+	}
+	for _, part := range strings.Split(pkg.Filename, "/") {
+		if part == "" || part == "." || part == ".." {
+			return LintFail("Filename '%s' is not a clean path", pkg.Filename)
+		}
+	}
+	return nil
+}
+
+// Check that a Package entry doesn't Provide the same name twice.
+func ProvidesCheck(pkg Package) error {
+	field := pkg.Paragraph.Values["Provides"]
+	if field == "" {
+		return nil
+	}
+	provides, err := dependency.Parse(field)
+	if err != nil {
+		return LintFail("can't parse Provides: %s", err)
+	}
+
+	seen := map[string]bool{}
+	for _, possibility := range provides.GetAllPossibilities() {
+		if seen[possibility.Name] {
+			return LintWarn("%s is Provided more than once", possibility.Name)
+		}
+		seen[possibility.Name] = true
+	}
+	return nil
+}
+
+// }}}
+
+// Suite Linting {{{
+
+// Add a LintCheck to be run against every Package entry in the Suite,
+// after the built in checks. The name is used to say which LintCheck
+// found a LintProblem.
+func (s *Suite) AddLintCheck(name string, check LintCheck) {
+	s.lintChecks = append(s.lintChecks, namedLintCheck{name: name, check: check})
+}
+
+// Lint the Suite before it's Engrossed. If any LintErrors are found, the
+// LintReport is returned from Engross as an error, and nothing is written
+// out. LintWarnings are logged, if the Archive has a Logger. Linting is
+// off by default.
+func (s *Suite) SetLint(enabled bool) {
+	s.features.Lint = enabled
+}
+
+// Run the built in LintChecks, and any added with AddLintCheck, against
+// every Package entry in the Suite.
+func (s Suite) Lint() LintReport {
+	checks := append(append([]namedLintCheck{}, builtinLintChecks...), s.lintChecks...)
+
+	report := LintReport{Problems: []LintProblem{}}
+	for _, name := range s.componentNames() {
+		component := s.components[name]
+		for _, arch := range component.arches() {
+			for _, entry := range component.packageWriters[arch].entries {
+				pkg, ok := entry.(Package)
+				if !ok {
+					continue
+				}
+				for _, check := range checks {
+					err := check.check(pkg)
+					if err == nil {
+						continue
+					}
+
+					problem := LintProblem{Severity: LintError, Reason: err.Error()}
+					if p, ok := err.(*LintProblem); ok {
+						problem = *p
+					}
+					problem.Check = check.name
+					problem.Component = name
+					problem.Package = pkg.Package
+					problem.Version = pkg.Version.String()
+					problem.Architecture = pkg.Architecture.String()
+					report.Problems = append(report.Problems, problem)
+				}
+			}
+		}
+	}
+	return report
+}
+
+// Lint the Suite if linting is enabled, logging any LintWarnings, and
+// returning the LintReport as an error if there were any LintErrors.
+func (a Archive) lintSuite(suite Suite) error {
+	if !suite.features.Lint {
+		return nil
+	}
+
+	report := suite.Lint()
+	for _, problem := range report.Problems {
+		if problem.Severity == LintWarning {
+			a.warn("lint", "suite", suite.Name, "problem", problem.Error())
+		}
+	}
+	if len(report.Errors()) != 0 {
+		return report
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,85 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Lock {{{
+
+// Returned by TryLock if another process is holding the Archive's Lock.
+var ErrLocked = errors.New("Archive is locked by another process")
+
+// Lock is an exclusive, advisory, cross-process lock on an Archive. Any
+// process doing a sequence of Engross, Link and GC against an Archive
+// should hold the Lock for the whole sequence, so that two publishers can't
+// interleave their changes to dists/, or race the garbage collector.
+type Lock struct {
+	fd *os.File
+}
+
+func (a Archive) lockPath() string {
+	return filepath.Join(a.path, ".lock")
+}
+
+func (a Archive) openLock() (*os.File, error) {
+	if a.path == "" {
+		return nil, fmt.Errorf("Archive has no local path to lock")
+	}
+	return os.OpenFile(a.lockPath(), os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// Take the Archive's Lock, waiting until any other process has released
+// it.
+func (a Archive) Lock() (*Lock, error) {
+	fd, err := a.openLock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(fd, true); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &Lock{fd: fd}, nil
+}
+
+// Take the Archive's Lock, or return ErrLocked right away if another
+// process is holding it.
+func (a Archive) TryLock() (*Lock, error) {
+	fd, err := a.openLock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(fd, false); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &Lock{fd: fd}, nil
+}
+
+// Release the Lock.
+func (l *Lock) Unlock() error {
+	if err := unlockFile(l.fd); err != nil {
+		l.fd.Close()
+		return err
+	}
+	return l.fd.Close()
+}
+
+// Run `fn` while holding the Archive's Lock.
+func (a Archive) WithLock(fn func() error) error {
+	lock, err := a.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return fn()
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package archive
+
+import (
+	"fmt"
+	"os"
+)
+
+func lockFile(fd *os.File, wait bool) error {
+	return fmt.Errorf("Archive locking is not supported on this platform")
+}
+
+func unlockFile(fd *os.File) error {
+	return nil
+}
@@ -0,0 +1,39 @@
+package archive
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logging {{{
+
+// Set the logger the Archive (and its Pool) emit structured events to,
+// such as indices being written, Release files being signed, or blobs
+// being removed by GC. By default, nothing is logged.
+func (a *Archive) SetLogger(logger *slog.Logger) {
+	a.logger = logger
+	a.Pool.logger = logger
+}
+
+func logEvent(logger *slog.Logger, level slog.Level, msg string, args ...interface{}) {
+	if logger == nil {
+		return
+	}
+	logger.Log(context.Background(), level, msg, args...)
+}
+
+func (a Archive) info(msg string, args ...interface{}) {
+	logEvent(a.logger, slog.LevelInfo, msg, args...)
+}
+
+func (a Archive) debug(msg string, args ...interface{}) {
+	logEvent(a.logger, slog.LevelDebug, msg, args...)
+}
+
+func (a Archive) warn(msg string, args ...interface{}) {
+	logEvent(a.logger, slog.LevelWarn, msg, args...)
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,190 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore {{{
+
+// MemoryStore is a Store kept entirely in memory, which is mostly useful
+// to check what an Archive would publish (indices, Release files and their
+// signatures) without touching the filesystem.
+type MemoryStore struct {
+	lock  sync.Mutex
+	blobs map[string]memoryBlob
+	links map[string]string
+}
+
+type memoryBlob struct {
+	data      []byte
+	committed time.Time
+}
+
+// Create a new, empty, MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		blobs: map[string]memoryBlob{},
+		links: map[string]string{},
+	}
+}
+
+type memoryWriter struct {
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("Write to a closed Writer")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func (s *MemoryStore) Create() (Writer, error) {
+	return &memoryWriter{}, nil
+}
+
+func (s *MemoryStore) Commit(writer Writer) (*Object, error) {
+	w, ok := writer.(*memoryWriter)
+	if !ok {
+		return nil, fmt.Errorf("Writer was not created by a MemoryStore")
+	}
+	w.Close()
+
+	data := w.buf.Bytes()
+	obj := Object{ID: fmt.Sprintf("%x", sha256.Sum256(data))}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.blobs[obj.ID]; !ok {
+		s.blobs[obj.ID] = memoryBlob{data: data, committed: time.Now()}
+	}
+	return &obj, nil
+}
+
+func (s *MemoryStore) Open(obj Object) (io.ReadCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	blob, ok := s.blobs[obj.ID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(blob.data)), nil
+}
+
+func (s *MemoryStore) Stat(obj Object) (*ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	blob, ok := s.blobs[obj.ID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &ObjectInfo{
+		Object:  obj,
+		Size:    int64(len(blob.data)),
+		ModTime: blob.committed,
+	}, nil
+}
+
+func (s *MemoryStore) Link(obj Object, target string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.blobs[obj.ID]; !ok {
+		return fmt.Errorf("No such blob: '%s'", obj.ID)
+	}
+	s.links[strings.TrimPrefix(target, "/")] = obj.ID
+	return nil
+}
+
+func (s *MemoryStore) Unlink(target string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	target = strings.TrimPrefix(target, "/")
+	if _, ok := s.links[target]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.links, target)
+	return nil
+}
+
+func (s *MemoryStore) Lookup(target string) (*Object, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id, ok := s.links[strings.TrimPrefix(target, "/")]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &Object{ID: id}, nil
+}
+
+func (s *MemoryStore) List(prefix string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	ret := []string{}
+	for target := range s.links {
+		if strings.HasPrefix(target, prefix) {
+			ret = append(ret, target)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s *MemoryStore) garbage() []Object {
+	linked := map[string]bool{}
+	for _, id := range s.links {
+		linked[id] = true
+	}
+
+	ret := []Object{}
+	for id := range s.blobs {
+		if !linked[id] {
+			ret = append(ret, Object{ID: id})
+		}
+	}
+	return ret
+}
+
+func (s *MemoryStore) Garbage() ([]Object, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.garbage(), nil
+}
+
+func (s *MemoryStore) GC() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, obj := range s.garbage() {
+		delete(s.blobs, obj.ID)
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,426 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+
+	"pault.ag/go/debian/control"
+)
+
+// Mirror {{{
+
+// Mirror copies Suites from a Remote (such as a Debian mirror) into an
+// Archive, so that they can be published (or filtered, merged, and so on)
+// as if they'd been built here. Every request is made through the Remote,
+// with its RetryPolicy and rate limit.
+type Mirror struct {
+	archive *Archive
+	remote  *Remote
+	keyring openpgp.EntityList
+	workers int
+}
+
+// Create a Mirror, copying from `remote` into the Archive.
+func (a *Archive) Mirror(remote *Remote) *Mirror {
+	return &Mirror{archive: a, remote: remote}
+}
+
+// Set the keyring the Remote's InRelease files must be signed by. If no
+// keyring is set, the Release files are used without checking any
+// signature at all.
+func (m *Mirror) SetKeyring(keyring openpgp.EntityList) {
+	m.keyring = keyring
+}
+
+// Set how many pool files are downloaded at once; one per CPU if `workers`
+// is less than 1, which is the default.
+func (m *Mirror) SetWorkers(workers int) {
+	m.workers = workers
+}
+
+// Copy each of the named Suites (such as "bookworm") from the Remote, just
+// like Archive.Import does from the filesystem.
+//
+// Every index is checked against the Release, and every pool file against
+// its index, before anything is added to the returned Suites. If the
+// Remote has a cache (see Remote.SetCache), the Release and indices are
+// only downloaded if they've changed since the last Sync. Pool files
+// are downloaded a few at a time (see SetWorkers), each committed to the
+// Pool as soon as it's been checked, in whatever order they finish in;
+// files already in the Pool (with the same hash) aren't downloaded again,
+// so a Sync that was interrupted picks up where it left off.
+//
+// The returned Suites aren't published until they're Engrossed and Linked.
+func (m Mirror) Sync(suites ...string) ([]*Suite, error) {
+	return m.SyncContext(context.Background(), suites...)
+}
+
+// Sync, stopping once `ctx` is done.
+func (m Mirror) SyncContext(ctx context.Context, suites ...string) ([]*Suite, error) {
+	if len(suites) == 0 {
+		return nil, fmt.Errorf("At least one suite is required")
+	}
+
+	tmpdir, err := os.MkdirTemp("", "archive-mirror-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	/* Copy with ctx, but hand back Suites of the caller's Archive */
+	archive := m.archive
+	ctxArchive := m.archive.withContext(ctx)
+	m.archive = &ctxArchive
+
+	ret := []*Suite{}
+	for _, name := range suites {
+		suite, err := m.syncSuite(ctx, tmpdir, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		suite.archive = archive
+		ret = append(ret, suite)
+	}
+	return ret, nil
+}
+
+// Compressions of an index a Mirror will fetch, smallest first. Only the
+// ones LoadPackages and LoadSources can read are tried.
+var mirrorCompressions = []string{".xz", ".gz", ""}
+
+func (m Mirror) syncSuite(ctx context.Context, tmpdir string, name string) (*Suite, error) {
+	dir := path.Join("dists", name)
+	release, err := m.release(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	suite, err := m.archive.suiteFromRelease(name, *release)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := release.Indices()
+	bases := []string{}
+	for filename := range indices {
+		base := stripCompression(filename)
+		kind := path.Base(base)
+		if kind != "Packages" && kind != "Sources" {
+			continue
+		}
+		if !slices.Contains(release.Components, path.Dir(path.Dir(base))) {
+			continue
+		}
+		if !slices.Contains(bases, base) {
+			bases = append(bases, base)
+		}
+	}
+	slices.Sort(bases)
+
+	/* Every pool file is fetched before anything is added to the Suite,
+	 * so that a Suite is never returned with half its files missing */
+	pending := []mirrorEntry{}
+	files := map[string]control.FileHash{}
+	for _, base := range bases {
+		entries, err := m.syncIndex(tmpdir, dir, base, indices)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			for target, hash := range entry.files() {
+				if err := checkPoolPath(target); err != nil {
+					return nil, err
+				}
+				files[target] = hash
+			}
+		}
+		pending = append(pending, entries...)
+	}
+
+	if err := m.fetchPoolFiles(ctx, tmpdir, files); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range pending {
+		component, err := suite.Component(entry.component)
+		if err != nil {
+			return nil, err
+		}
+		if entry.pkg != nil {
+			/* "all" Packages are often listed in every Architecture's index */
+			if component.hasEntry(entry.pkg.Architecture, *entry.pkg) {
+				continue
+			}
+			err = component.AddPackage(*entry.pkg)
+		} else {
+			err = component.AddSource(*entry.src)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.archive.info("suite mirrored", "suite", name, "remote", m.remote.URL(""), "files", len(files))
+	return suite, nil
+}
+
+// Fetch the Release for the Suite in `dir`; the InRelease, checked against
+// the keyring, if there is one, or the Release if not.
+func (m Mirror) release(dir string) (*Release, error) {
+	if m.keyring == nil {
+		fd, err := m.remote.Open(path.Join(dir, "Release"))
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		return LoadInRelease(fd, nil)
+	}
+
+	fd, err := m.remote.Open(path.Join(dir, "InRelease"))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return LoadInRelease(fd, &m.keyring)
+}
+
+// A single Package or Source entry from the Remote, waiting on its pool
+// files before it's added to its Component.
+type mirrorEntry struct {
+	component string
+	pkg       *Package
+	src       *Source
+}
+
+// Get every pool file the entry needs, with the hash to check it against.
+func (e mirrorEntry) files() map[string]control.FileHash {
+	if e.pkg != nil {
+		hash, _ := packageFileHash(*e.pkg)
+		return map[string]control.FileHash{e.pkg.Filename: hash}
+	}
+	ret := map[string]control.FileHash{}
+	for filename, hash := range sourceFileHashes(*e.src) {
+		ret[path.Join(e.src.Directory, filename)] = hash
+	}
+	return ret
+}
+
+// Download the index `base` (relative to `dir`), in the first compression
+// the Release lists that's there, and read every entry out of it.
+func (m Mirror) syncIndex(
+	tmpdir string,
+	dir string,
+	base string,
+	indices map[string]control.FileHashes,
+) ([]mirrorEntry, error) {
+	for _, ext := range mirrorCompressions {
+		hashes, ok := indices[base+ext]
+		if !ok || len(hashes) == 0 {
+			continue
+		}
+		indexPath := path.Join(dir, base+ext)
+		dest, err := mirrorTempFile(tmpdir, indexPath)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(dest)
+
+		err = m.fetchIndex(indexPath, dest)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hash := range hashes {
+			fd, err := os.Open(dest)
+			if err != nil {
+				return nil, err
+			}
+			err = verifyHash(indexPath, fd, hash)
+			fd.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return readMirrorIndex(dest, indexPath, path.Dir(path.Dir(base)))
+	}
+	/* apt is fine with an index that's listed but not there, and so
+	 * is Verify */
+	return nil, nil
+}
+
+// Fetch an index to `dest`. This goes through the Remote's cache (if it
+// has one), so an index that hasn't changed since the last Sync isn't
+// downloaded again.
+func (m Mirror) fetchIndex(indexPath string, dest string) error {
+	in, err := m.remote.Open(indexPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func readMirrorIndex(fsPath string, indexPath string, component string) ([]mirrorEntry, error) {
+	fd, err := os.Open(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	ret := []mirrorEntry{}
+	if path.Base(stripCompression(indexPath)) == "Sources" {
+		sources, err := LoadSources(fd)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			src, err := sources.Next()
+			if err == io.EOF {
+				return ret, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", indexPath, err)
+			}
+			ret = append(ret, mirrorEntry{component: component, src: src})
+		}
+	}
+
+	packages, err := LoadPackages(fd)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", indexPath, err)
+		}
+		if _, ok := packageFileHash(*pkg); !ok {
+			return nil, fmt.Errorf("%s: %s %s has no checksums", indexPath, pkg.Package, pkg.Version)
+		}
+		ret = append(ret, mirrorEntry{component: component, pkg: pkg})
+	}
+}
+
+// Download every pool file in `files` that isn't already in the Pool, a
+// few at a time, returning the first error any of them hit.
+func (m Mirror) fetchPoolFiles(ctx context.Context, tmpdir string, files map[string]control.FileHash) error {
+	targets := []string{}
+	for target := range files {
+		targets = append(targets, target)
+	}
+	slices.Sort(targets)
+
+	workers := m.workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan string)
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range queue {
+				if err := m.fetchPoolFile(tmpdir, target, files[target]); err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					lock.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+
+queue:
+	for _, target := range targets {
+		select {
+		case queue <- target:
+		case <-ctx.Done():
+			break queue
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// Download a single pool file, check it, and commit it to the Pool at
+// `target`; run by each of the workers.
+func (m Mirror) fetchPoolFile(tmpdir string, target string, hash control.FileHash) error {
+	if ok, err := m.archive.Pool.hasFile(target, hash); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	dest, err := mirrorTempFile(tmpdir, target)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dest)
+	if err := m.remote.Download(target, dest, hash); err != nil {
+		return err
+	}
+
+	obj, err := m.archive.Pool.Copy(dest)
+	if err != nil {
+		return err
+	}
+	if err := m.archive.Store.Link(*obj, target); err != nil {
+		return err
+	}
+	m.archive.debug("mirrored", "path", target, "object", obj.ID)
+	return nil
+}
+
+// Create an empty file in `tmpdir` to download `target` to, named after
+// it, but unique, so that no two downloads ever share one.
+func mirrorTempFile(tmpdir string, target string) (string, error) {
+	fd, err := os.CreateTemp(tmpdir, strings.ReplaceAll(path.Base(target), "*", "_")+".*")
+	if err != nil {
+		return "", err
+	}
+	return fd.Name(), fd.Close()
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,167 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// PublishEvent {{{
+
+// PublishEvent describes a successful Link, for passing to each
+// PublishHook.
+type PublishEvent struct {
+	Time time.Time `json:"time"`
+
+	// Every path that was added or now points to a different blob, sorted.
+	// Paths linked to the very same blob as before aren't included.
+	Changed []string `json:"changed"`
+
+	// Each Suite (or Snapshot) whose Release was linked.
+	Suites []PublishedSuite `json:"suites"`
+}
+
+// PublishedSuite summarizes a Suite (or Snapshot) published by a Link, as
+// read back from its new Release file.
+type PublishedSuite struct {
+	// Path of the Suite under dists, such as "unstable".
+	Name string `json:"name"`
+
+	Date          string   `json:"date"`
+	ValidUntil    string   `json:"valid_until,omitempty"`
+	Components    []string `json:"components"`
+	Architectures []string `json:"architectures"`
+
+	// How many paths under the Suite changed.
+	Changed int `json:"changed"`
+}
+
+// }}}
+
+// PublishHook {{{
+
+// A PublishHook is run after every successful Link, such as to purge a
+// CDN, notify a chat channel or trigger mirrors. By the time it's run, the
+// publish is done; errors are logged (if the Archive has a Logger), and
+// don't stop any other PublishHook from running.
+type PublishHook func(PublishEvent) error
+
+type namedPublishHook struct {
+	name string
+	hook PublishHook
+}
+
+// Register a PublishHook to be run after every successful Link, in the
+// order they were added. The `name` is used when logging failures.
+func (a *Archive) AddPublishHook(name string, hook PublishHook) {
+	a.publishHooks = append(a.publishHooks, namedPublishHook{name: name, hook: hook})
+}
+
+// Create a PublishHook which POSTs the PublishEvent, as JSON, to `url`.
+// Any response other than a 2xx is treated as a failure.
+func WebhookPublishHook(url string) PublishHook {
+	return func(event PublishEvent) error {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("Webhook %s returned %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// Build the PublishEvent for a Link of `blobs`, given what each path was
+// linked to before, and run every PublishHook with it.
+func (a Archive) notifyPublish(blobs ArchiveState, previous map[string]*Object) {
+	if len(a.publishHooks) == 0 {
+		return
+	}
+
+	event, err := a.publishEvent(blobs, previous)
+	if err != nil {
+		a.warn("publish hooks skipped", "error", err)
+		return
+	}
+
+	for _, hook := range a.publishHooks {
+		if err := hook.hook(*event); err != nil {
+			a.warn("publish hook failed", "hook", hook.name, "error", err)
+		}
+	}
+}
+
+func (a Archive) publishEvent(blobs ArchiveState, previous map[string]*Object) (*PublishEvent, error) {
+	event := PublishEvent{
+		Time:    time.Now().UTC(),
+		Changed: []string{},
+		Suites:  []PublishedSuite{},
+	}
+
+	targets := linkOrder(blobs)
+	for _, target := range targets {
+		if before := previous[target]; before == nil || before.ID != blobs[target].ID {
+			event.Changed = append(event.Changed, target)
+		}
+	}
+
+	for _, target := range targets {
+		if !isSuiteRelease(target) {
+			continue
+		}
+
+		fd, err := a.Store.Open(blobs[target])
+		if err != nil {
+			return nil, err
+		}
+		release, err := LoadInRelease(fd, nil)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		dir := path.Dir(target)
+		suite := PublishedSuite{
+			Name:          strings.TrimPrefix(dir, "dists/"),
+			Date:          release.Date,
+			ValidUntil:    release.ValidUntil,
+			Components:    release.Components,
+			Architectures: []string{},
+		}
+		for _, arch := range release.Architectures {
+			suite.Architectures = append(suite.Architectures, arch.String())
+		}
+		for _, el := range event.Changed {
+			if strings.HasPrefix(el, dir+"/") {
+				suite.Changed++
+			}
+		}
+		event.Suites = append(event.Suites, suite)
+	}
+	return &event, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,208 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// OpenSuite {{{
+
+// Get a handle to write a given Suite from an Archive, seeded with what's
+// currently published for it, so that it can be changed and published
+// again without rebuilding every index from scratch.
+//
+// The Suite gets the Description, Origin, Label and Version of its
+// published Release, and a Component for each Component it lists, holding
+// every Package and Source entry of its indices, and its Translations. The
+// entries are read back as they were published; nothing is added to the
+// audit log, and pool files are left where they are. DEP11 metadata isn't
+// read back, and nor are any settings (such as Hashes or Compressions)
+// that aren't in the Release; set them again before publishing.
+//
+// If the Suite has never been published, the error satisfies
+// os.IsNotExist.
+func (a *Archive) OpenSuite(name string) (*Suite, error) {
+	dir := path.Join("dists", name)
+	fd, err := a.OpenPath(path.Join(dir, "Release"))
+	if err != nil {
+		return nil, err
+	}
+	release, err := LoadInRelease(fd, nil)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	suite, err := a.suiteFromRelease(name, *release)
+	if err != nil {
+		return nil, err
+	}
+	indices := release.Indices()
+
+	for _, base := range releaseEntryIndices(*release) {
+		component, err := suite.Component(path.Dir(path.Dir(base)))
+		if err != nil {
+			return nil, err
+		}
+		fd, err := a.openIndex(dir, base, indices)
+		if err != nil {
+			return nil, err
+		}
+		if fd == nil {
+			continue
+		}
+
+		switch path.Base(base) {
+		case "Packages":
+			err = openPackages(fd, component)
+		case "Sources":
+			err = openSources(fd, component)
+		}
+		fd.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path.Join(dir, base), err)
+		}
+	}
+
+	if err := a.openTranslations(suite, *release); err != nil {
+		return nil, err
+	}
+
+	a.info("suite opened", "suite", name)
+	return suite, nil
+}
+
+// Open whichever compression of the index `base` (relative to `dir`) is
+// published, or return nil if none of them are.
+func (a Archive) openIndex(
+	dir string,
+	base string,
+	indices map[string]control.FileHashes,
+) (io.ReadCloser, error) {
+	for _, ext := range indexCompressions {
+		if _, ok := indices[base+ext]; !ok {
+			continue
+		}
+		fd, err := a.OpenPath(path.Join(dir, base+ext))
+		if os.IsNotExist(err) {
+			continue
+		}
+		return fd, err
+	}
+	return nil, nil
+}
+
+func openPackages(fd io.Reader, component *Component) error {
+	packages, err := LoadPackages(fd)
+	if err != nil {
+		return err
+	}
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		/* "all" Packages may be listed in every Architecture's index */
+		if component.hasEntry(pkg.Architecture, *pkg) {
+			continue
+		}
+		writer, err := component.getWriter(pkg.Architecture)
+		if err != nil {
+			return err
+		}
+		if err := writer.Add(*pkg); err != nil {
+			return err
+		}
+	}
+}
+
+func openSources(fd io.Reader, component *Component) error {
+	sources, err := LoadSources(fd)
+	if err != nil {
+		return err
+	}
+	for {
+		src, err := sources.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if component.sourceWriter == nil {
+			writer, err := newIndexWriter(component.suite)
+			if err != nil {
+				return err
+			}
+			component.sourceWriter = writer
+		}
+		if err := component.sourceWriter.Add(*src); err != nil {
+			return err
+		}
+	}
+}
+
+// Read every published "<component>/i18n/Translation-<lang>" of the
+// Release's Components back into the Suite.
+func (a Archive) openTranslations(suite *Suite, release Release) error {
+	dir := path.Join("dists", suite.Name)
+	indices := release.Indices()
+
+	bases := []string{}
+	for filename := range indices {
+		base := stripCompression(filename)
+		if !strings.HasPrefix(path.Base(base), "Translation-") || slices.Contains(bases, base) {
+			continue
+		}
+		if path.Base(path.Dir(base)) != "i18n" {
+			continue
+		}
+		if !slices.Contains(release.Components, path.Dir(path.Dir(base))) {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	slices.Sort(bases)
+
+	for _, base := range bases {
+		component, err := suite.Component(path.Dir(path.Dir(base)))
+		if err != nil {
+			return err
+		}
+		fd, err := a.openIndex(dir, base, indices)
+		if err != nil {
+			return err
+		}
+		if fd == nil {
+			continue
+		}
+
+		buf := bytes.Buffer{}
+		reader, err := decompress(fd)
+		if err == nil {
+			_, err = io.Copy(&buf, reader)
+		}
+		fd.Close()
+		if err != nil {
+			return err
+		}
+		component.translations[strings.TrimPrefix(path.Base(base), "Translation-")] = buf.Bytes()
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
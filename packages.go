@@ -21,19 +21,18 @@
 package archive
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"iter"
 	"os"
 	"strconv"
-
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"hash"
+	"strings"
 
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/deb"
 	"pault.ag/go/debian/dependency"
+	"pault.ag/go/debian/transput"
 	"pault.ag/go/debian/version"
 )
 
@@ -78,43 +77,55 @@ type Package struct {
 // .deb Control file into the Package entry, and set information as to
 // the location of the file, the size of the file, and hash the file.
 func PackageFromDeb(debFile deb.Deb) (*Package, error) {
-	pkg := Package{}
-
-	paragraph := debFile.Control.Paragraph
-	paragraph.Set("Filename", debFile.Path)
-	/* Now, let's do some magic */
-
 	fd, err := os.Open(debFile.Path)
 	if err != nil {
 		return nil, err
 	}
-	stat, err := fd.Stat()
+	defer fd.Close()
+
+	/* Right, now, in addition, we ought to hash the crap out of the file */
+	writer, hashers, err := newHashers(poolHashes)
 	if err != nil {
 		return nil, err
 	}
 
-	paragraph.Set("Size", strconv.Itoa(int(stat.Size())))
-	/* Right, now, in addition, we ought to hash the crap out of the file */
+	if _, err := io.Copy(writer, fd); err != nil {
+		return nil, err
+	}
 
-	md5sum := md5.New()
-	sha1 := sha1.New()
-	sha256 := sha256.New()
+	return packageFromHashers(debFile, debFile.Path, hashers)
+}
 
-	writer := io.MultiWriter(md5sum, sha256, sha1)
+// Names of the Package fields each hash algorithm is written to.
+var packageHashFields = map[string]string{
+	"md5":    "MD5sum",
+	"sha1":   "SHA1",
+	"sha256": "SHA256",
+	"sha512": "SHA512",
+}
 
-	if _, err := io.Copy(writer, fd); err != nil {
-		return nil, err
+// Create a Package entry from the deb.Deb's Control file, setting the
+// Filename to `filename`, and the Size and hashes from the Hashers the .deb
+// was written through. The deb.Deb's Control is left untouched.
+func packageFromHashers(debFile deb.Deb, filename string, hashers []*transput.Hasher) (*Package, error) {
+	pkg := Package{}
+
+	paragraph := control.Paragraph{Values: map[string]string{}, Order: []string{}}
+	for _, key := range debFile.Control.Paragraph.Order {
+		paragraph.Set(key, debFile.Control.Paragraph.Values[key])
 	}
 
-	for key, hasher := range map[string]hash.Hash{
-		"MD5sum": md5sum,
-		"SHA1":   sha1,
-		"SHA256": sha256,
-	} {
-		paragraph.Set(key, fmt.Sprintf("%x", hasher.Sum(nil)))
+	paragraph.Set("Filename", filename)
+	for _, hasher := range hashers {
+		field, ok := packageHashFields[hasher.Name()]
+		if !ok {
+			return nil, fmt.Errorf("No known hash: '%s'", hasher.Name())
+		}
+		paragraph.Set("Size", strconv.Itoa(int(hasher.Size())))
+		paragraph.Set(field, fmt.Sprintf("%x", hasher.Sum(nil)))
 	}
 
-	return &pkg, control.UnpackFromParagraph(debFile.Control.Paragraph, &pkg)
+	return &pkg, control.UnpackFromParagraph(paragraph, &pkg)
 }
 
 // }}}
@@ -127,6 +138,12 @@ func PackageFromDeb(debFile deb.Deb) (*Package, error) {
 // apt repo. This contians information about the binary Debian packages.
 type Packages struct {
 	decoder *control.Decoder
+	closer  io.Closer
+
+	/* Only set for Packages iterators from LoadPackagesFields */
+	reader          *bufio.Reader
+	fields          map[string]bool
+	fullDescription bool
 }
 
 // Map {{{
@@ -159,12 +176,62 @@ func (p *Packages) Map(q func(*Package) bool) ([]Package, error) {
 // Get the next Package entry in the Packages list. This will return an
 // io.EOF at the last entry.
 func (p *Packages) Next() (*Package, error) {
+	if p.fields != nil {
+		return p.nextFields()
+	}
 	next := Package{}
 	return &next, p.decoder.Decode(&next)
 }
 
 // }}}
 
+// All {{{
+
+// Get an iterator over the rest of the Package entries in the Packages list,
+// for use with range:
+//
+//	for pkg, err := range packages.All() {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// Iteration stops after the first error is yielded. Reaching the end of
+// the list is not an error.
+func (p *Packages) All() iter.Seq2[*Package, error] {
+	return func(yield func(*Package, error) bool) {
+		for {
+			pkg, err := p.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(pkg, nil) {
+				return
+			}
+		}
+	}
+}
+
+// }}}
+
+// Close {{{
+
+// Close the underlying file, if this Packages iterator was created by
+// LoadPackagesFile. This is a no-op otherwise.
+func (p *Packages) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// }}}
+
 // LoadPackagesFile {{{
 
 // Given a path, create a Packages iterator. Note that the Packages
@@ -175,7 +242,13 @@ func LoadPackagesFile(path string) (*Packages, error) {
 	if err != nil {
 		return nil, err
 	}
-	return LoadPackages(fd)
+	ret, err := LoadPackages(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	ret.closer = fd
+	return ret, nil
 }
 
 // }}}
@@ -185,8 +258,16 @@ func LoadPackagesFile(path string) (*Packages, error) {
 // Given an io.Reader, create a Packages iterator. Note that the Packages
 // file is not OpenPGP signed, so one will need to verify the integrety
 // of this file from the InRelease file before trusting any output.
+//
+// The data may be gzip, xz or zstd compressed (as published in dists/), or
+// uncompressed.
 func LoadPackages(in io.Reader) (*Packages, error) {
-	decoder, err := control.NewDecoder(in, nil)
+	reader, err := decompress(in)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := control.NewDecoder(reader, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -195,6 +276,132 @@ func LoadPackages(in io.Reader) (*Packages, error) {
 
 // }}}
 
+// LoadPackagesFields {{{
+
+// Fields of a Package entry that are always decoded by LoadPackagesFields,
+// since a Package isn't valid without them.
+var requiredPackageFields = []string{
+	"Package", "Version", "Architecture", "Maintainer", "Description",
+	"Filename", "Size",
+}
+
+// Given an io.Reader, create a Packages iterator which only decodes the
+// named fields (along with the fields every Package entry requires), for
+// scanning very large Packages files without holding on to everything in
+// them.
+//
+// Entries returned by this iterator have an empty Paragraph, and unless
+// "Description" is named, only the first line (the synopsis) of the
+// Description is kept.
+func LoadPackagesFields(in io.Reader, fields ...string) (*Packages, error) {
+	reader, err := decompress(in)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := Packages{reader: bufio.NewReader(reader), fields: map[string]bool{}}
+	for _, field := range requiredPackageFields {
+		ret.fields[strings.ToLower(field)] = true
+	}
+	for _, field := range fields {
+		ret.fields[strings.ToLower(field)] = true
+		if strings.EqualFold(field, "Description") {
+			ret.fullDescription = true
+		}
+	}
+	return &ret, nil
+}
+
+// Given a path, create a Packages iterator which only decodes the named
+// fields, just like LoadPackagesFields.
+func LoadPackagesFileFields(path string, fields ...string) (*Packages, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := LoadPackagesFields(fd, fields...)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	ret.closer = fd
+	return ret, nil
+}
+
+func (p *Packages) nextFields() (*Package, error) {
+	paragraph, err := p.readFields()
+	if err != nil {
+		return nil, err
+	}
+
+	next := Package{}
+	if err := control.UnpackFromParagraph(*paragraph, &next); err != nil {
+		return nil, err
+	}
+	next.Paragraph = control.Paragraph{}
+	return &next, nil
+}
+
+// Read the next paragraph, keeping only the fields the iterator was asked
+// for. Continuation lines of every other field are thrown away as they're
+// read, rather than being stored.
+func (p *Packages) readFields() (*control.Paragraph, error) {
+	paragraph := control.Paragraph{Values: map[string]string{}, Order: []string{}}
+	key := ""
+	keep := false
+	synopsis := false
+
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == io.EOF && line == "" {
+			if len(paragraph.Order) == 0 {
+				return nil, io.EOF
+			}
+			return &paragraph, nil
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(paragraph.Order) != 0 || key != "" {
+				return &paragraph, nil
+			}
+		case strings.HasPrefix(line, "#"):
+		case line[0] == ' ' || line[0] == '\t':
+			if key == "" {
+				return nil, fmt.Errorf("Continuation line without a field: '%s'", line)
+			}
+			if keep && !synopsis {
+				paragraph.Values[key] += "\n" + line
+			}
+		default:
+			i := strings.Index(line, ":")
+			if i == -1 {
+				return nil, fmt.Errorf("Malformed field: '%s'", line)
+			}
+			key = line[:i]
+			lower := strings.ToLower(key)
+			keep = p.fields[lower]
+			synopsis = lower == "description" && !p.fullDescription
+			if keep {
+				paragraph.Set(key, strings.TrimSpace(line[i+1:]))
+			}
+		}
+
+		if err == io.EOF {
+			if len(paragraph.Order) == 0 {
+				return nil, io.EOF
+			}
+			return &paragraph, nil
+		}
+	}
+}
+
+// }}}
+
 // }}}
 
 // vim: foldmethod=marker
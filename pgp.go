@@ -0,0 +1,39 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// OpenPGP {{{
+
+// Read an OpenPGP clearsigned document, and check its signature against
+// the keyring, returning the signed text, and the Entity that signed it.
+//
+// The control package can only check signatures against the (frozen)
+// golang.org/x/crypto keyrings, so signatures are checked here instead,
+// and only the signed text is handed off to be decoded.
+func readClearsigned(in io.Reader, keyring openpgp.EntityList) ([]byte, *openpgp.Entity, error) {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("Not OpenPGP clearsigned")
+	}
+
+	signer, err := block.VerifySignature(keyring, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block.Plaintext, signer, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -1,97 +1,295 @@
 package archive
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 
-	"pault.ag/go/blobstore"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/deb"
+	"pault.ag/go/debian/transput"
+	"pault.ag/go/debian/version"
 )
 
 type Pool struct {
-	Store blobstore.Store
+	Store Store
+
+	ctx        context.Context
+	logger     *slog.Logger
+	dedup      *poolDedup
+	debKeyring openpgp.EntityList
+}
+
+// Get a copy of the Pool which makes every Store operation with `ctx`,
+// and stops copying files into the Store once `ctx` is done.
+func (p Pool) WithContext(ctx context.Context) Pool {
+	p.ctx = ctx
+	p.Store = storeWithContext(p.Store, ctx)
+	return p
 }
 
+// Hashes computed for each file included into the Pool, as needed to
+// write out the Package entry.
+var poolHashes = []string{"md5", "sha1", "sha256"}
+
+// Get the directory (relative to the component's pool directory) that
+// a given source package's files live in. Most source packages are kept
+// in a directory named after the first letter of the source, except for
+// libraries, which are split out by the first four letters ("libf/libfoo").
+// An empty source has no directory.
 func poolPrefix(source string) string {
+	if source == "" {
+		return ""
+	}
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		return path.Join(source[0:4], source)
+	}
 	return path.Join(source[0:1], source)
 }
 
-func (p Pool) Copy(path string) (*blobstore.Object, error) {
+// Package and source names, as Debian Policy allows them: lowercase
+// letters, digits, "+", "-" and ".", starting with a letter or digit, and
+// at least two long.
+var packageName = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+
+// Check that `name` is a valid package or source name, so that it's safe
+// to build a pool path out of it.
+func checkPackageName(kind, name string) error {
+	if !packageName.MatchString(name) {
+		return fmt.Errorf("Invalid %s name: '%s'", kind, name)
+	}
+	return nil
+}
+
+// Filenames in the pool never contain the epoch, since it'd render as
+// a ":" in the path.
+func poolVersion(v version.Version) string {
+	if v.Revision == "" {
+		return v.Version
+	}
+	return fmt.Sprintf("%s-%s", v.Version, v.Revision)
+}
+
+func (p Pool) Copy(path string) (*Object, error) {
+	obj, _, err := p.copyHashed(path, []string{})
+	return obj, err
+}
+
+// Copy the file at `path` into the Store, hashing the file with each
+// of the named algorithms as it's written.
+func (p Pool) copyHashed(path string, algorithms []string) (*Object, []*transput.Hasher, error) {
 	fd, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer fd.Close()
 
 	writer, err := p.Store.Create()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer writer.Close()
 
-	if _, err := io.Copy(writer, fd); err != nil {
-		return nil, err
+	hashWriter, hashers, err := newHashers(algorithms)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	obj, err := p.Store.Commit(*writer)
+	var reader io.Reader = fd
+	if p.ctx != nil {
+		reader = contextReader{ctx: p.ctx, reader: fd}
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writer, hashWriter), reader); err != nil {
+		return nil, nil, err
+	}
+
+	obj, err := p.Store.Commit(writer)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return obj, nil
+	return obj, hashers, nil
 }
 
-func (p Pool) IncludeSources(dsc *control.DSC) (string, map[string]blobstore.Object, error) {
-	files := map[string]blobstore.Object{}
+// Copy a .dsc, and all the files it references, into the Pool, under the
+// canonical directory for its Component and source package (such as
+// "pool/main/f/foo/"), and return the Source entry for it, ready to be
+// added to the Component.
+//
+// Files that already exist in the Pool with the same checksum (such as
+// the orig tarball shared between Debian revisions) are not copied again.
+// If a file exists with a different checksum, this will return an error,
+// as will a .dsc whose Source isn't a valid source name.
+func (p Pool) IncludeSources(component string, dsc control.DSC) (*Source, error) {
+	if err := checkPackageName("source", dsc.Source); err != nil {
+		return nil, err
+	}
+	targetDir := path.Join("pool", component, poolPrefix(dsc.Source))
 
-	targetDir := path.Join("pool", poolPrefix(dsc.Source))
+	sha256s := map[string]control.FileHash{}
+	for _, el := range dsc.ChecksumsSha256 {
+		sha256s[el.Filename] = el.FileHash
+	}
+
+	for _, file := range dsc.AbsFiles() {
+		localName := path.Base(file.Filename)
+		poolPath := path.Join(targetDir, localName)
+
+		hash := file
+		if sha256, ok := sha256s[localName]; ok {
+			hash = sha256
+		}
+
+		exists, err := p.hasFile(poolPath, hash)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
 
-	for _, file := range dsc.Files {
 		obj, err := p.Copy(file.Filename)
 		if err != nil {
-			return "", nil, err
+			return nil, err
 		}
 
-		localName := path.Base(file.Filename)
-		files[path.Join(targetDir, localName)] = *obj
+		if err := p.Store.Link(*obj, poolPath); err != nil {
+			return nil, err
+		}
 	}
 
-	obj, err := p.Copy(dsc.Filename)
+	dscName := path.Base(dsc.Filename)
+	obj, hashers, err := p.copyHashed(dsc.Filename, poolHashes)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	localName := path.Base(dsc.Filename)
-	files[path.Join(targetDir, localName)] = *obj
+	if err := p.Store.Link(*obj, path.Join(targetDir, dscName)); err != nil {
+		return nil, err
+	}
+	logEvent(p.logger, slog.LevelInfo, "included", "path", path.Join(targetDir, dscName), "object", obj.ID)
+
+	src, err := SourceFromDsc(&dsc, targetDir)
+	if err != nil {
+		return nil, err
+	}
 
-	for path, object := range files {
-		if err := p.Store.Link(object, path); err != nil {
-			return "", nil, err
+	for _, hasher := range hashers {
+		if err := src.addHash(control.FileHashFromHasher(dscName, *hasher)); err != nil {
+			return nil, err
 		}
 	}
 
-	return targetDir, files, nil
+	return src, nil
 }
 
-func (p Pool) IncludeDeb(debFile *deb.Deb) (string, *blobstore.Object, error) {
-	obj, err := p.Copy(debFile.Path)
+// Check to see if the file at `poolPath` already exists. If it exists, but
+// doesn't match the expected FileHash, this will return an error.
+func (p Pool) hasFile(poolPath string, hash control.FileHash) (bool, error) {
+	obj, err := p.Store.Lookup(poolPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	fd, err := p.Store.Open(*obj)
 	if err != nil {
-		return "", nil, err
+		return false, err
+	}
+	defer fd.Close()
+
+	if err := verifyHash(poolPath, fd, hash); err != nil {
+		return false, fmt.Errorf("%s already exists in the pool: %s", poolPath, err)
+	}
+	return true, nil
+}
+
+// Copy a .deb into the Pool, under the canonical path for its Component
+// and source package (such as "pool/main/f/foo/foo_1.0-1_amd64.deb", or
+// ending in .udeb or .ddeb, if that's what the file is named), and
+// return the Package entry for it, with the Filename, Size and hashes set,
+// ready to be added to the Component. With pool dedup on (see
+// EnablePoolDedup), a .deb that's already in the Pool keeps its existing
+// Filename, even if that's under another Component. If the Archive requires
+// embedded signatures (see RequireDebSignatures), they're checked first.
+//
+// A .deb whose Package or source name isn't valid is refused. If the same
+// .deb is already at its pool path, it's left alone; if a different one
+// is, this will return an error.
+func (p Pool) IncludeDeb(component string, debFile deb.Deb) (*Package, error) {
+	if err := checkPackageName("source", debFile.Control.SourceName()); err != nil {
+		return nil, err
+	}
+	if err := checkPackageName("package", debFile.Control.Package); err != nil {
+		return nil, err
+	}
+
+	if p.debKeyring != nil {
+		if _, err := VerifyDebSignature(debFile.Path, p.debKeyring); err != nil {
+			return nil, err
+		}
+	}
+
+	/* Keep .udebs and .ddebs as they are, so they can be told apart */
+	ext := filepath.Ext(debFile.Path)
+	switch ext {
+	case ".deb", ".udeb", ".ddeb":
+	default:
+		ext = ".deb"
 	}
 
 	debPath := path.Join(
 		"pool",
+		component,
 		poolPrefix(debFile.Control.SourceName()),
 		fmt.Sprintf(
-			"%s_%s_%s.deb",
+			"%s_%s_%s%s",
 			debFile.Control.Package,
-			debFile.Control.Version,
-			debFile.Control.Architecture,
+			poolVersion(debFile.Control.Version),
+			debFile.Control.Architecture.String(),
+			ext,
 		),
 	)
 
-	return debPath, obj, p.Store.Link(*obj, debPath)
+	obj, hashers, err := p.copyHashed(debFile.Path, poolHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, ok, err := p.dedupPath(*obj, debPath); err != nil {
+		return nil, err
+	} else if ok {
+		return packageFromHashers(debFile, existing, hashers)
+	}
+
+	/* Never replace a .deb published indices already have the hashes of */
+	for _, hasher := range hashers {
+		fileHash := control.FileHashFromHasher(debPath, *hasher)
+		if fileHash.Algorithm != "sha256" {
+			continue
+		}
+		exists, err := p.hasFile(debPath, fileHash)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return packageFromHashers(debFile, debPath, hashers)
+		}
+	}
+
+	if err := p.Store.Link(*obj, debPath); err != nil {
+		return nil, err
+	}
+	logEvent(p.logger, slog.LevelInfo, "included", "path", debPath, "object", obj.ID)
+
+	return packageFromHashers(debFile, debPath, hashers)
 }
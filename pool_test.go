@@ -0,0 +1,78 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/deb"
+)
+
+// Pool {{{
+
+func TestPoolPrefix(t *testing.T) {
+	for source, prefix := range map[string]string{
+		"foo":    "f/foo",
+		"libfoo": "libf/libfoo",
+		"lib":    "l/lib",
+		"":       "",
+	} {
+		if got := poolPrefix(source); got != prefix {
+			t.Errorf("poolPrefix(%q) = %q, expected %q", source, got, prefix)
+		}
+	}
+}
+
+func TestIncludeDebInvalidName(t *testing.T) {
+	for _, ctrl := range []deb.Control{
+		{Package: "foo", Source: "../../etc"},
+		{Package: "../foo"},
+		{Package: ""},
+		{Package: "Foo"},
+	} {
+		_, err := (Pool{}).IncludeDeb("main", deb.Deb{Control: ctrl, Path: "foo.deb"})
+		if err == nil || !strings.Contains(err.Error(), "Invalid") {
+			t.Errorf("Package '%s' (source '%s') wasn't refused: %v", ctrl.Package, ctrl.Source, err)
+		}
+	}
+}
+
+func TestIncludeSourcesInvalidName(t *testing.T) {
+	for _, source := range []string{"", "../../etc", "f", "Foo"} {
+		_, err := (Pool{}).IncludeSources("main", control.DSC{Source: source})
+		if err == nil || !strings.Contains(err.Error(), "Invalid source name") {
+			t.Errorf("Source '%s' wasn't refused: %v", source, err)
+		}
+	}
+}
+
+func TestIncludeDscSourceMismatch(t *testing.T) {
+	root := t.TempDir()
+	a, err := New(filepath.Join(root, "archive"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dscPath := filepath.Join(root, "bar_1.0.dsc")
+	if err := os.WriteFile(dscPath, []byte("Source: bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = a.includeDsc(component, "foo", dscPath)
+	if err == nil || !strings.Contains(err.Error(), "the .changes is for 'foo'") {
+		t.Fatalf(".dsc for another source wasn't refused: %v", err)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
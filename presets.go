@@ -0,0 +1,55 @@
+package archive
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Suite Presets {{{
+
+// Get a handle to write a backports Suite (such as "bookworm-backports"),
+// set up the way Debian's are: "NotAutomatic: yes" and
+// "ButAutomaticUpgrades: yes", so that apt only installs from it when
+// asked to, but keeps anything installed from it up to date, a Description
+// naming the Suite it's a backport to, and a Valid-Until of two weeks,
+// since backports are published less often. Any of it can be changed on the
+// Suite before it's published.
+func (a *Archive) BackportsSuite(name string) (*Suite, error) {
+	suite, err := a.Suite(name)
+	if err != nil {
+		return nil, err
+	}
+	suite.Description = fmt.Sprintf("Backports for %s", strings.TrimSuffix(name, "-backports"))
+	suite.Set("NotAutomatic", "yes")
+	suite.Set("ButAutomaticUpgrades", "yes")
+	if err := suite.SetValidUntil(14 * 24 * time.Hour); err != nil {
+		return nil, err
+	}
+	return suite, nil
+}
+
+// Get a handle to write a security Suite (such as "bookworm-security"),
+// set up the way Debian's are: Components are published under "updates/"
+// (so Component("main") is "updates/main"), every index is published
+// by-hash, with "Acquire-By-Hash: yes" (see SetByHash), a Description naming
+// the Suite it has security updates for, and a Valid-Until of just a day,
+// so that clients notice quickly if they're being held back from updates.
+// Any of it can be changed on the Suite before it's published.
+func (a *Archive) SecuritySuite(name string) (*Suite, error) {
+	suite, err := a.Suite(name)
+	if err != nil {
+		return nil, err
+	}
+	suite.Description = fmt.Sprintf("Security updates for %s", strings.TrimSuffix(name, "-security"))
+	suite.SetComponentPrefix("updates/")
+	suite.SetByHash(true)
+	if err := suite.SetValidUntil(24 * time.Hour); err != nil {
+		return nil, err
+	}
+	return suite, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
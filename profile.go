@@ -0,0 +1,320 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/transput"
+)
+
+// Profile {{{
+
+// Profile is a set of defaults for what a Suite publishes, which can be
+// picked all at once with SetProfile.
+type Profile int
+
+const (
+	// Publish what older apt releases expect; MD5sum and SHA1 in Package
+	// entries, SHA1, SHA256 and SHA512 in the Release file, and
+	// uncompressed indices. This is the default.
+	DefaultProfile Profile = iota
+
+	// Publish only what current apt releases need; no MD5sum or SHA1 in
+	// Package entries or the Release file (just SHA256 and SHA512), and
+	// only xz compressed indices.
+	ModernProfile
+)
+
+// Set the hashes, index compressions and Package entry fields the Suite
+// publishes to those of a Profile, replacing anything set before with
+// SetHashes or SetCompressions.
+func (s *Suite) SetProfile(profile Profile) error {
+	switch profile {
+	case DefaultProfile, ModernProfile:
+	default:
+		return fmt.Errorf("No such profile: %d", int(profile))
+	}
+	s.setProfile(profile)
+	return nil
+}
+
+func (s *Suite) setProfile(profile Profile) {
+	switch profile {
+	case ModernProfile:
+		s.features.Hashes = []string{"sha256", "sha512"}
+		s.features.Compressions = []string{".xz"}
+		s.features.StripWeakHashes = true
+	default:
+		s.features.Hashes = []string{"sha1", "sha256", "sha512"}
+		s.features.Compressions = []string{""}
+		s.features.StripWeakHashes = false
+	}
+}
+
+// Set which forms each Packages and Sources index is published in; any
+// of "none" (uncompressed), "gz", "xz" or "zst". Every form is written out
+// at once, from a single pass over the entries, and each is listed in the
+// Release file with its own size and hashes. Unless the Suite's
+// UncompressedPolicy says otherwise, the hashes of the uncompressed index
+// are listed in the Release file even if it's not published. By default,
+// only uncompressed indices are published.
+func (s *Suite) SetCompressions(compressions ...string) error {
+	if len(compressions) == 0 {
+		return fmt.Errorf("At least one compression is required")
+	}
+
+	suffixes := []string{}
+	seen := map[string]bool{}
+	for _, compression := range compressions {
+		suffix := ""
+		switch compression {
+		case "none":
+		case "gz", "xz", "zst":
+			suffix = "." + compression
+		default:
+			return fmt.Errorf("No known compression: '%s'", compression)
+		}
+		if seen[suffix] {
+			return fmt.Errorf("Compression given more than once: '%s'", compression)
+		}
+		seen[suffix] = true
+		suffixes = append(suffixes, suffix)
+	}
+	s.features.Compressions = suffixes
+	return nil
+}
+
+// UncompressedPolicy decides whether the Release lists the hashes of an
+// index that's only published compressed, as it would be if it was
+// published uncompressed too.
+type UncompressedPolicy int
+
+const (
+	// List the uncompressed index in the Release, even though it's not
+	// published; this is what Debian's own archive does, and lets clients
+	// check an index once they've decompressed it. This is the default.
+	ListUncompressed UncompressedPolicy = iota
+
+	// Only list the forms of each index that are actually published.
+	OmitUncompressed
+)
+
+// Set whether the Suite's Release lists the uncompressed form of indices
+// that aren't published uncompressed (see SetCompressions).
+func (s *Suite) SetUncompressedPolicy(policy UncompressedPolicy) {
+	s.features.Uncompressed = policy
+}
+
+// Check if the Release should list the uncompressed form of each index.
+func (s Suite) listUncompressed() bool {
+	return s.features.Uncompressed == ListUncompressed || slices.Contains(s.features.Compressions, "")
+}
+
+// CompressionOptions tunes how a Suite's indices are compressed; trading
+// publish time for size, such as for a CI archive that's published every
+// few minutes, or one with huge indices that's fetched by a lot of
+// clients. Anything left as 0 is the compressor's default.
+type CompressionOptions struct {
+	// gzip level, from 1 (gzip.BestSpeed) to 9 (gzip.BestCompression).
+	GzipLevel int
+
+	// Size of the xz dictionary in bytes; bigger compresses large indices
+	// better, but needs more memory to decompress. xz's own presets use
+	// from 256KiB (-0) to 64MiB (-9); the default is 8MiB (-6).
+	XZDictSize int
+
+	// zstd level, on zstd's own scale from 1 to 22; only a few levels are
+	// actually distinct, with 1, 3, 7 and 11 and above the fastest to best.
+	ZstdLevel int
+
+	// Size of the zstd window in bytes, a power of two; set it to 128MiB
+	// (1 << 27, the most apt will decompress) for the equivalent of
+	// "zstd --long".
+	ZstdWindowSize int
+}
+
+// Set how the Suite's indices are compressed. By default, each compressor
+// uses its own defaults.
+func (s *Suite) SetCompressionOptions(options CompressionOptions) error {
+	if options.GzipLevel < 0 || options.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("Invalid gzip level: %d", options.GzipLevel)
+	}
+	if options.ZstdLevel < 0 || options.ZstdLevel > 22 {
+		return fmt.Errorf("Invalid zstd level: %d", options.ZstdLevel)
+	}
+	if options.ZstdWindowSize > 1<<27 {
+		return fmt.Errorf("zstd window is too big for apt: %d", options.ZstdWindowSize)
+	}
+	for _, suffix := range []string{".gz", ".xz", ".zst"} {
+		compressor, err := newCompressor(io.Discard, suffix, options)
+		if err != nil {
+			return err
+		}
+		compressor.Close()
+	}
+	s.features.Compression = options
+	return nil
+}
+
+// Get a compressor writing to `out` for an index published with `suffix`
+// (one of "", ".gz", ".xz" or ".zst"), or nil if it's not compressed.
+func newCompressor(out io.Writer, suffix string, options CompressionOptions) (io.WriteCloser, error) {
+	switch suffix {
+	case "":
+		return nil, nil
+	case ".gz":
+		level := gzip.DefaultCompression
+		if options.GzipLevel != 0 {
+			level = options.GzipLevel
+		}
+		return gzip.NewWriterLevel(out, level)
+	case ".xz":
+		config := xz.WriterConfig{DictCap: options.XZDictSize}
+		if err := config.Verify(); err != nil {
+			return nil, err
+		}
+		return config.NewWriter(out)
+	case ".zst":
+		zstdOptions := []zstd.EOption{}
+		if options.ZstdLevel != 0 {
+			zstdOptions = append(zstdOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.ZstdLevel)))
+		}
+		if options.ZstdWindowSize != 0 {
+			zstdOptions = append(zstdOptions, zstd.WithWindowSize(options.ZstdWindowSize))
+		}
+		return zstd.NewWriter(out, zstdOptions...)
+	}
+	return nil, fmt.Errorf("No known compression: '%s'", suffix)
+}
+
+// Get the entry as it's to be written to one of the Suite's indices;
+// without MD5sum or SHA1 if the Suite is stripping weak hashes.
+func (s Suite) indexEntry(entry interface{}) interface{} {
+	pkg, ok := entry.(Package)
+	if !ok || !s.features.StripWeakHashes {
+		return entry
+	}
+
+	pkg.MD5sum = ""
+	pkg.SHA1 = ""
+
+	paragraph := control.Paragraph{Values: map[string]string{}, Order: []string{}}
+	for _, key := range pkg.Paragraph.Order {
+		if key == "MD5sum" || key == "SHA1" {
+			continue
+		}
+		paragraph.Set(key, pkg.Paragraph.Values[key])
+	}
+	pkg.Paragraph = paragraph
+	return pkg
+}
+
+// }}}
+
+// indexFile {{{
+
+// A single file published for an index, compressed or not.
+type indexFile struct {
+	suffix  string
+	handle  Writer
+	hashers []*transput.Hasher
+
+	/* Where to write the uncompressed index to, and, if compressed, the
+	 * compressor, to be flushed once everything's written */
+	writer     io.Writer
+	compressor io.WriteCloser
+
+	/* Set once committed */
+	obj *Object
+
+	/* Set instead of the handle and hashers when the index is unchanged,
+	 * and what's already published is being reused */
+	reused control.FileHashes
+}
+
+// Create a new blob in the store for an index, compressed according to
+// `suffix` (one of "", ".gz", ".xz" or ".zst"), and hashed with the Suite's
+// hash algorithms as it's written.
+func newIndexFile(store Store, suite *Suite, suffix string) (*indexFile, error) {
+	handle, err := store.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	hashWriter, hashers, err := getHashers(suite)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	file := indexFile{
+		suffix:  suffix,
+		handle:  handle,
+		hashers: hashers,
+		writer:  io.MultiWriter(handle, hashWriter),
+	}
+
+	file.compressor, err = newCompressor(file.writer, suffix, suite.features.Compression)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	if file.compressor != nil {
+		file.writer = file.compressor
+	}
+	return &file, nil
+}
+
+// Finish writing out the index, once everything has been written to it.
+func (f *indexFile) flush() error {
+	if f.compressor == nil {
+		return nil
+	}
+	return f.compressor.Close()
+}
+
+// Commit the flushed index to the store, and close its handle.
+func (f *indexFile) commit(store Store) error {
+	obj, err := store.Commit(f.handle)
+	if err != nil {
+		f.close()
+		return err
+	}
+	f.obj = obj
+	return f.close()
+}
+
+// Close the index's handle, throwing the blob away if it was never
+// committed. This is safe to call more than once.
+func (f *indexFile) close() error {
+	if f.handle == nil {
+		return nil
+	}
+	return f.handle.Close()
+}
+
+// Get the hashes of the index for the Release, as published at `filePath`.
+func (f *indexFile) fileHashes(filePath string) []control.FileHash {
+	ret := []control.FileHash{}
+	if f.reused != nil {
+		for _, fileHash := range f.reused {
+			fileHash.Filename = filePath
+			ret = append(ret, fileHash)
+		}
+		return ret
+	}
+	for _, hasher := range f.hashers {
+		ret = append(ret, control.FileHashFromHasher(filePath, *hasher))
+	}
+	return ret
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Profile {{{
+
+// Engross a Suite with a single Package in it, returning what would be
+// published, and the Release.
+func engrossTestSuite(t *testing.T, configure func(*Suite) error) (*Archive, ArchiveState, *Release) {
+	a, err := New(t.TempDir(), newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configure(suite); err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.AddPackage(newTestPackage(t, "foo", "1.0", "amd64")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := a.Engross(*suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := readBlob(a.Store, files["dists/unstable/Release"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := LoadInRelease(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, files, release
+}
+
+func TestCompressions(t *testing.T) {
+	a, files, release := engrossTestSuite(t, func(suite *Suite) error {
+		return suite.SetCompressions("none", "gz", "xz", "zst")
+	})
+
+	uncompressed, err := readBlob(a.Store, files["dists/unstable/main/binary-amd64/Packages"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	indices := release.Indices()
+
+	for suffix, decompress := range map[string]func(io.Reader) (io.Reader, error){
+		"":     func(in io.Reader) (io.Reader, error) { return in, nil },
+		".gz":  func(in io.Reader) (io.Reader, error) { return gzip.NewReader(in) },
+		".xz":  func(in io.Reader) (io.Reader, error) { return xz.NewReader(in) },
+		".zst": func(in io.Reader) (io.Reader, error) { return zstd.NewReader(in) },
+	} {
+		filePath := "main/binary-amd64/Packages" + suffix
+		obj, ok := files["dists/unstable/"+filePath]
+		if !ok {
+			t.Errorf("%s wasn't published", filePath)
+			continue
+		}
+		data, err := readBlob(a.Store, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := decompress(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, uncompressed) {
+			t.Errorf("%s doesn't decompress to the uncompressed index", filePath)
+		}
+
+		hashes := indices[filePath]
+		for algorithm, hasher := range map[string]hash.Hash{
+			"sha1":   sha1.New(),
+			"sha256": sha256.New(),
+			"sha512": sha512.New(),
+		} {
+			hasher.Write(data)
+			fileHash, ok := findFileHash(hashes, algorithm)
+			if !ok {
+				t.Errorf("Release has no %s for %s", algorithm, filePath)
+				continue
+			}
+			if fileHash.Hash != fmt.Sprintf("%x", hasher.Sum(nil)) || fileHash.Size != int64(len(data)) {
+				t.Errorf("Release has the wrong %s for %s", algorithm, filePath)
+			}
+		}
+	}
+}
+
+func TestUncompressedPolicy(t *testing.T) {
+	for policy, listed := range map[UncompressedPolicy]bool{
+		ListUncompressed: true,
+		OmitUncompressed: false,
+	} {
+		_, files, release := engrossTestSuite(t, func(suite *Suite) error {
+			suite.SetUncompressedPolicy(policy)
+			return suite.SetCompressions("xz")
+		})
+		if _, ok := files["dists/unstable/main/binary-amd64/Packages"]; ok {
+			t.Errorf("Uncompressed index was published with policy %d", policy)
+		}
+		indices := release.Indices()
+		if _, ok := indices["main/binary-amd64/Packages.xz"]; !ok {
+			t.Errorf("Release doesn't list the xz index with policy %d", policy)
+		}
+		if _, ok := indices["main/binary-amd64/Packages"]; ok != listed {
+			t.Errorf("Uncompressed index listed: %t, expected %t, with policy %d", ok, listed, policy)
+		}
+	}
+
+	/* Anything published uncompressed is always listed */
+	_, _, release := engrossTestSuite(t, func(suite *Suite) error {
+		suite.SetUncompressedPolicy(OmitUncompressed)
+		return suite.SetCompressions("none", "xz")
+	})
+	if _, ok := release.Indices()["main/binary-amd64/Packages"]; !ok {
+		t.Errorf("Published uncompressed index isn't listed in the Release")
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"pault.ag/go/debian/dependency"
+)
+
+// Query {{{
+
+// QueryResult is every Package entry in a Suite matching one Relation of
+// a query (that is, one of the comma separated parts).
+type QueryResult struct {
+	Relation dependency.Relation
+	Packages []Package
+}
+
+// Check if anything in the Suite matched the Relation.
+func (q QueryResult) Satisfied() bool {
+	return len(q.Packages) != 0
+}
+
+// Find the Package entries in the Suite (in any Component) that satisfy a
+// query, written the same way as a Depends field, such as
+// "foo (>= 1.2), bar [amd64] | baz". One QueryResult is returned for each
+// comma separated Relation, in order, with every Package entry matching
+// any of its alternatives.
+//
+// An architecture restriction (such as "[amd64]" or "[!i386]") limits
+// the matches to Package entries built for those architectures, along
+// with any built for "all". An architecture qualifier (such as "foo:amd64")
+// matches only that architecture.
+func (s Suite) Query(query string) ([]QueryResult, error) {
+	dep, err := dependency.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []QueryResult{}
+	for _, relation := range dep.Relations {
+		result := QueryResult{Relation: relation, Packages: []Package{}}
+		s.eachPackage(func(pkg Package) {
+			for _, possibility := range relation.Possibilities {
+				if possibilityMatches(possibility, pkg) {
+					result.Packages = append(result.Packages, pkg)
+					return
+				}
+			}
+		})
+		ret = append(ret, result)
+	}
+	return ret, nil
+}
+
+// Call `fn` with every Package entry in the Suite, in a stable order.
+func (s Suite) eachPackage(fn func(Package)) {
+	for _, name := range s.componentNames() {
+		component := s.components[name]
+		for _, arch := range component.arches() {
+			for _, entry := range component.packageWriters[arch].entries {
+				if pkg, ok := entry.(Package); ok {
+					fn(pkg)
+				}
+			}
+		}
+	}
+}
+
+// Check if a Package entry satisfies a single Possibility of a Relation,
+// by name, version, and architecture.
+func possibilityMatches(possibility dependency.Possibility, pkg Package) bool {
+	if possibility.Name != pkg.Package {
+		return false
+	}
+
+	if possibility.Version != nil && !possibility.Version.SatisfiedBy(pkg.Version) {
+		return false
+	}
+
+	if possibility.Arch != nil && !pkg.Architecture.Is(possibility.Arch) {
+		return false
+	}
+
+	if possibility.Architectures != nil && len(possibility.Architectures.Architectures) != 0 {
+		if pkg.Architecture.String() != "all" &&
+			!possibility.Architectures.Matches(&pkg.Architecture) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,173 @@
+package archive
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// References {{{
+
+// Walk every published Packages and Sources index under dists/, and
+// return the set of every pool path they reference.
+func (a Archive) poolReferences() (map[string]bool, error) {
+	ret := map[string]bool{}
+
+	targets, err := a.Store.List("dists")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range targets {
+		switch stripCompression(path.Base(target)) {
+		case "Packages":
+			err = a.addPackagesReferences(target, ret)
+		case "Sources":
+			err = a.addSourcesReferences(target, ret)
+		case "Buildinfo":
+			err = a.addBuildinfoReferences(target, ret)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (a Archive) addPackagesReferences(target string, references map[string]bool) error {
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	packages, err := LoadPackages(fd)
+	if err != nil {
+		return err
+	}
+
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		references[pkg.Filename] = true
+	}
+}
+
+func (a Archive) addSourcesReferences(target string, references map[string]bool) error {
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	sources, err := LoadSources(fd)
+	if err != nil {
+		return err
+	}
+
+	for {
+		src, err := sources.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, file := range src.Files {
+			references[path.Join(src.Directory, file.Filename)] = true
+		}
+	}
+}
+
+// Remove any of the given pool paths which aren't referenced by any
+// published Packages or Sources index, so that the next GC will reclaim
+// their blobs. This returns the paths that were removed.
+//
+// This is intended to be used with Suite.Removed, after the Suite has
+// been published without the removed entries.
+func (a Archive) UnlinkUnreferenced(paths []string) ([]string, error) {
+	references, err := a.poolReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, poolPath := range paths {
+		if references[poolPath] {
+			continue
+		}
+		err := a.Store.Unlink(poolPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, poolPath)
+	}
+	return ret, nil
+}
+
+// }}}
+
+// Orphans {{{
+
+// Orphan is a file under pool/ that no published Packages or Sources index
+// references.
+type Orphan struct {
+	Path string
+	ObjectInfo
+}
+
+// OrphanReport lists every Orphan in the pool, along with their total
+// size. Blobs shared by more than one Orphan are counted once for each.
+type OrphanReport struct {
+	Orphans []Orphan
+	Size    int64
+}
+
+// Find every file in the pool that isn't referenced by any published
+// Packages or Sources index, of any Suite or Snapshot, without changing
+// anything. This is intended for auditing the pool before unlinking
+// anything with UnlinkUnreferenced or GCUnreferenced.
+func (a Archive) Orphans() (*OrphanReport, error) {
+	references, err := a.poolReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := a.Store.List("pool")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(targets)
+
+	ret := OrphanReport{Orphans: []Orphan{}}
+	for _, target := range targets {
+		if references[target] {
+			continue
+		}
+		obj, err := a.Store.Lookup(target)
+		if err != nil {
+			return nil, err
+		}
+		info, err := a.Store.Stat(*obj)
+		if err != nil {
+			return nil, err
+		}
+		ret.Orphans = append(ret.Orphans, Orphan{Path: target, ObjectInfo: *info})
+		ret.Size += info.Size
+	}
+	return &ret, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -21,11 +21,12 @@
 package archive
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/dependency"
 )
@@ -123,6 +124,11 @@ type Release struct {
 	Date       string
 	ValidUntil string `control:"Valid-Until"`
 
+	// Set to "Packages" if Packages built for "all" are only listed in
+	// their own "binary-all" index, and not in the index of every other
+	// Architecture, so that apt doesn't go looking for them there.
+	NoSupportForArchitectureAll string `control:"No-Support-for-Architecture-all"`
+
 	// note the upper-case S in MD5Sum (unlike in Packages and Sources files)
 	//
 	// These fields are used for two purposes:
@@ -178,7 +184,7 @@ type Release struct {
 }
 
 // Given a file declared in the Release file, get the FileHash entries
-// for that file (MD5, SHA1, SHA256). These can be used to ensure the
+// for that file (MD5, SHA1, SHA256, SHA512). These can be used to ensure the
 // integrety of files in the archive.
 func (r *Release) Indices() map[string]control.FileHashes {
 	ret := map[string]control.FileHashes{}
@@ -191,6 +197,9 @@ func (r *Release) Indices() map[string]control.FileHashes {
 	for _, el := range r.SHA256 {
 		ret[el.Filename] = append(ret[el.Filename], el.FileHash)
 	}
+	for _, el := range r.SHA512 {
+		ret[el.Filename] = append(ret[el.Filename], el.FileHash)
+	}
 	return ret
 }
 
@@ -215,10 +224,19 @@ func (r *Release) AddHash(h control.FileHash) error {
 // LoadInRelease {{{
 
 // Given an InRelease io.Reader, and the OpenPGP keyring
-// to validate against, return the parsed InRelease file.
+// to validate against, return the parsed InRelease file. If the keyring
+// is nil, the signature (if any) isn't checked.
 func LoadInRelease(in io.Reader, keyring *openpgp.EntityList) (*Release, error) {
+	if keyring != nil {
+		plaintext, _, err := readClearsigned(in, *keyring)
+		if err != nil {
+			return nil, err
+		}
+		in = bytes.NewReader(plaintext)
+	}
+
 	ret := Release{}
-	decoder, err := control.NewDecoder(in, keyring)
+	decoder, err := control.NewDecoder(in, nil)
 	if err != nil {
 		return nil, err
 	}
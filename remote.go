@@ -0,0 +1,540 @@
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/transput"
+)
+
+// Remote {{{
+
+// Remote is an apt repository (such as a Debian mirror) read over HTTP or
+// HTTPS. Nothing is ever written to it.
+type Remote struct {
+	base   *url.URL
+	client *http.Client
+	retry  RetryPolicy
+	limit  *rateLimiter
+	cache  string
+}
+
+// Create a Remote for the repository at `baseURL`; the URL of the
+// directory with dists/ and pool/ in it, such as
+// "https://deb.debian.org/debian".
+func NewRemote(baseURL string) (*Remote, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("Not an HTTP(S) URL: '%s'", baseURL)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &Remote{base: base, client: http.DefaultClient}, nil
+}
+
+// Set the http.Client the Remote makes every request with, such as one
+// going through a proxy, trusting a private CA, or presenting a client
+// certificate. Passing nil goes back to http.DefaultClient.
+func (r *Remote) SetClient(client *http.Client) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	r.client = client
+}
+
+// Set the http.RoundTripper the Remote makes every request with, such as
+// one wrapped for instrumentation, with an http.Client that's otherwise
+// the default. Passing nil goes back to http.DefaultTransport.
+func (r *Remote) SetTransport(transport http.RoundTripper) {
+	r.client = &http.Client{Transport: transport}
+}
+
+// Get the URL of the file at `target`, relative to the root of the
+// repository (such as "dists/stable/InRelease").
+func (r Remote) URL(target string) string {
+	return r.base.ResolveReference(&url.URL{Path: target}).String()
+}
+
+// Open the file at `target`, relative to the root of the repository. If
+// there's no such file, the error satisfies os.IsNotExist.
+//
+// If the Remote has a cache (see SetCache), files under dists/ are read
+// through it.
+func (r Remote) Open(target string) (io.ReadCloser, error) {
+	if r.cache != "" && strings.HasPrefix(target, "dists/") {
+		return r.openCached(target)
+	}
+	resp, err := r.do(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Check if there's a file at `target`, relative to the root of the
+// repository, without fetching it.
+func (r Remote) Exists(target string) (bool, error) {
+	resp, err := r.do(http.MethodHead, target, nil)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// Make a request for `target`, with any extra `header`s, turning any
+// response other than a 2xx into an error. Requests that fail in a way
+// worth retrying are retried according to the Remote's RetryPolicy.
+func (r Remote) do(method string, target string, header http.Header) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := r.doOnce(method, target, header)
+		if err == nil && r.limit != nil {
+			resp.Body = limitedReader{reader: resp.Body, limiter: r.limit}
+		}
+		if err == nil || attempt >= r.retry.Attempts || !retryable(err) {
+			return resp, err
+		}
+		time.Sleep(r.retry.backoff(attempt))
+	}
+}
+
+func (r Remote) doOnce(method string, target string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.URL(target), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: target, Err: os.ErrNotExist}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		resp.Body.Close()
+		return nil, &RemoteError{Method: method, URL: r.URL(target), StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// RemoteError is an unexpected HTTP response from a Remote.
+type RemoteError struct {
+	Method     string
+	URL        string
+	StatusCode int
+}
+
+func (e RemoteError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// }}}
+
+// RetryPolicy {{{
+
+// RetryPolicy is how a Remote retries requests that fail with a 5xx
+// response or a timeout. Anything else (such as a 404) is never retried.
+type RetryPolicy struct {
+	// How many times to try each request, including the first. Anything
+	// less than 2 means requests aren't retried, which is the default.
+	Attempts int
+
+	// How long to wait before the first retry; this doubles after each
+	// retry, up to MaxBackoff (if it's set).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Set how the Remote retries requests to a flaky server.
+func (r *Remote) SetRetryPolicy(policy RetryPolicy) {
+	r.retry = policy
+}
+
+// Get how long to wait after the `attempt`th try.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempt; i++ {
+		wait *= 2
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return wait
+}
+
+// Check if a request that failed with `err` is worth trying again.
+func retryable(err error) bool {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// }}}
+
+// Cache {{{
+
+// Keep a copy of every file under dists/ (such as InRelease, and the
+// Packages indices) opened from the Remote in the directory `dir`, along
+// with the ETag and Last-Modified the server sent with it, so that the
+// next time it's opened, it's only fetched again if it's changed. This
+// makes syncing a Suite that hasn't changed (or has only changed a bit)
+// cost next to nothing.
+//
+// The directory is created if it doesn't exist. It may be shared between
+// Remotes, and between runs.
+func (r *Remote) SetCache(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	r.cache = dir
+	return nil
+}
+
+// What the cache knows about a file, stored next to it, with ".meta"
+// appended.
+type remoteCacheEntry struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Of what was cached, so that a file that's been damaged (or left
+	// half-written) is fetched again rather than trusted.
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Get the path `target` is cached at; under the host and path of the
+// Remote, so that Remotes can share a cache.
+func (r Remote) cachePath(target string) string {
+	u := r.base.ResolveReference(&url.URL{Path: target})
+	return filepath.Join(r.cache, u.Host, filepath.FromSlash(path.Clean(u.Path)))
+}
+
+// Load what's cached for `target`, if it's all there and intact.
+func (r Remote) cached(target string) (*remoteCacheEntry, bool) {
+	cachePath := r.cachePath(target)
+	data, err := os.ReadFile(cachePath + ".meta")
+	if err != nil {
+		return nil, false
+	}
+	entry := remoteCacheEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+
+	fd, err := os.Open(cachePath)
+	if err != nil {
+		return nil, false
+	}
+	defer fd.Close()
+	err = verifyHash(target, fd, control.FileHash{
+		Algorithm: "sha256",
+		Hash:      entry.SHA256,
+		Size:      entry.Size,
+	})
+	return &entry, err == nil
+}
+
+// Open `target` through the cache; asking the server for it only if it's
+// changed since it was cached.
+func (r Remote) openCached(target string) (io.ReadCloser, error) {
+	cachePath := r.cachePath(target)
+
+	header := http.Header{}
+	entry, ok := r.cached(target)
+	if ok {
+		if entry.ETag != "" {
+			header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := r.do(http.MethodGet, target, header)
+	if remoteErr, isRemote := err.(*RemoteError); isRemote && ok &&
+		remoteErr.StatusCode == http.StatusNotModified {
+		return os.Open(cachePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := r.writeCache(cachePath, resp); err != nil {
+		return nil, err
+	}
+	return os.Open(cachePath)
+}
+
+// Write the body of `resp` to the cache at `cachePath`, along with its
+// validators. The file is replaced all at once, so that anyone reading the
+// cache at the same time never sees half of it.
+func (r Remote) writeCache(cachePath string, resp *http.Response) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+	fd, err := os.CreateTemp(filepath.Dir(cachePath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	hasher, err := transput.NewHasher("sha256")
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(io.MultiWriter(fd, hasher), resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(remoteCacheEntry{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		SHA256:       fmt.Sprintf("%x", hasher.Sum(nil)),
+		Size:         size,
+	})
+	if err != nil {
+		return err
+	}
+
+	/* The old .meta never describes the new file; at worst, the new file
+	 * is fetched again next time */
+	if err := os.Rename(fd.Name(), cachePath); err != nil {
+		return err
+	}
+	return os.WriteFile(cachePath+".meta", data, 0644)
+}
+
+// }}}
+
+// Rate Limiting {{{
+
+// Limit how fast the Remote downloads, across every request it makes at
+// once, to `bytesPerSecond`, allowing bursts of up to `burst` bytes (or
+// one second's worth, if `burst` is less than 1), so that syncing a large
+// mirror doesn't saturate a shared link. Passing 0 removes the limit.
+func (r *Remote) SetRateLimit(bytesPerSecond int64, burst int64) {
+	if bytesPerSecond <= 0 {
+		r.limit = nil
+		return
+	}
+	if burst < 1 {
+		burst = bytesPerSecond
+	}
+	r.limit = &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// A token bucket, filled with a byte's worth of tokens at `rate` bytes
+// per second, holding at most `burst` bytes worth.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  int64
+	tokens float64
+	last   time.Time
+}
+
+// Take `n` bytes worth of tokens, waiting until they're there. `n` must
+// be no more than the burst.
+func (l *rateLimiter) wait(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		/* Holding the lock while asleep keeps everyone else waiting too,
+		 * which is the point */
+		wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		time.Sleep(wait)
+		l.last = l.last.Add(wait)
+		l.tokens = 0
+	}
+}
+
+type limitedReader struct {
+	reader  io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.limiter.burst {
+		p = p[:r.limiter.burst]
+	}
+	n, err := r.reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+func (r limitedReader) Close() error {
+	return r.reader.Close()
+}
+
+// }}}
+
+// Download {{{
+
+// How many times Download picks up where it left off, within a single
+// call, if the connection keeps dropping.
+const downloadResumes = 5
+
+// Download the file at `target`, relative to the root of the repository,
+// to the local path `dest`, checking it against `hash` once it's all
+// there. This is intended for large files, such as pool files or Contents
+// indices.
+//
+// The file is written to `dest` with ".partial" appended until it's been
+// checked. If the connection drops, the download is resumed from where it
+// left off, with a Range request; and if a ".partial" file is left over
+// from an earlier call, it's resumed rather than started over. If the
+// server doesn't support Range requests, the download starts over. If the
+// complete file doesn't match `hash`, the ".partial" file is removed.
+//
+// Only a dropped connection, or a 5xx or 429 response, is resumed from;
+// anything else (such as a 404 or 403) is returned straight away.
+func (r Remote) Download(target string, dest string, hash control.FileHash) error {
+	partial := dest + ".partial"
+	fd, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	for resumes := 0; ; resumes++ {
+		offset, err := fd.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if hash.Size > 0 && offset == hash.Size {
+			break
+		}
+		if hash.Size > 0 && offset > hash.Size {
+			if err := fd.Truncate(0); err != nil {
+				return err
+			}
+			offset = 0
+		}
+
+		err = r.downloadFrom(target, fd, offset)
+		if err == nil {
+			break
+		}
+		if !resumable(err) || resumes >= downloadResumes {
+			return err
+		}
+	}
+
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := verifyHash(target, fd, hash); err != nil {
+		fd.Close()
+		os.Remove(partial)
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, dest)
+}
+
+// Check if a Download that failed with `err` is worth resuming; that is, if
+// the connection dropped, or the server is failing or busy, rather than
+// refusing the request outright.
+func resumable(err error) bool {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.StatusCode >= 500 ||
+			remoteErr.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Fetch `target` into `fd`, starting `offset` bytes in, if the server
+// allows it, or from the start if not.
+func (r Remote) downloadFrom(target string, fd *os.File, offset int64) error {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := r.do(http.MethodGet, target, header)
+	if remoteErr, ok := err.(*RemoteError); ok && offset > 0 &&
+		remoteErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		/* Whatever's there is longer than the file; start over */
+		if err := fd.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := fd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return r.downloadFrom(target, fd, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	resumed := resp.StatusCode == http.StatusPartialContent &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset))
+	if !resumed {
+		if err := fd.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := fd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	_, err = io.Copy(fd, resp.Body)
+	return err
+}
+
+// }}}
+
+// vim: foldmethod=marker
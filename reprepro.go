@@ -0,0 +1,180 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/dependency"
+)
+
+// reprepro {{{
+
+// RepreproDistribution is a single distribution from reprepro's
+// conf/distributions.
+type RepreproDistribution struct {
+	control.Paragraph
+
+	Codename      string
+	Suite         string
+	Version       string
+	Origin        string
+	Label         string
+	Description   string
+	Components    []string `delim:" "`
+	Architectures []string `delim:" "`
+}
+
+// Parse reprepro's conf/distributions. Comment lines (starting with "#")
+// are skipped.
+func LoadRepreproDistributions(in io.Reader) ([]RepreproDistribution, error) {
+	stripped := bytes.Buffer{}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		stripped.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	decoder, err := control.NewDecoder(&stripped, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []RepreproDistribution{}
+	for {
+		distribution := RepreproDistribution{}
+		if err := decoder.Decode(&distribution); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if distribution.Codename == "" {
+			return nil, fmt.Errorf("Distribution has no Codename")
+		}
+		ret = append(ret, distribution)
+	}
+	return ret, nil
+}
+
+// Rebuild a reprepro setup, with its base directory at `basedir`, as
+// Suites of this Archive, for anyone moving off reprepro.
+//
+// A Suite is made for every distribution in conf/distributions, named
+// after its Codename (the directory reprepro publishes it under), with its
+// Origin, Label, Version, Description and declared Architectures, and its
+// Suite (if it has one) as an alias. Every
+// Package and Source entry, and every pool file, is then imported from
+// what reprepro published (in the basedir, or the "outdir" set in
+// conf/options), just like Import.
+//
+// reprepro's own db/ is a Berkeley DB, which isn't read; what's published
+// is everything needed to rebuild the Suites, and has been checked by
+// apt. Any distribution reprepro hasn't exported yet can't be imported.
+func (a Archive) ImportReprepro(basedir string) ([]*Suite, error) {
+	basedir, err := filepath.Abs(basedir)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.Open(filepath.Join(basedir, "conf", "distributions"))
+	if err != nil {
+		return nil, err
+	}
+	distributions, err := LoadRepreproDistributions(fd)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	outdir, err := repreproOutdir(basedir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*Suite{}
+	for _, distribution := range distributions {
+		suites, err := a.Import(outdir, distribution.Codename)
+		if err != nil {
+			return nil, err
+		}
+		suite := suites[0]
+
+		if err := distribution.apply(suite); err != nil {
+			return nil, fmt.Errorf("%s: %s", distribution.Codename, err)
+		}
+		ret = append(ret, suite)
+	}
+	return ret, nil
+}
+
+// Carry the settings from conf/distributions over to the imported Suite.
+func (d RepreproDistribution) apply(suite *Suite) error {
+	suite.Origin = d.Origin
+	suite.Label = d.Label
+	suite.Version = d.Version
+	suite.Description = d.Description
+	if d.Suite != "" && d.Suite != d.Codename {
+		if err := suite.AddAlias(d.Suite); err != nil {
+			return err
+		}
+	}
+
+	arches := []dependency.Arch{}
+	for _, name := range d.Architectures {
+		if name == "source" {
+			continue
+		}
+		arch, err := dependency.ParseArch(name)
+		if err != nil {
+			return err
+		}
+		arches = append(arches, *arch)
+	}
+	if len(arches) == 0 {
+		return nil
+	}
+	return suite.SetArchitectures(arches...)
+}
+
+// Find where reprepro publishes to; the "outdir" in conf/options (relative
+// to the basedir), or the basedir itself.
+func repreproOutdir(basedir string) (string, error) {
+	fd, err := os.Open(filepath.Join(basedir, "conf", "options"))
+	if os.IsNotExist(err) {
+		return basedir, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "outdir" {
+			continue
+		}
+		outdir := fields[1]
+		outdir = strings.Replace(outdir, "+b/", basedir+"/", 1)
+		if !filepath.IsAbs(outdir) {
+			outdir = filepath.Join(basedir, outdir)
+		}
+		return outdir, nil
+	}
+	return basedir, scanner.Err()
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"pault.ag/go/debian/control"
+)
+
+// Resign {{{
+
+// Sign the Suite's currently published Release again, with a fresh Date
+// and Valid-Until, without touching any of its indices. Every index the
+// Release lists that's published is checked against its hash first. This
+// returns an ArchiveState with just the Release, Release.gpg and InRelease,
+// fit for passage to Link.
+//
+// Only the Suite's Name, Valid-Until duration and Archive (for the signing
+// key and publish time) are used; everything else in the Release is kept
+// as it was published. This is intended for extending Valid-Until on a
+// Suite that otherwise isn't changing.
+func (a Archive) Resign(suite Suite) (ArchiveState, error) {
+	releasePath := path.Join("dists", suite.Name, "Release")
+	fd, err := a.OpenPath(releasePath)
+	if err != nil {
+		return nil, err
+	}
+	release, err := LoadInRelease(fd, nil)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.checkPublishedIndices(suite, release); err != nil {
+		return nil, err
+	}
+
+	when, err := suite.archive.PublishTime()
+	if err != nil {
+		return nil, err
+	}
+
+	paragraph := release.Paragraph
+	paragraph.Set("Date", when.In(time.UTC).Format(time.RFC1123Z))
+	if suite.features.Duration != 0 {
+		validUntil := when.Add(suite.features.Duration).In(time.UTC)
+		paragraph.Set("Valid-Until", validUntil.Format(time.RFC1123Z))
+	} else {
+		removeField(&paragraph, "Valid-Until")
+	}
+
+	files := ArchiveState{}
+	if err := suite.archive.signRelease(suite, &paragraph, files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Check every index listed in the Release that's currently published
+// against the strongest hash the Release has for it.
+func (a Archive) checkPublishedIndices(suite Suite, release *Release) error {
+	hashes := map[string]control.FileHash{}
+	for _, el := range release.MD5Sum {
+		hashes[el.Filename] = el.FileHash
+	}
+	for _, el := range release.SHA1 {
+		hashes[el.Filename] = el.FileHash
+	}
+	for _, el := range release.SHA256 {
+		hashes[el.Filename] = el.FileHash
+	}
+	for _, el := range release.SHA512 {
+		hashes[el.Filename] = el.FileHash
+	}
+
+	for filename, hash := range hashes {
+		target := path.Join("dists", suite.Name, filename)
+		fd, err := a.OpenPath(target)
+		if os.IsNotExist(err) {
+			/* Uncompressed indices are listed even if they're not present */
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = verifyHash(target, fd, hash)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a field from a Paragraph, if it's set.
+func removeField(paragraph *control.Paragraph, key string) {
+	if _, ok := paragraph.Values[key]; !ok {
+		return
+	}
+	delete(paragraph.Values, key)
+
+	order := []string{}
+	for _, el := range paragraph.Order {
+		if el != key {
+			order = append(order, el)
+		}
+	}
+	paragraph.Order = order
+}
+
+// }}}
+
+// vim: foldmethod=marker
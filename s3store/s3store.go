@@ -0,0 +1,319 @@
+// Package s3store provides an archive.Store that keeps an Archive in an
+// Amazon S3 (or S3 compatible) bucket, so that it can be published
+// directly to a bucket fronting a CDN.
+//
+// Blobs are kept under the ".blobs/" prefix, named by their ID, and are
+// published by copying them to their path in the bucket. Each published
+// object records the ID of its blob in its metadata, which is used to
+// Lookup paths and to decide what's still in use during GC.
+package s3store
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"pault.ag/go/archive"
+)
+
+// Metadata key each published object stores its blob's ID under.
+const blobMetadata = "archive-blob"
+
+// Store {{{
+
+// Store is an archive.Store backed by an S3 bucket.
+type Store struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	ctx    context.Context
+}
+
+// Create a new Store, keeping the Archive in `bucket`, with every key
+// prefixed by `prefix` (which may be empty, to use the whole bucket).
+func New(client *s3.Client, bucket, prefix string) *Store {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return &Store{client: client, bucket: bucket, prefix: prefix}
+}
+
+// Get a copy of the Store, which makes every request with `ctx`, so that
+// they can be cancelled, or given a deadline.
+func (s Store) WithContext(ctx context.Context) archive.Store {
+	s.ctx = ctx
+	return &s
+}
+
+func (s Store) requestContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func (s Store) key(target string) string {
+	return s.prefix + strings.TrimPrefix(target, "/")
+}
+
+func (s Store) blobKey(obj archive.Object) string {
+	return s.key(path.Join(".blobs", obj.ID))
+}
+
+// Blobs are written to a local temporary file first, since we need to
+// know the hash of the data before we know where it's going to live.
+type writer struct {
+	fd        *os.File
+	hash      hash.Hash
+	size      int64
+	committed bool
+	closed    bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.fd.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.fd.Close()
+	os.Remove(w.fd.Name())
+	return err
+}
+
+func (s Store) Create() (archive.Writer, error) {
+	fd, err := os.CreateTemp("", "archive-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{fd: fd, hash: sha256.New()}, nil
+}
+
+func (s Store) Commit(w archive.Writer) (*archive.Object, error) {
+	blob, ok := w.(*writer)
+	if !ok {
+		return nil, fmt.Errorf("Writer was not created by an s3store.Store")
+	}
+	defer blob.Close()
+
+	obj := archive.Object{ID: fmt.Sprintf("%x", blob.hash.Sum(nil))}
+	ctx := s.requestContext()
+
+	/* Content addressed, so if it's already there, we're done */
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.blobKey(obj)),
+	})
+	if err == nil {
+		return &obj, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	if _, err := blob.fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(s.blobKey(obj)),
+		Body:          blob.fd,
+		ContentLength: aws.Int64(blob.size),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (s Store) Open(obj archive.Object) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(s.requestContext(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.blobKey(obj)),
+	})
+	if isNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Copy the blob to the target key. S3 replaces objects atomically, so
+// readers will see either the old or new object.
+func (s Store) Link(obj archive.Object, target string) error {
+	_, err := s.client.CopyObject(s.requestContext(), &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(s.key(target)),
+		CopySource:        aws.String(s.bucket + "/" + url.PathEscape(s.blobKey(obj))),
+		Metadata:          map[string]string{blobMetadata: obj.ID},
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	return err
+}
+
+func (s Store) Unlink(target string) error {
+	if _, err := s.Lookup(target); err != nil {
+		return err
+	}
+	_, err := s.client.DeleteObject(s.requestContext(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(target)),
+	})
+	return err
+}
+
+func (s Store) Lookup(target string) (*archive.Object, error) {
+	out, err := s.client.HeadObject(s.requestContext(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(target)),
+	})
+	if isNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := out.Metadata[blobMetadata]
+	if !ok {
+		return nil, fmt.Errorf("%s is not linked to any blob", target)
+	}
+	return &archive.Object{ID: id}, nil
+}
+
+// Call `fn` with every key under the prefix (relative to the Store's own
+// prefix).
+func (s Store) walk(prefix string, fn func(string) error) error {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(s.requestContext())
+		if err != nil {
+			return err
+		}
+		for _, el := range page.Contents {
+			if err := fn(strings.TrimPrefix(aws.ToString(el.Key), s.prefix)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s Store) List(prefix string) ([]string, error) {
+	ret := []string{}
+	err := s.walk(prefix, func(target string) error {
+		if !strings.HasPrefix(target, ".blobs/") {
+			ret = append(ret, target)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s Store) Stat(obj archive.Object) (*archive.ObjectInfo, error) {
+	out, err := s.client.HeadObject(s.requestContext(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.blobKey(obj)),
+	})
+	if isNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &archive.ObjectInfo{
+		Object:  obj,
+		Size:    aws.ToInt64(out.ContentLength),
+		ModTime: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+// Find every blob that no published object points to.
+func (s Store) Garbage() ([]archive.Object, error) {
+	targets, err := s.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	linked := map[string]bool{}
+	for _, target := range targets {
+		obj, err := s.Lookup(target)
+		if err != nil {
+			/* Not something we published, leave it be */
+			continue
+		}
+		linked[obj.ID] = true
+	}
+
+	ret := []archive.Object{}
+	err = s.walk(".blobs/", func(target string) error {
+		if id := path.Base(target); !linked[id] {
+			ret = append(ret, archive.Object{ID: id})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Remove every blob that no published object points to.
+func (s Store) GC() error {
+	garbage, err := s.Garbage()
+	if err != nil {
+		return err
+	}
+	for _, obj := range garbage {
+		_, err := s.client.DeleteObject(s.requestContext(), &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.blobKey(obj)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+	return errors.As(err, &notFound) || errors.As(err, &noSuchKey)
+}
+
+// }}}
+
+// vim: foldmethod=marker
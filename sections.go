@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// Section and Priority Policy {{{
+
+// The Sections a Package may be in, after any Component prefix (such as
+// "contrib/") is taken off; the Sections Debian's archive knows about.
+var knownSections = map[string]bool{
+	"admin": true, "cli-mono": true, "comm": true, "database": true,
+	"debian-installer": true, "debug": true, "devel": true, "doc": true,
+	"editors": true, "education": true, "electronics": true,
+	"embedded": true, "fonts": true, "games": true, "gnome": true,
+	"gnu-r": true, "gnustep": true, "golang": true, "graphics": true,
+	"hamradio": true, "haskell": true, "httpd": true,
+	"interpreters": true, "introspection": true, "java": true,
+	"javascript": true, "kde": true, "kernel": true, "libdevel": true,
+	"libs": true, "lisp": true, "localization": true, "mail": true,
+	"math": true, "metapackages": true, "misc": true, "net": true,
+	"news": true, "ocaml": true, "oldlibs": true, "otherosfs": true,
+	"perl": true, "php": true, "python": true, "ruby": true, "rust": true,
+	"science": true, "shells": true, "sound": true, "tasks": true,
+	"tex": true, "text": true, "utils": true, "vcs": true, "video": true,
+	"web": true, "x11": true, "xfce": true, "zope": true,
+}
+
+// The Priorities a Package may have. "extra" has been deprecated in favour
+// of "optional" since Debian Policy 4.0.1, so it isn't one of them.
+var knownPriorities = map[string]bool{
+	"required":  true,
+	"important": true,
+	"standard":  true,
+	"optional":  true,
+}
+
+// SectionPolicy decides what's done with a Package added to a Suite with a
+// Section or Priority that isn't one the archive knows about.
+type SectionPolicy int
+
+const (
+	// Don't check the Section or Priority at all. This is the default.
+	AnySection SectionPolicy = iota
+
+	// Refuse to add the Package; AddPackage returns an error.
+	StrictSections
+
+	// Add the Package anyway, with an unknown Section replaced by "misc"
+	// (keeping any Component prefix), and an unknown Priority by
+	// "optional".
+	LenientSections
+)
+
+// Override is the Section and Priority a Package (by name) is published
+// with, no matter what its own entry says, like the override files dak
+// and apt-ftparchive use. Empty fields aren't overridden.
+type Override struct {
+	Section  string
+	Priority string
+}
+
+// Set how the Section and Priority of each Package added to the Suite are
+// checked, and any Overrides (by Package name) to apply before they're
+// checked. Empty Sections and Priorities are left alone, in either policy.
+//
+// Sections may have a Component prefix, such as "contrib/net"; only the
+// part after it is checked.
+func (s *Suite) SetSectionPolicy(policy SectionPolicy, overrides map[string]Override) error {
+	switch policy {
+	case AnySection, StrictSections, LenientSections:
+	default:
+		return fmt.Errorf("No such section policy: %d", int(policy))
+	}
+	s.features.Sections = policy
+	s.features.Overrides = overrides
+	return nil
+}
+
+// Check if a Section (with or without a Component prefix) is known.
+func isKnownSection(section string) bool {
+	if i := strings.LastIndex(section, "/"); i != -1 {
+		section = section[i+1:]
+	}
+	return knownSections[section]
+}
+
+// Apply the Override to a Package, returning the Package with the
+// overridden Section and Priority, without changing the Paragraph the
+// caller handed in.
+func (o Override) apply(pkg Package) Package {
+	section, priority := pkg.Section, pkg.Priority
+	if o.Section != "" {
+		section = o.Section
+	}
+	if o.Priority != "" {
+		priority = o.Priority
+	}
+	return withSection(pkg, section, priority)
+}
+
+// Apply the Suite's Overrides and SectionPolicy to a Package, returning
+// the Package as it's to be added to the Suite.
+func (s Suite) checkSection(pkg Package) (Package, error) {
+	if override, ok := s.features.Overrides[pkg.Package]; ok {
+		pkg = override.apply(pkg)
+	}
+	section, priority := pkg.Section, pkg.Priority
+
+	sectionOk := section == "" || isKnownSection(section)
+	priorityOk := priority == "" || knownPriorities[priority]
+
+	switch s.features.Sections {
+	case StrictSections:
+		if !sectionOk {
+			return pkg, fmt.Errorf("Unknown Section for %s: '%s'", pkg.Package, section)
+		}
+		if !priorityOk {
+			return pkg, fmt.Errorf("Unknown Priority for %s: '%s'", pkg.Package, priority)
+		}
+	case LenientSections:
+		if !sectionOk {
+			section = path.Join(path.Dir(section), "misc")
+		}
+		if !priorityOk {
+			priority = "optional"
+		}
+	}
+
+	return withSection(pkg, section, priority), nil
+}
+
+// Get a copy of the Package with the given Section and Priority, leaving
+// the Paragraph the caller handed in alone.
+func withSection(pkg Package, section, priority string) Package {
+	if section == pkg.Section && priority == pkg.Priority {
+		return pkg
+	}
+
+	paragraph := control.Paragraph{Values: map[string]string{}, Order: []string{}}
+	for _, key := range pkg.Paragraph.Order {
+		paragraph.Set(key, pkg.Paragraph.Values[key])
+	}
+	if section != pkg.Section {
+		paragraph.Set("Section", section)
+	}
+	if priority != pkg.Priority {
+		paragraph.Set("Priority", priority)
+	}
+	pkg.Paragraph = paragraph
+	pkg.Section = section
+	pkg.Priority = priority
+	return pkg
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,253 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Server {{{
+
+// Server is an http.Handler serving whatever is published in a Store, so
+// that an Archive can be tested with apt right away, without setting up a
+// web server.
+//
+// Directories get a simple listing, and uncompressed indices are gzip
+// compressed on the fly for clients that accept it. Files are opened by
+// path if the Store can (see PathOpener), rather than looked up. Nothing
+// hidden (such as the FilesystemStore's blobs) is ever served.
+type Server struct {
+	store Store
+}
+
+// Create a new Server for everything published in the Store.
+func NewServer(store Store) *Server {
+	return &Server{store: store}
+}
+
+// Content types for files in an Archive that mime doesn't know about.
+var contentTypes = map[string]string{
+	".deb":  "application/vnd.debian.binary-package",
+	".udeb": "application/vnd.debian.binary-package",
+	".dsc":  "text/plain; charset=utf-8",
+	".gpg":  "application/pgp-signature",
+	".asc":  "application/pgp-keys",
+	".gz":   "application/gzip",
+	".xz":   "application/x-xz",
+	".bz2":  "application/x-bzip2",
+	".zst":  "application/zstd",
+	".yml":  "text/yaml; charset=utf-8",
+}
+
+// Uncompressed files apt fetches, which are worth compressing on the fly.
+var plainIndices = map[string]bool{
+	"Release":   true,
+	"InRelease": true,
+	"Packages":  true,
+	"Sources":   true,
+	"Contents":  true,
+	"changelog": true,
+}
+
+func contentType(target string) string {
+	base := path.Base(target)
+	if plainIndices[base] || strings.HasPrefix(base, "Contents-") {
+		return "text/plain; charset=utf-8"
+	}
+	ext := path.Ext(base)
+	if contentType, ok := contentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	for _, part := range strings.Split(target, "/") {
+		if strings.HasPrefix(part, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	var err error
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		var fd io.ReadCloser
+		var info *ObjectInfo
+		fd, info, err = s.open(target)
+		if err == nil {
+			defer fd.Close()
+			s.serveObject(w, r, target, fd, *info)
+			return
+		}
+	}
+
+	entries, listErr := s.store.List(target)
+	if listErr != nil {
+		http.Error(w, listErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	s.serveListing(w, r, target, entries)
+}
+
+// Open whatever is published at `target`, by path if the Store can, so
+// that serving a large file doesn't mean hashing all of it first.
+func (s Server) open(target string) (io.ReadCloser, *ObjectInfo, error) {
+	if opener, ok := s.store.(PathOpener); ok {
+		return opener.OpenPath(target)
+	}
+
+	obj, err := s.store.Lookup(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd, err := s.store.Open(*obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := s.store.Stat(*obj)
+	if err != nil {
+		info = &ObjectInfo{Object: *obj}
+	}
+	return fd, info, nil
+}
+
+func (s Server) serveObject(w http.ResponseWriter, r *http.Request, target string, fd io.ReadCloser, info ObjectInfo) {
+	modTime := info.ModTime
+
+	etag := info.ID
+	if etag == "" {
+		/* Opened by path; the size and age of the file will do */
+		etag = fmt.Sprintf("%x-%x", info.ModTime.UnixNano(), info.Size)
+	}
+
+	w.Header().Set("Content-Type", contentType(target))
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", etag))
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if plainIndices[path.Base(target)] && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if !modTime.IsZero() {
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		writer := gzip.NewWriter(w)
+		defer writer.Close()
+		io.Copy(writer, fd)
+		return
+	}
+
+	if seeker, ok := fd.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(target), modTime, seeker)
+		return
+	}
+
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, fd)
+}
+
+// Check if the client will take a gzip Content-Encoding; that is, it lists
+// gzip in its Accept-Encoding, without a q-value of 0 (or one that can't
+// be parsed).
+func acceptsGzip(r *http.Request) bool {
+	for _, el := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(el, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+				return false
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// Render the immediate children of `target` (given every path under it).
+func (s Server) serveListing(w http.ResponseWriter, r *http.Request, target string, entries []string) {
+	prefix := ""
+	if target != "" {
+		prefix = target + "/"
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, entry := range entries {
+		rest := strings.TrimPrefix(entry, prefix)
+		name := rest
+		if i := strings.Index(rest, "/"); i != -1 {
+			name = rest[:i+1]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	title := html.EscapeString("/" + prefix)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>Index of %s</title></head><body>\n", title)
+	fmt.Fprintf(w, "<h1>Index of %s</h1>\n<ul>\n", title)
+	if target != "" {
+		fmt.Fprintf(w, "<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, name := range names {
+		escaped := html.EscapeString(name)
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", escaped, escaped)
+	}
+	fmt.Fprintf(w, "</ul>\n</body></html>\n")
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,37 @@
+package archive
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Server {{{
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                       false,
+		"gzip":                   true,
+		"GZIP":                   true,
+		"deflate, gzip":          true,
+		"gzip;q=0.5":             true,
+		"gzip; q=0.05":           true,
+		"gzip;q=0":               false,
+		"gzip;q=0.000":           false,
+		"gzip;q=nope":            false,
+		"identity, deflate;q=1":  false,
+		"gzip;level=1, deflate":  true,
+		"x-gzip, identity;q=0.1": false,
+	} {
+		r := &http.Request{Header: http.Header{}}
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		if got := acceptsGzip(r); got != expected {
+			t.Errorf("acceptsGzip(%q) = %t, expected %t", header, got, expected)
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
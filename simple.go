@@ -0,0 +1,97 @@
+package archive
+
+import (
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Simple {{{
+
+// Simple is a single Suite with a single Component, for the common case of
+// publishing a handful of .debs somewhere apt can get at them, without
+// dealing with the Archive, Pool, Suite, Component and ArchiveState
+// directly. They're all still there, on the Archive and Suite fields, for
+// anything Simple doesn't cover.
+//
+//	repo, err := archive.NewSimple("/srv/apt", signer, "stable", "main")
+//	...
+//	if _, err := repo.AddDebs("foo_1.0_amd64.deb", "bar_2.0_all.deb"); err != nil {
+//		...
+//	}
+//	err = repo.Publish()
+type Simple struct {
+	Archive *Archive
+	Suite   *Suite
+
+	component string
+}
+
+// Create (or open) an Archive at `root` on the filesystem, signed with
+// `signer`, and get a Simple to publish the Suite `suite`, with a single
+// Component `component`. If the Suite's already published, it starts off
+// with everything already in it, so nothing published before is dropped.
+//
+// A .deb added with the same name, version and architecture as one that's
+// already in the Suite replaces it.
+func NewSimple(root string, signer *openpgp.Entity, suite, component string) (*Simple, error) {
+	a, err := New(root, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := a.OpenSuite(suite)
+	if os.IsNotExist(err) {
+		s, err = a.Suite(suite)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.SetDuplicatePolicy(ReplaceDuplicates)
+	if _, err := s.Component(component); err != nil {
+		return nil, err
+	}
+
+	return &Simple{Archive: a, Suite: s, component: component}, nil
+}
+
+// Copy .deb files (by path) into the Pool, and add them to the Suite, to
+// be published on the next call to Publish. This returns the Package
+// entries of every .deb added, in the same order as the paths.
+func (s *Simple) AddDebs(paths ...string) ([]Package, error) {
+	component, err := s.Suite.Component(s.component)
+	if err != nil {
+		return nil, err
+	}
+	packages, err := s.Archive.Pool.IncludeDebs(component.name, paths, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range packages {
+		if err := component.AddPackage(pkg); err != nil {
+			return nil, err
+		}
+	}
+	return packages, nil
+}
+
+// Publish the Suite; write out its indices and Release, sign it, link it
+// all into place, and then remove anything that no published Suite refers
+// to any more. This is done while holding the Archive's Lock.
+func (s *Simple) Publish() error {
+	return s.Archive.WithLock(func() error {
+		files, err := s.Archive.Engross(*s.Suite)
+		if err != nil {
+			return err
+		}
+		if err := s.Archive.Link(files); err != nil {
+			return err
+		}
+		_, err = s.Archive.GCUnreferenced()
+		return err
+	})
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,110 @@
+package archive
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Snapshot {{{
+
+// Get the name of the directory under dists/ that a Snapshot of a Suite
+// lives in.
+func snapshotDist(suite, name string) string {
+	return fmt.Sprintf("%s@%s", suite, name)
+}
+
+// Record the ArchiveState of a Suite (as returned by Engross) as an
+// immutable, named Snapshot. This will return a new ArchiveState, with
+// each file under dists/<suite>/ moved to dists/<suite>@<name>/, fit for
+// passage to Link.
+//
+// Since the Snapshot's indices live under dists/, the pool files they
+// reference are kept around for as long as the Snapshot exists. Snapshots
+// can't be overwritten; if a Snapshot with this name already exists, this
+// will return an error. Files linked for the Suite's aliases are left out
+// of the Snapshot.
+func (a Archive) Snapshot(suite string, name string, state ArchiveState) (ArchiveState, error) {
+	if name == "" || strings.ContainsAny(name, "/@") {
+		return nil, fmt.Errorf("Invalid snapshot name: '%s'", name)
+	}
+
+	snapshotRoot := path.Join("dists", snapshotDist(suite, name))
+	existing, err := a.Store.List(snapshotRoot)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) != 0 {
+		return nil, fmt.Errorf("Snapshot %s of %s already exists", name, suite)
+	}
+
+	suiteRoot := path.Join("dists", suite) + "/"
+	ret := ArchiveState{}
+	for filePath, obj := range state {
+		if !strings.HasPrefix(filePath, suiteRoot) {
+			if isAliasOf(state, suite, filePath) {
+				continue
+			}
+			return nil, fmt.Errorf("%s is not part of %s", filePath, suite)
+		}
+		ret[path.Join(snapshotRoot, strings.TrimPrefix(filePath, suiteRoot))] = obj
+	}
+	return ret, nil
+}
+
+// Get the names of every Snapshot of the given Suite, sorted.
+func (a Archive) Snapshots(suite string) ([]string, error) {
+	prefix := path.Join("dists", snapshotDist(suite, ""))
+	targets, err := a.Store.List(path.Dir(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, target := range targets {
+		if !strings.HasPrefix(target, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(target, prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Create an ArchiveState which will re-publish the Snapshot `name` as
+// the Suite itself (under dists/<suite>/), fit for passage to Link. This
+// reuses the Snapshot's blobs as-is.
+//
+// Files under dists/<suite>/ that are not part of the Snapshot are left
+// alone, not removed.
+func (a Archive) RestoreSnapshot(suite string, name string) (ArchiveState, error) {
+	snapshotRoot := path.Join("dists", snapshotDist(suite, name))
+	targets, err := a.Store.List(snapshotRoot)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("No such snapshot %s of %s", name, suite)
+	}
+
+	ret := ArchiveState{}
+	for _, target := range targets {
+		obj, err := a.Store.Lookup(target)
+		if err != nil {
+			return nil, err
+		}
+		relPath := strings.TrimPrefix(target, snapshotRoot+"/")
+		ret[path.Join("dists", suite, relPath)] = *obj
+	}
+	return ret, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
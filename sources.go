@@ -23,6 +23,7 @@ package archive
 import (
 	"fmt"
 	"io"
+	"iter"
 	"os"
 	"strings"
 
@@ -111,6 +112,21 @@ func (s Source) BuildDepends() (*dependency.Dependency, error) {
 	return dependency.Parse(s.Paragraph.Values["Build-Depends"])
 }
 
+// Add a FileHash to the Files or Checksums-* list matching its Algorithm.
+func (s *Source) addHash(h control.FileHash) error {
+	switch h.Algorithm {
+	case "md5":
+		s.Files = append(s.Files, control.MD5FileHash{FileHash: h})
+	case "sha1":
+		s.ChecksumsSha1 = append(s.ChecksumsSha1, control.SHA1FileHash{FileHash: h})
+	case "sha256":
+		s.ChecksumsSha256 = append(s.ChecksumsSha256, control.SHA256FileHash{FileHash: h})
+	default:
+		return fmt.Errorf("No known hash: '%s'", h.Algorithm)
+	}
+	return nil
+}
+
 // }}}
 
 // SourceFromDsc {{{
@@ -119,6 +135,7 @@ func SourceFromDsc(dsc *control.DSC, directory string) (*Source, error) {
 	pkg := Source{}
 
 	paragraph := dsc.Paragraph
+	paragraph.Set("Package", dsc.Source)
 	paragraph.Set("Directory", directory)
 	// paragraph.Set("Filename", debFile.Path)
 
@@ -131,10 +148,36 @@ func SourceFromDsc(dsc *control.DSC, directory string) (*Source, error) {
 
 // Sources {{{
 
+// Iterator to access the entries contained in the Sources entry in an
+// apt repo. This contains information about the Debian source packages.
 type Sources struct {
 	decoder *control.Decoder
+	closer  io.Closer
+}
+
+// Map {{{
+
+// Get any sources that match the criteria
+func (p *Sources) Map(q func(*Source) bool) ([]Source, error) {
+	ret := []Source{}
+
+	for {
+		src, err := p.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if q(src) {
+			ret = append(ret, *src)
+		}
+	}
 }
 
+// }}}
+
 // Next {{{
 
 // Get the next Source entry in the Sources list. This will return an
@@ -146,6 +189,53 @@ func (p *Sources) Next() (*Source, error) {
 
 // }}}
 
+// All {{{
+
+// Get an iterator over the rest of the Source entries in the Sources list,
+// for use with range:
+//
+//	for src, err := range sources.All() {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// Iteration stops after the first error is yielded. Reaching the end of
+// the list is not an error.
+func (p *Sources) All() iter.Seq2[*Source, error] {
+	return func(yield func(*Source, error) bool) {
+		for {
+			src, err := p.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(src, nil) {
+				return
+			}
+		}
+	}
+}
+
+// }}}
+
+// Close {{{
+
+// Close the underlying file, if this Sources iterator was created by
+// LoadSourcesFile. This is a no-op otherwise.
+func (p *Sources) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// }}}
+
 // LoadSourcesFile {{{
 
 // Given a path, create a Sources iterator. Note that the Sources
@@ -156,7 +246,13 @@ func LoadSourcesFile(path string) (*Sources, error) {
 	if err != nil {
 		return nil, err
 	}
-	return LoadSources(fd)
+	ret, err := LoadSources(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	ret.closer = fd
+	return ret, nil
 }
 
 // }}}
@@ -166,8 +262,16 @@ func LoadSourcesFile(path string) (*Sources, error) {
 // Given an io.Reader, create a Sources iterator. Note that the Sources
 // file is not OpenPGP signed, so one will need to verify the integrety
 // of this file from the InRelease file before trusting any output.
+//
+// The data may be gzip, xz or zstd compressed (as published in dists/), or
+// uncompressed.
 func LoadSources(in io.Reader) (*Sources, error) {
-	decoder, err := control.NewDecoder(in, nil)
+	reader, err := decompress(in)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := control.NewDecoder(reader, nil)
 	if err != nil {
 		return nil, err
 	}
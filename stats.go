@@ -0,0 +1,174 @@
+package archive
+
+import (
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Stats {{{
+
+// IndexStats describes a single Packages or Sources index in an
+// ArchiveState. Architecture is "source" for the Sources index.
+type IndexStats struct {
+	Suite        string
+	Component    string
+	Architecture string
+
+	// Number of entries in the index.
+	Entries int
+
+	// Size of the index itself, in bytes.
+	Size int64
+}
+
+// PublishStats describes an ArchiveState (as returned by Engross), for
+// checking over before it's passed to Link.
+type PublishStats struct {
+	Indices []IndexStats
+
+	// Total size of every file in the ArchiveState (indices, Release
+	// files and signatures), in bytes.
+	IndexBytes int64
+
+	// Total size of every pool file referenced by the indices, in bytes.
+	PoolBytes int64
+
+	// Number of paths that would be linked to a different blob than they
+	// are now (or weren't linked at all), and the number that are already
+	// linked to the same blob.
+	NewBlobs    int
+	ReusedBlobs int
+}
+
+// Get the PublishStats of an ArchiveState, without changing anything.
+func (a Archive) Stats(state ArchiveState) (*PublishStats, error) {
+	ret := PublishStats{Indices: []IndexStats{}}
+	pool := map[string]int64{}
+	counted := map[string]bool{}
+
+	targets := []string{}
+	for target := range state {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		obj := state[target]
+
+		info, err := a.Store.Stat(obj)
+		if err != nil {
+			return nil, err
+		}
+		ret.IndexBytes += info.Size
+
+		if current, err := a.Store.Lookup(target); err == nil && current.ID == obj.ID {
+			ret.ReusedBlobs++
+		} else {
+			ret.NewBlobs++
+		}
+
+		/* dists/<suite>/<component>/<binary-arch or source>/<index> */
+		parts := strings.Split(target, "/")
+		if len(parts) < 5 || parts[0] != "dists" {
+			continue
+		}
+		index := IndexStats{
+			Suite:     parts[1],
+			Component: strings.Join(parts[2:len(parts)-2], "/"),
+			Size:      info.Size,
+		}
+		indexDir := parts[len(parts)-2]
+
+		/* Count each index once, no matter how many compressions of it
+		 * there are; the uncompressed file sorts first, if it's there */
+		name := stripCompression(path.Base(target))
+		if counted[path.Join(path.Dir(target), name)] {
+			continue
+		}
+		counted[path.Join(path.Dir(target), name)] = true
+
+		switch {
+		case name == "Packages" && strings.HasPrefix(indexDir, "binary-"):
+			index.Architecture = strings.TrimPrefix(indexDir, "binary-")
+			index.Entries, err = a.packagesStats(obj, pool)
+		case name == "Sources" && indexDir == "source":
+			index.Architecture = "source"
+			index.Entries, err = a.sourcesStats(obj, pool)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret.Indices = append(ret.Indices, index)
+	}
+
+	for _, size := range pool {
+		ret.PoolBytes += size
+	}
+	return &ret, nil
+}
+
+// Count the entries of a Packages index, recording the size of each pool
+// file it references.
+func (a Archive) packagesStats(obj Object, pool map[string]int64) (int, error) {
+	fd, err := a.Store.Open(obj)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	packages, err := LoadPackages(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	entries := 0
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		entries++
+		pool[pkg.Filename] = int64(pkg.Size)
+	}
+}
+
+// Count the entries of a Sources index, recording the size of each pool
+// file it references.
+func (a Archive) sourcesStats(obj Object, pool map[string]int64) (int, error) {
+	fd, err := a.Store.Open(obj)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	sources, err := LoadSources(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	entries := 0
+	for {
+		src, err := sources.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		entries++
+		for _, file := range src.Files {
+			pool[path.Join(src.Directory, file.Filename)] = file.Size
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,201 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Store {{{
+
+// Object is a handle to a blob that has been committed to a Store. Objects
+// are content addressed, and the ID is the hex encoded SHA256 of the blob.
+type Object struct {
+	ID string
+}
+
+// ObjectInfo describes a committed blob.
+type ObjectInfo struct {
+	Object
+
+	// Size of the blob, in bytes.
+	Size int64
+
+	// When the blob was committed to the Store.
+	ModTime time.Time
+}
+
+// Writer is a blob that's in the process of being written to a Store.
+// Once all the data has been written, the Writer must be passed to
+// Store.Commit to get a handle to the Object. Closing a Writer that was
+// never committed will throw away anything written to it.
+type Writer interface {
+	io.Writer
+	io.Closer
+}
+
+// Store is the storage backend an Archive writes to. Blobs are written
+// with Create and Commit, after which the resulting Object can be linked
+// to any number of paths (such as "pool/main/f/foo/foo_1.0_all.deb" or
+// "dists/unstable/InRelease") to publish it.
+//
+// Blobs not linked to any path may be removed by GC at any time after they
+// were committed. A Store must be safe for concurrent use.
+//
+// A Store may wrap another that keeps blobs differently than they read
+// back (such as a CompressedStore or EncryptedStore). What the wrapped
+// Store publishes can't be served as-is; serve the Archive with a Server
+// on the wrapping Store instead.
+type Store interface {
+	// Create a new Writer to write a blob into.
+	Create() (Writer, error)
+
+	// Commit the data written to a Writer (created by this Store) into the
+	// Store, and return the Object for it.
+	Commit(Writer) (*Object, error)
+
+	// Read back the blob for a committed Object.
+	Open(Object) (io.ReadCloser, error)
+
+	// Publish the Object at the given path (relative to the root of the
+	// Store), replacing anything that was there. Readers of the path must
+	// see either the old or new blob, never a mix of the two.
+	Link(Object, string) error
+
+	// Remove whatever is published at the given path. If nothing is linked
+	// to the path, the error must satisfy os.IsNotExist.
+	Unlink(string) error
+
+	// Get the Object currently published at the given path. If nothing is
+	// linked to the path, the error must satisfy os.IsNotExist.
+	Lookup(string) (*Object, error)
+
+	// Get every path under the given prefix that has an Object linked to
+	// it, sorted.
+	List(string) ([]string, error)
+
+	// Get the size and age of a committed Object.
+	Stat(Object) (*ObjectInfo, error)
+
+	// Get every blob that isn't linked to any path, which is to say,
+	// everything GC would remove.
+	Garbage() ([]Object, error)
+
+	// Remove any blobs that aren't linked to any path.
+	GC() error
+}
+
+// ObjectRemover is a Store which can remove a single blob, such as for GC
+// with a grace period (see SetGCGracePeriod).
+type ObjectRemover interface {
+	Store
+
+	// Remove a single blob, whether or not it's linked to anything. If
+	// there's no such blob, the error must satisfy os.IsNotExist.
+	Remove(Object) error
+}
+
+// PathOpener is a Store which can read back whatever is published at a
+// path without finding out which Object it is first, such as one where
+// Lookup has to hash the whole file.
+type PathOpener interface {
+	Store
+
+	// Read back whatever is published at the given path, along with its
+	// size and age; the ObjectInfo has no Object ID. If nothing is
+	// published at the path, the error must satisfy os.IsNotExist.
+	OpenPath(string) (io.ReadCloser, *ObjectInfo, error)
+}
+
+// ObjectVerifier is a Store which checks a blob against its Object ID
+// itself, such as one that stores blobs differently than they read back.
+type ObjectVerifier interface {
+	Store
+
+	// Check that the blob stored for the Object still hashes to its ID.
+	Verify(Object) error
+}
+
+// Check that the blob stored for `obj` still hashes to its ID; with the
+// Store's own Verify, if it has one, or by reading it back.
+func verifyObject(store Store, obj Object) error {
+	if verifier, ok := store.(ObjectVerifier); ok {
+		return verifier.Verify(obj)
+	}
+
+	fd, err := store.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fd); err != nil {
+		return err
+	}
+	if sum := fmt.Sprintf("%x", hash.Sum(nil)); sum != obj.ID {
+		return fmt.Errorf("Blob %s is corrupt: it hashes to %s", obj.ID, sum)
+	}
+	return nil
+}
+
+// ContextStore is a Store which can make its operations with a
+// context.Context, such as a Store backed by a remote service.
+type ContextStore interface {
+	Store
+
+	// Get a copy of the Store which makes every operation with `ctx`.
+	WithContext(ctx context.Context) Store
+}
+
+// Bind the Store to `ctx`, if the Store supports it.
+func storeWithContext(store Store, ctx context.Context) Store {
+	if contextStore, ok := store.(ContextStore); ok {
+		return contextStore.WithContext(ctx)
+	}
+	return store
+}
+
+// contextReader is an io.Reader which stops with the context's error once
+// the context is done, so that long copies can be cancelled.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// Read back whatever is currently published at `target` (relative to the
+// root of the Archive, such as "dists/unstable/InRelease"). If nothing is
+// published there, the error satisfies os.IsNotExist.
+func (a Archive) OpenPath(target string) (io.ReadCloser, error) {
+	obj, err := a.Store.Lookup(target)
+	if err != nil {
+		return nil, err
+	}
+	return a.Store.Open(*obj)
+}
+
+// Read back the committed blob with the given hex encoded SHA256 (which
+// is its Object ID), whether or not it's published anywhere, such as a pool
+// file by the SHA256 its Package entry gives. For a CompressedStore or an
+// EncryptedStore, the ID is the SHA256 of the blob as it's stored, not as it
+// reads back.
+func (a Archive) Open(hash string) (io.ReadCloser, error) {
+	if len(hash) != sha256.Size*2 || strings.Trim(hash, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("Not a SHA256: '%s'", hash)
+	}
+	return a.Store.Open(Object{ID: hash})
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// Transaction {{{
+
+// transaction is a single Link of an ArchiveState into the Archive. Before
+// anything is changed, every Object is checked to make sure it's in the
+// Store, and whatever is currently linked at each path is recorded. Only
+// then are the Objects linked into place, so that any failure can be rolled
+// back to exactly how the Archive looked before.
+type transaction struct {
+	archive *Archive
+
+	// Store to roll back with; the Archive's Store if nil.
+	undo Store
+
+	// Whatever was linked to each path before the transaction, or nil if
+	// nothing was.
+	previous map[string]*Object
+
+	// Paths that have been linked so far, in order.
+	linked []string
+}
+
+func (a Archive) newTransaction() *transaction {
+	return &transaction{
+		archive:  &a,
+		previous: map[string]*Object{},
+		linked:   []string{},
+	}
+}
+
+// Make sure every Object can be read back from the Store (and, if the
+// Archive verifies on Link, still matches its ID), and record what each
+// path currently points to.
+func (t *transaction) stage(blobs ArchiveState) error {
+	verified := map[string]bool{}
+	for target, obj := range blobs {
+		if t.archive.verifyLink {
+			if !verified[obj.ID] {
+				if err := verifyObject(t.archive.Store, obj); err != nil {
+					return fmt.Errorf("Failed to stage %s: %s", target, err)
+				}
+				verified[obj.ID] = true
+			}
+			if err := t.record(target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fd, err := t.archive.Store.Open(obj)
+		if err != nil {
+			return fmt.Errorf("Failed to stage %s: %s", target, err)
+		}
+		_, err = io.CopyN(io.Discard, fd, 1)
+		fd.Close()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Failed to stage %s: %s", target, err)
+		}
+
+		if err := t.record(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Record what `target` currently points to, to roll back to.
+func (t *transaction) record(target string) error {
+	previous, err := t.archive.Store.Lookup(target)
+	if os.IsNotExist(err) {
+		t.previous[target] = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.previous[target] = previous
+	return nil
+}
+
+// Link an Object into place.
+func (t *transaction) swap(target string, obj Object) error {
+	t.linked = append(t.linked, target)
+	return t.archive.Store.Link(obj, target)
+}
+
+// Undo every swap, in reverse order, putting back whatever was linked
+// before, and removing anything that wasn't there.
+func (t *transaction) rollback() error {
+	store := t.undo
+	if store == nil {
+		store = t.archive.Store
+	}
+
+	var ret error
+	for i := len(t.linked) - 1; i >= 0; i-- {
+		target := t.linked[i]
+
+		var err error
+		if previous := t.previous[target]; previous != nil {
+			err = store.Link(*previous, target)
+		} else {
+			err = store.Unlink(target)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// Release files must be swapped in last, so that at no point do they
+// reference an index that's not in place yet.
+func linkOrder(blobs ArchiveState) []string {
+	isRelease := func(target string) bool {
+		switch path.Base(target) {
+		case "Release", "Release.gpg", "InRelease":
+			return true
+		}
+		return false
+	}
+
+	ret := []string{}
+	for target := range blobs {
+		ret = append(ret, target)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if isRelease(ret[i]) != isRelease(ret[j]) {
+			return !isRelease(ret[i])
+		}
+		return ret[i] < ret[j]
+	})
+	return ret
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,141 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Transaction {{{
+
+// Copy `data` into the Archive's Pool, and add it to `state`, to be linked
+// to `target`.
+func addTestBlob(t *testing.T, a *Archive, state ArchiveState, target string, data []byte) {
+	localPath := filepath.Join(t.TempDir(), "blob")
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := a.Pool.Copy(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state[target] = *obj
+}
+
+func TestLinkRollback(t *testing.T) {
+	root := t.TempDir()
+	a, err := New(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := ArchiveState{}
+	addTestBlob(t, a, old, "dists/unstable/main/binary-amd64/Packages", []byte("Package: foo\nVersion: 1.0\n"))
+	if err := a.Link(old); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Nothing can be linked under a file */
+	if err := os.WriteFile(filepath.Join(root, "dists/unstable/zz"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := ArchiveState{}
+	addTestBlob(t, a, blobs, "dists/unstable/main/binary-amd64/Packages", []byte("Package: foo\nVersion: 2.0\n"))
+	addTestBlob(t, a, blobs, "dists/unstable/main/binary-arm64/Packages", []byte("Package: bar\nVersion: 2.0\n"))
+	addTestBlob(t, a, blobs, "dists/unstable/zz/binary-amd64/Packages", []byte("Package: baz\nVersion: 2.0\n"))
+	addTestBlob(t, a, blobs, "dists/unstable/Release", []byte("Suite: unstable\n"))
+	if err := a.Link(blobs); err == nil {
+		t.Fatalf("Link didn't fail")
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "dists/unstable/main/binary-amd64/Packages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Package: foo\nVersion: 1.0\n" {
+		t.Errorf("Replaced index wasn't put back: %q", data)
+	}
+	for _, target := range []string{
+		"dists/unstable/main/binary-arm64/Packages",
+		"dists/unstable/Release",
+	} {
+		if _, err := os.Stat(filepath.Join(root, target)); !os.IsNotExist(err) {
+			t.Errorf("%s is still published after a rollback: %v", target, err)
+		}
+	}
+}
+
+// Write `data` into the Store as a blob.
+func commitBlob(t *testing.T, store Store, data []byte) Object {
+	writer, err := store.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := store.Commit(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *obj
+}
+
+// failingStore is a MemoryStore which fails to Link anything to one path.
+type failingStore struct {
+	*MemoryStore
+	target string
+}
+
+func (s failingStore) Link(obj Object, target string) error {
+	if target == s.target {
+		return fmt.Errorf("Failed to link %s", target)
+	}
+	return s.MemoryStore.Link(obj, target)
+}
+
+func TestLinkRollbackStore(t *testing.T) {
+	store := failingStore{MemoryStore: NewMemoryStore(), target: "dists/unstable/InRelease"}
+	a, err := NewWithStore(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPackages := commitBlob(t, store, []byte("Package: foo\nVersion: 1.0\n"))
+	if err := store.Link(oldPackages, "dists/unstable/main/binary-amd64/Packages"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.Link(ArchiveState{
+		"dists/unstable/main/binary-amd64/Packages": commitBlob(t, store, []byte("Package: foo\nVersion: 2.0\n")),
+		"dists/unstable/main/binary-arm64/Packages": commitBlob(t, store, []byte("Package: bar\nVersion: 2.0\n")),
+		"dists/unstable/Release":                    commitBlob(t, store, []byte("Suite: unstable\n")),
+		"dists/unstable/InRelease":                  commitBlob(t, store, []byte("Suite: unstable\n")),
+	})
+	if err == nil {
+		t.Fatalf("Link didn't fail")
+	}
+
+	obj, err := store.Lookup("dists/unstable/main/binary-amd64/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.ID != oldPackages.ID {
+		t.Errorf("Replaced index wasn't put back")
+	}
+	for _, target := range []string{
+		"dists/unstable/main/binary-arm64/Packages",
+		"dists/unstable/Release",
+		"dists/unstable/InRelease",
+	} {
+		if _, err := store.Lookup(target); !os.IsNotExist(err) {
+			t.Errorf("%s is still published after a rollback: %v", target, err)
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
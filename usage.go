@@ -0,0 +1,309 @@
+package archive
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Usage {{{
+
+// Usage is how much of the Store an Archive is using, and what for, as
+// returned by Archive.Usage. Every blob is only ever counted once in each
+// total, however many paths it's linked to.
+type Usage struct {
+	// Every published Suite (and Snapshot), sorted by name.
+	Suites []SuiteUsage
+
+	// Size of every blob linked to any path, in bytes.
+	LinkedBytes int64
+
+	// Size of every blob that's linked, but not referenced by any Suite;
+	// what GCUnreferenced would free (along with the GarbageBytes).
+	UnreferencedBytes int64
+
+	// Size of every blob that isn't linked anywhere; what GC would free.
+	GarbageBytes int64
+
+	// Size of every blob referenced by more than one Suite.
+	SharedBytes int64
+}
+
+// SuiteUsage is how much of the Store a single Suite (or Snapshot) is
+// using.
+type SuiteUsage struct {
+	Suite string
+
+	// Every Component of the Suite, sorted by name.
+	Components []ComponentUsage
+
+	// Size of the Suite's Release files, signatures and indices, and of
+	// every pool file its indices list, in bytes.
+	IndexBytes int64
+	PoolBytes  int64
+
+	// Size of every blob the Suite shares with any other Suite, and of
+	// every blob only this Suite uses; what removing the Suite (and then
+	// running GCUnreferenced) would free.
+	SharedBytes int64
+	UniqueBytes int64
+}
+
+// ComponentUsage is how much of the Store a single Component of a Suite is
+// using. Indices (such as Contents files) that aren't part of any
+// Component are only counted in the SuiteUsage.
+type ComponentUsage struct {
+	Component string
+
+	IndexBytes int64
+	PoolBytes  int64
+
+	// Size of every blob the Component shares with any other Component,
+	// of this Suite or any other.
+	SharedBytes int64
+}
+
+// Blobs (by Object ID), split up by what they're used for.
+type usageSet struct {
+	index map[string]bool
+	pool  map[string]bool
+}
+
+func newUsageSet() usageSet {
+	return usageSet{index: map[string]bool{}, pool: map[string]bool{}}
+}
+
+// Get every blob in the set, whatever it's used for.
+func (u usageSet) all() map[string]bool {
+	ret := map[string]bool{}
+	for id := range u.index {
+		ret[id] = true
+	}
+	for id := range u.pool {
+		ret[id] = true
+	}
+	return ret
+}
+
+// Work out how much of the Store the Archive is using, broken down by
+// Suite (and Snapshot), Component, and indices versus pool files, for
+// planning capacity, or finding the Suite that's been growing without
+// bound.
+//
+// This reads every published Release file and index, and looks up every
+// published path, which on a FilesystemStore means hashing every file.
+func (a Archive) Usage() (*Usage, error) {
+	targets, err := a.Store.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	/* Object ID of everything published, and the size of every blob */
+	objects := map[string]string{}
+	sizes := map[string]int64{}
+	for _, target := range targets {
+		obj, err := a.Store.Lookup(target)
+		if err != nil {
+			/* Not linked to a blob, so it's not using any of the Store */
+			continue
+		}
+		objects[target] = obj.ID
+		if _, ok := sizes[obj.ID]; ok {
+			continue
+		}
+		info, err := a.Store.Stat(*obj)
+		if err != nil {
+			return nil, err
+		}
+		sizes[obj.ID] = info.Size
+	}
+
+	ret := Usage{Suites: []SuiteUsage{}}
+	for _, size := range sizes {
+		ret.LinkedBytes += size
+	}
+
+	garbage, err := a.Store.Garbage()
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range garbage {
+		info, err := a.Store.Stat(obj)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ret.GarbageBytes += info.Size
+	}
+
+	/* What each Suite, and each Component of each Suite, refers to */
+	suites := map[string]usageSet{}
+	components := map[string]map[string]usageSet{}
+	for _, target := range targets {
+		if !strings.HasPrefix(target, "dists/") || !isSuiteRelease(target) {
+			continue
+		}
+		name := strings.TrimPrefix(path.Dir(target), "dists/")
+		suite, suiteComponents, err := a.suiteUsage(target, objects)
+		if err != nil {
+			return nil, err
+		}
+		suites[name] = suite
+		components[name] = suiteComponents
+	}
+
+	/* How many Suites, and Components, use each blob */
+	suiteUsers := map[string]int{}
+	componentUsers := map[string]int{}
+	for name, suite := range suites {
+		for id := range suite.all() {
+			suiteUsers[id]++
+		}
+		for _, component := range components[name] {
+			for id := range component.all() {
+				componentUsers[id]++
+			}
+		}
+	}
+	for id, users := range suiteUsers {
+		if users > 1 {
+			ret.SharedBytes += sizes[id]
+		}
+	}
+	referenced := map[string]bool{}
+	for id := range suiteUsers {
+		referenced[id] = true
+	}
+	for id, size := range sizes {
+		if !referenced[id] {
+			ret.UnreferencedBytes += size
+		}
+	}
+
+	names := []string{}
+	for name := range suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		suite := suites[name]
+		usage := SuiteUsage{Suite: name, Components: []ComponentUsage{}}
+		for id := range suite.index {
+			usage.IndexBytes += sizes[id]
+		}
+		for id := range suite.pool {
+			usage.PoolBytes += sizes[id]
+		}
+		for id := range suite.all() {
+			if suiteUsers[id] > 1 {
+				usage.SharedBytes += sizes[id]
+			} else {
+				usage.UniqueBytes += sizes[id]
+			}
+		}
+
+		componentNames := []string{}
+		for componentName := range components[name] {
+			componentNames = append(componentNames, componentName)
+		}
+		sort.Strings(componentNames)
+		for _, componentName := range componentNames {
+			component := components[name][componentName]
+			componentUsage := ComponentUsage{Component: componentName}
+			for id := range component.index {
+				componentUsage.IndexBytes += sizes[id]
+			}
+			for id := range component.pool {
+				componentUsage.PoolBytes += sizes[id]
+			}
+			for id := range component.all() {
+				if componentUsers[id] > 1 {
+					componentUsage.SharedBytes += sizes[id]
+				}
+			}
+			usage.Components = append(usage.Components, componentUsage)
+		}
+		ret.Suites = append(ret.Suites, usage)
+	}
+	return &ret, nil
+}
+
+// Find every blob the Suite with its Release at `target` uses, and every
+// blob each of its Components uses, by Component.
+func (a Archive) suiteUsage(
+	target string,
+	objects map[string]string,
+) (usageSet, map[string]usageSet, error) {
+	suite := newUsageSet()
+	components := map[string]usageSet{}
+
+	dir := path.Dir(target)
+	for _, name := range []string{"Release", "Release.gpg", "InRelease"} {
+		if id, ok := objects[path.Join(dir, name)]; ok {
+			suite.index[id] = true
+		}
+	}
+
+	fd, err := a.OpenPath(target)
+	if err != nil {
+		return suite, nil, err
+	}
+	release, err := LoadInRelease(fd, nil)
+	fd.Close()
+	if err != nil {
+		return suite, nil, err
+	}
+	for _, name := range release.Components {
+		components[name] = newUsageSet()
+	}
+
+	for filename := range release.Indices() {
+		indexPath := path.Join(dir, filename)
+		id, ok := objects[indexPath]
+		if !ok {
+			continue
+		}
+		suite.index[id] = true
+
+		/* Indices of a Component live under a directory named after it,
+		 * which may itself have a "/" in it (such as "updates/main") */
+		component := ""
+		for name := range components {
+			if strings.HasPrefix(filename, name+"/") && len(name) > len(component) {
+				component = name
+			}
+		}
+		if component != "" {
+			components[component].index[id] = true
+		}
+
+		references := map[string]bool{}
+		switch stripCompression(path.Base(indexPath)) {
+		case "Packages":
+			err = a.addPackagesReferences(indexPath, references)
+		case "Sources":
+			err = a.addSourcesReferences(indexPath, references)
+		}
+		if err != nil {
+			return suite, nil, err
+		}
+		for poolPath := range references {
+			id, ok := objects[poolPath]
+			if !ok {
+				continue
+			}
+			suite.pool[id] = true
+			if component != "" {
+				components[component].pool[id] = true
+			}
+		}
+	}
+	return suite, components, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
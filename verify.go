@@ -0,0 +1,559 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+
+	"pault.ag/go/debian/control"
+)
+
+// Verify {{{
+
+// Problem is a single thing found wrong with an Archive by Verify.
+type Problem struct {
+	// Path (relative to the root of the Archive) the Problem was found at.
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Reason)
+}
+
+// VerifyReport is the result of walking an Archive with Verify.
+type VerifyReport struct {
+	// How many Release files, indices and pool files were checked.
+	Releases int `json:"releases"`
+	Indices  int `json:"indices"`
+	Files    int `json:"files"`
+
+	Problems []Problem `json:"problems"`
+}
+
+// Check to see if Verify found nothing wrong.
+func (r VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (v *verifier) problem(path string, format string, args ...interface{}) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.report.Problems = append(v.report.Problems, Problem{
+		Path:   path,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// Walk the Archive on the filesystem at `root`, and check it, just like
+// Archive.Verify. Nothing under `root` is modified.
+func Verify(root string, keyring openpgp.EntityList) (*VerifyReport, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Only used to read, so there's no need to set up the .blobs dir */
+	store := FilesystemStore{root: root}
+	v := verifier{
+		open: func(target string) (io.ReadCloser, error) {
+			return os.Open(store.targetPath(target))
+		},
+		list:    store.List,
+		keyring: keyring,
+	}
+	return v.verify()
+}
+
+// Walk every Release file under dists/ (or InRelease file, for a Suite
+// without a Release), and check that it's signed by a key in the keyring
+// (if the keyring isn't nil), that every index it lists exists with the
+// declared size and hashes, and that every file listed by the Packages
+// and Sources indices exists in the pool with the declared size and hash.
+//
+// Pool files are checked a few at a time, one per CPU.
+//
+// Anything wrong is recorded in the returned VerifyReport; an error is
+// only returned if the Archive couldn't be walked at all.
+func (a Archive) Verify(keyring openpgp.EntityList) (*VerifyReport, error) {
+	v := verifier{
+		open:    a.OpenPath,
+		list:    a.Store.List,
+		keyring: keyring,
+	}
+	return v.verify()
+}
+
+// Check the Suites of a mirror (or any other repository) served over HTTP,
+// just like Archive.Verify, with `workers` pool files being fetched and
+// checked at once (or one per CPU, if `workers` is less than 1). Since
+// there's no way to list what's on the mirror, the Suites to check (such
+// as "bookworm" or "bookworm-updates") have to be given.
+//
+// The VerifyReport can be encoded as JSON, for other tools to read.
+func VerifyRemote(
+	remote *Remote,
+	suites []string,
+	keyring openpgp.EntityList,
+	workers int,
+) (*VerifyReport, error) {
+	if len(suites) == 0 {
+		return nil, fmt.Errorf("At least one suite is required")
+	}
+	v := verifier{
+		open:    remote.Open,
+		exists:  remote.Exists,
+		suites:  suites,
+		keyring: keyring,
+		workers: workers,
+	}
+	return v.verify()
+}
+
+type verifier struct {
+	open    func(string) (io.ReadCloser, error)
+	list    func(string) ([]string, error)
+	keyring openpgp.EntityList
+
+	/* For repositories that can't be listed, the Suites to check, and how
+	 * to find out if a file is there */
+	suites []string
+	exists func(string) (bool, error)
+
+	/* How many pool files to check at once; one per CPU if less than 1 */
+	workers   int
+	poolFiles chan poolFile
+
+	lock      sync.Mutex
+	report    VerifyReport
+	checked   map[string]bool
+	published map[string]bool
+}
+
+// A pool file to be checked against the hash its index gives for it.
+type poolFile struct {
+	index  string
+	target string
+	hash   control.FileHash
+}
+
+// Compression extensions an index may be published with.
+var indexCompressions = []string{"", ".gz", ".xz", ".bz2", ".lzma", ".zst"}
+
+func (v *verifier) verify() (*VerifyReport, error) {
+	v.checked = map[string]bool{}
+	v.published = map[string]bool{}
+	v.report.Problems = []Problem{}
+
+	dirs := []string{}
+	if v.list != nil {
+		targets, err := v.list("dists")
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			v.published[target] = true
+		}
+		for _, target := range targets {
+			dir := path.Dir(target)
+			if isSuiteRelease(target) {
+				dirs = append(dirs, dir)
+			} else if path.Base(target) == "InRelease" && !v.published[path.Join(dir, "Release")] {
+				/* A Suite with only an InRelease */
+				dirs = append(dirs, dir)
+			}
+		}
+	} else {
+		for _, suite := range v.suites {
+			dirs = append(dirs, path.Join("dists", suite))
+		}
+	}
+
+	workers := v.workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	v.poolFiles = make(chan poolFile)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range v.poolFiles {
+				v.checkPoolFile(file)
+			}
+		}()
+	}
+
+	for _, dir := range dirs {
+		v.report.Releases++
+		v.verifyRelease(dir)
+	}
+	close(v.poolFiles)
+	wg.Wait()
+
+	/* Pool files are checked in whatever order the workers get to them */
+	sort.SliceStable(v.report.Problems, func(i, j int) bool {
+		return v.report.Problems[i].Path < v.report.Problems[j].Path
+	})
+	return &v.report, nil
+}
+
+// Check if anything is published at `target`; from the listing, or, for a
+// repository that can't be listed, by asking.
+func (v *verifier) isPublished(target string) bool {
+	if v.list != nil {
+		return v.published[target]
+	}
+	if published, ok := v.published[target]; ok {
+		return published
+	}
+	published, err := v.exists(target)
+	if err != nil {
+		v.problem(target, "%s", err)
+	}
+	v.published[target] = published
+	return published
+}
+
+func (v *verifier) verifyRelease(dir string) {
+	if v.keyring != nil {
+		v.verifySignatures(dir)
+	}
+
+	releasePath := path.Join(dir, "Release")
+	inReleasePath := path.Join(dir, "InRelease")
+	if !v.isPublished(releasePath) && v.isPublished(inReleasePath) {
+		/* apt is fine with only an InRelease, so long as it's signed */
+		releasePath = inReleasePath
+	}
+
+	fd, err := v.open(releasePath)
+	if err != nil {
+		v.problem(releasePath, "%s", err)
+		return
+	}
+	release, err := v.loadRelease(fd, releasePath == inReleasePath)
+	fd.Close()
+	if err != nil {
+		v.problem(releasePath, "Can't parse Release: %s", err)
+		return
+	}
+
+	/* Group the indices by their name without any compression, since
+	 * only one of each needs to actually exist */
+	indices := release.Indices()
+	groups := map[string]bool{}
+	bases := []string{}
+	for filename := range indices {
+		base := stripCompression(filename)
+		if !groups[base] {
+			groups[base] = true
+			bases = append(bases, base)
+		}
+	}
+	sort.Strings(bases)
+
+	for _, base := range bases {
+		found := ""
+		for _, ext := range indexCompressions {
+			filename := base + ext
+			hashes, ok := indices[filename]
+			indexPath := path.Join(dir, filename)
+			if !ok || !v.isPublished(indexPath) {
+				continue
+			}
+			v.report.Indices++
+			if !v.verifyFile(indexPath, hashes) {
+				continue
+			}
+			if found == "" {
+				found = indexPath
+			}
+		}
+
+		if found == "" {
+			if !v.anyPublished(path.Join(dir, base)) {
+				v.problem(path.Join(dir, base), "Listed in Release, but not published")
+			}
+			continue
+		}
+
+		switch path.Base(base) {
+		case "Packages":
+			v.verifyPackages(found)
+		case "Sources":
+			v.verifySources(found)
+		}
+	}
+}
+
+// Check to see if any compression of the index is published at all, even
+// if it's not listed in the Release (which is reported as a hash mismatch
+// or not at all).
+func (v *verifier) anyPublished(base string) bool {
+	for _, ext := range indexCompressions {
+		if v.isPublished(base + ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripCompression(filename string) string {
+	for _, ext := range indexCompressions[1:] {
+		if strings.HasSuffix(filename, ext) {
+			return strings.TrimSuffix(filename, ext)
+		}
+	}
+	return filename
+}
+
+// Check the InRelease and Release.gpg signatures against the keyring.
+func (v *verifier) verifySignatures(dir string) {
+	inReleasePath := path.Join(dir, "InRelease")
+	gpgPath := path.Join(dir, "Release.gpg")
+
+	if !v.isPublished(inReleasePath) && !v.isPublished(gpgPath) {
+		v.problem(path.Join(dir, "Release"), "Not signed")
+		return
+	}
+
+	if v.isPublished(inReleasePath) {
+		if err := v.verifyInRelease(inReleasePath); err != nil {
+			v.problem(inReleasePath, "Bad signature: %s", err)
+		}
+	}
+
+	if v.isPublished(gpgPath) {
+		if err := v.verifyDetached(path.Join(dir, "Release"), gpgPath); err != nil {
+			v.problem(gpgPath, "Bad signature: %s", err)
+		}
+	}
+}
+
+// Parse a Release file, or the Release clearsigned in an InRelease file,
+// without checking the signature; that's left to verifySignatures.
+func (v *verifier) loadRelease(in io.Reader, clearsigned bool) (*Release, error) {
+	if clearsigned {
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := clearsign.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("Not OpenPGP clearsigned")
+		}
+		in = bytes.NewReader(block.Plaintext)
+	}
+	return LoadInRelease(in, nil)
+}
+
+func (v *verifier) verifyInRelease(target string) error {
+	fd, err := v.open(target)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	_, err = LoadInRelease(fd, &v.keyring)
+	return err
+}
+
+func (v *verifier) verifyDetached(target, sigPath string) error {
+	sig, err := v.open(sigPath)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	sigData, err := io.ReadAll(sig)
+	if err != nil {
+		return err
+	}
+
+	fd, err := v.open(target)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if bytes.HasPrefix(bytes.TrimSpace(sigData), []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(v.keyring, fd, bytes.NewReader(sigData), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(v.keyring, fd, bytes.NewReader(sigData), nil)
+	}
+	return err
+}
+
+// Check the file at `target` against every hash given, recording any
+// mismatch. This returns true if the file matched.
+func (v *verifier) verifyFile(target string, hashes []control.FileHash) bool {
+	for _, hash := range hashes {
+		fd, err := v.open(target)
+		if err != nil {
+			v.problem(target, "%s", err)
+			return false
+		}
+		err = verifyHash(target, fd, hash)
+		fd.Close()
+		if err != nil {
+			v.problem(target, "%s", err)
+			return false
+		}
+	}
+	return true
+}
+
+// Check a pool file against the strongest hash an index gives for it, only
+// checking each pool file once.
+func (v *verifier) verifyPoolFile(index, target string, hash control.FileHash) {
+	if v.checked[target] {
+		return
+	}
+	v.checked[target] = true
+	v.report.Files++
+
+	v.poolFiles <- poolFile{index: index, target: target, hash: hash}
+}
+
+// Check a single pool file; run by each of the workers.
+func (v *verifier) checkPoolFile(file poolFile) {
+	fd, err := v.open(file.target)
+	if os.IsNotExist(err) {
+		v.problem(file.target, "Listed in %s, but not in the pool", file.index)
+		return
+	}
+	if err != nil {
+		v.problem(file.target, "%s", err)
+		return
+	}
+	defer fd.Close()
+
+	if err := verifyHash(file.target, fd, file.hash); err != nil {
+		v.problem(file.target, "%s", err)
+	}
+}
+
+func (v *verifier) openIndex(target string) (io.Reader, io.Closer, bool) {
+	fd, err := v.open(target)
+	if err != nil {
+		v.problem(target, "%s", err)
+		return nil, nil, false
+	}
+	reader, err := decompress(fd)
+	if err != nil {
+		fd.Close()
+		v.problem(target, "%s", err)
+		return nil, nil, false
+	}
+	return reader, fd, true
+}
+
+func (v *verifier) verifyPackages(target string) {
+	reader, closer, ok := v.openIndex(target)
+	if !ok {
+		return
+	}
+	defer closer.Close()
+
+	packages, err := LoadPackages(reader)
+	if err != nil {
+		v.problem(target, "%s", err)
+		return
+	}
+
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			v.problem(target, "%s", err)
+			return
+		}
+
+		hash, ok := packageFileHash(*pkg)
+		if !ok {
+			v.problem(target, "%s %s has no checksums", pkg.Package, pkg.Version)
+			continue
+		}
+		v.verifyPoolFile(target, pkg.Filename, hash)
+	}
+}
+
+// Get the strongest hash a Package entry gives for its pool file, if it
+// has any at all.
+func packageFileHash(pkg Package) (control.FileHash, bool) {
+	hash := control.FileHash{Filename: pkg.Filename, Size: int64(pkg.Size)}
+	switch {
+	case pkg.SHA256 != "":
+		hash.Algorithm, hash.Hash = "sha256", pkg.SHA256
+	case pkg.SHA1 != "":
+		hash.Algorithm, hash.Hash = "sha1", pkg.SHA1
+	case pkg.MD5sum != "":
+		hash.Algorithm, hash.Hash = "md5", pkg.MD5sum
+	default:
+		return hash, false
+	}
+	return hash, true
+}
+
+func (v *verifier) verifySources(target string) {
+	reader, closer, ok := v.openIndex(target)
+	if !ok {
+		return
+	}
+	defer closer.Close()
+
+	sources, err := LoadSources(reader)
+	if err != nil {
+		v.problem(target, "%s", err)
+		return
+	}
+
+	for {
+		src, err := sources.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			v.problem(target, "%s", err)
+			return
+		}
+
+		for filename, hash := range sourceFileHashes(*src) {
+			v.verifyPoolFile(target, path.Join(src.Directory, filename), hash)
+		}
+	}
+}
+
+// Get the strongest hash a Source entry gives for each of its files, by
+// Filename.
+func sourceFileHashes(src Source) map[string]control.FileHash {
+	hashes := map[string]control.FileHash{}
+	for _, el := range src.Files {
+		hashes[el.Filename] = el.FileHash
+	}
+	for _, el := range src.ChecksumsSha1 {
+		hashes[el.Filename] = el.FileHash
+	}
+	for _, el := range src.ChecksumsSha256 {
+		hashes[el.Filename] = el.FileHash
+	}
+	return hashes
+}
+
+// }}}
+
+// vim: foldmethod=marker
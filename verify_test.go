@@ -0,0 +1,52 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Verify {{{
+
+func TestVerifyInReleaseOnly(t *testing.T) {
+	key := newTestKey(t)
+	root := t.TempDir()
+	a, err := New(root, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := a.Engross(*suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Link(files); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Release", "Release.gpg"} {
+		if err := os.Remove(filepath.Join(root, "dists/unstable", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Verify(root, openpgp.EntityList{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Releases != 1 {
+		t.Errorf("Expected 1 Release to be checked, got %d", report.Releases)
+	}
+	if !report.OK() {
+		t.Errorf("Suite with only an InRelease failed to verify: %v", report.Problems)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker